@@ -10,10 +10,9 @@ import (
 	"go.uber.org/zap"
 )
 
-var (
-	MaxPodsCnt = 1
-	url        = config.GetConfig().CotelligenceRwaEndpoint
-)
+// MaxPodsCnt is read from the RWA endpoint, the config is only loaded once it is polled so importing the package
+// does not need it
+var MaxPodsCnt = 1
 
 type Data struct {
 	ID int `json:"id"`
@@ -23,7 +22,7 @@ func UpdateMaxPodsCnt() {
 	ticker := time.NewTicker(10 * time.Second)
 	go func() {
 		for range ticker.C {
-			resp, err := http.Get(url)
+			resp, err := http.Get(config.GetConfig().CotelligenceRwaEndpoint)
 			if err != nil {
 				// handle error
 				continue
@@ -19,6 +19,10 @@ type Config struct {
 	DbDsn                   string
 	DBConns                 int
 	DBConnsIdle             int
+	WebhookSecret           string
+	AdminAPIKey             string
+	// WeightsUploadURL is the url prefix cog uploads trained weights to
+	WeightsUploadURL string
 }
 
 func GetConfig() Config {
@@ -34,6 +38,9 @@ func GetConfig() Config {
 			DbDsn:                   os.Getenv("DB_DSN"),
 			DBConns:                 dbConns,
 			DBConnsIdle:             dbConnsIdle,
+			WebhookSecret:           os.Getenv("WEBHOOK_SECRET"),
+			AdminAPIKey:             os.Getenv("ADMIN_API_KEY"),
+			WeightsUploadURL:        os.Getenv("WEIGHTS_UPLOAD_URL"),
 		}
 
 		if conf.RunPodAPIKey == "" {
@@ -4,12 +4,46 @@ import (
 	"cotelligence-model-hub/openapi"
 	"cotelligence-model-hub/version"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
+// predictionErrorStatus maps a SubmitPrediction error to its http status, setting Retry-After when rate limited
+func predictionErrorStatus(c *gin.Context, err error) int {
+	var invalidRequestError *InvalidRequestError
+	var rateLimitError *RateLimitError
+	var inputValidationError *InputValidationError
+	switch {
+	case errors.As(err, &inputValidationError):
+		return http.StatusUnprocessableEntity
+	case errors.As(err, &invalidRequestError):
+		return http.StatusBadRequest
+	case errors.As(err, &rateLimitError):
+		setRetryAfter(c, rateLimitError.RetryAfter)
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrInsufficientCredits):
+		return http.StatusPaymentRequired
+	case errors.Is(err, ErrModelNotAllowed):
+		return http.StatusForbidden
+	case errors.Is(err, ErrModelNotFound), errors.Is(err, ErrModelVersionNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrModelDeleted):
+		return http.StatusGone
+	case errors.Is(err, ErrVersionBreaksContract):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// errBillingAdminOnly is returned when a key without the admin scope sets the prices or limits of a model
+const errBillingAdminOnly = "only admin keys can set the prices and limits of a model"
+
 func registerModelHandler(c *gin.Context) {
 	var body Model
 	if err := c.ShouldBindJSON(&body); err != nil {
@@ -17,7 +51,36 @@ func registerModelHandler(c *gin.Context) {
 		return
 	}
 
+	// keys of an organization register models into it, admins may pick any organization
+	apiKey := currentAPIKey(c)
+	if !apiKey.HasScope(ScopeAdmin) {
+		if apiKey.Org == "" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "api key does not belong to an organization"})
+			return
+		}
+		body.Org = apiKey.Org
+		// prices and limits are billing settings, organizations can not pick their own
+		if body.PricePerSecond != 0 || body.PricePerOutput != 0 || body.RateLimit != 0 || body.MaxConcurrentTasks != 0 {
+			c.JSON(http.StatusForbidden, gin.H{"error": errBillingAdminOnly})
+			return
+		}
+	}
+
 	model, err := RegisterModel(body)
+	var invalidRequestError *InvalidRequestError
+	if errors.As(err, &invalidRequestError) || errors.Is(err, ErrOrgNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, ErrModelDeleted) {
+		c.JSON(http.StatusGone, gin.H{"error": "model is deleted, restore it before registering a new image"})
+		return
+	}
+	var contractError *openapi.ContractError
+	if errors.As(err, &contractError) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "violations": contractError.Violations})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -26,33 +89,81 @@ func registerModelHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, model)
 }
 
+// listModelsHandler lists the catalog filtered by ?type=, ?tag= (repeated or comma separated) and ?q=, a page of
+// ?limit= models from ?offset= at a time. The number of matching models is in the X-Total-Count header
 func listModelsHandler(c *gin.Context) {
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if offset < 0 || limit <= 0 || limit > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "offset must be positive and limit between 1 and 1000"})
+		return
+	}
+	var tags []string
+	for _, tag := range c.QueryArray("tag") {
+		tags = append(tags, strings.Split(tag, ",")...)
+	}
+	tags, err := normalizeTags(tags)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filter := ModelFilter{Type: ModelType(c.Query("type")), Tags: tags, Query: strings.TrimSpace(c.Query("q"))}
+
 	models, err := GetAllModels()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, models)
+	// private models of other organizations are hidden, deleted models are listed with ?deleted=true to their managers
+	apiKey := currentAPIKey(c)
+	deleted := c.Query("deleted") == "true"
+	visibleModels := make([]Model, 0, len(models))
+	for _, model := range models {
+		if !apiKey.CanSeeModel(model) || model.IsDeleted() != deleted {
+			continue
+		}
+		if deleted && !apiKey.CanManageModel(model) {
+			continue
+		}
+		visibleModels = append(visibleModels, model)
+	}
+
+	page, total := SearchModels(visibleModels, filter, offset, limit)
+	c.Header("X-Total-Count", strconv.Itoa(total))
+	c.JSON(http.StatusOK, page)
 }
 
 func startPredictionHandler(c *gin.Context) {
-	taskId := GenerateTaskID()
 	// Parse the incoming JSON body
 	var predictionParams map[string]interface{}
 	if err := c.ShouldBindJSON(&predictionParams); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON body"})
 		return
 	}
-	err := RecordTask(Task{ID: taskId, ModelId: c.Param("modelUUID"), Body: predictionParams})
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"db error": err.Error()})
+	// Stream the result in the same response when the caller accepts an event stream
+	if wantsEventStream(c) {
+		predictionParams["stream"] = true
 	}
+	stream, _ := predictionParams["stream"].(bool)
 	// Check if the request is synchronous, default to sync
 	sync := c.Query("sync") != "false"
 
-	// If the request is synchronous, wait for the task to complete and return the result
-	if sync {
+	taskId, err := SubmitPrediction(currentAPIKey(c), c.Param("modelUUID"), predictionParams)
+	var inputValidationError *InputValidationError
+	if errors.As(err, &inputValidationError) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid input", "violations": inputValidationError.Violations})
+		return
+	}
+	if err != nil {
+		c.JSON(predictionErrorStatus(c, err), gin.H{"error": err.Error()})
+		return
+	}
+
+	// If the request is synchronous, stream the events or wait for the task to complete and return the result
+	if sync && stream {
+		streamTaskEvents(c, taskId)
+	} else if sync {
 		result, err := waitForTaskCompletion(taskId)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -87,45 +198,165 @@ func listBindingsHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, bindings)
 }
 
+// getManagedModel returns the model if the caller can manage it, models the caller can not see are reported as not found
+func getManagedModel(c *gin.Context) (Model, bool) {
+	apiKey := currentAPIKey(c)
+	model, ok := GetModel(c.Param("modelUUID"))
+	if !ok || !apiKey.CanSeeModel(model) {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrModelNotFound.Error()})
+		return Model{}, false
+	}
+	if !apiKey.CanManageModel(model) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "api key can not manage this model"})
+		return Model{}, false
+	}
+	return model, true
+}
+
 func updateModelHandler(c *gin.Context) {
 	modelUUID := c.Param("modelUUID")
+	model, ok := getManagedModel(c)
+	if !ok {
+		return
+	}
 
 	var body struct {
-		MaxInstanceCnt int       `json:"max_instance_cnt"`
-		MinInstanceCnt int       `json:"min_instance_cnt"`
-		Type           ModelType `json:"type"`
+		// the instance counts and type left out are unchanged
+		MaxInstanceCnt *int       `json:"max_instance_cnt"`
+		MinInstanceCnt *int       `json:"min_instance_cnt"`
+		Type           *ModelType `json:"type"`
+		// the limits and prices left out are unchanged
+		RateLimit          *float64 `json:"rate_limit"`
+		MaxConcurrentTasks *int     `json:"max_concurrent_tasks"`
+		PricePerSecond     *int64   `json:"price_per_second"`
+		PricePerOutput     *int64   `json:"price_per_output"`
+		// Visibility is left unchanged when empty
+		Visibility ModelVisibility `json:"visibility"`
+		// the catalog metadata left out is unchanged
+		Description    *string   `json:"description"`
+		Tags           *[]string `json:"tags"`
+		License        *string   `json:"license"`
+		Owner          *string   `json:"owner"`
+		ExampleOutputs *[]string `json:"example_outputs"`
 	}
 	if err := c.ShouldBindJSON(&body); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	// prices and limits are billing settings, organizations can not change their own
+	isAdmin := currentAPIKey(c).HasScope(ScopeAdmin)
+	if !isAdmin && (body.PricePerSecond != nil || body.PricePerOutput != nil || body.RateLimit != nil || body.MaxConcurrentTasks != nil) {
+		c.JSON(http.StatusForbidden, gin.H{"error": errBillingAdminOnly})
+		return
+	}
+	if body.Description != nil {
+		model.Description = *body.Description
+	}
+	if body.Tags != nil {
+		model.Tags = *body.Tags
+	}
+	if body.License != nil {
+		model.License = *body.License
+	}
+	if body.Owner != nil {
+		model.Owner = *body.Owner
+	}
+	if body.ExampleOutputs != nil {
+		model.ExampleOutputs = *body.ExampleOutputs
+	}
+	if err := validateCatalog(&model); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if body.Type != nil {
+		if err := validateModelType(*body.Type); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		// the current spec must match the contract of the new type
+		if *body.Type != model.Type && model.SpecStatus == SpecReady {
+			if err := checkModelContract(*body.Type, modelUUID, ""); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+	}
+	if body.Visibility != "" && body.Visibility != Public && body.Visibility != Private {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "visibility must be public or private"})
+		return
+	}
 
+	// the request is checked in full above so that a bad one changes nothing
 	err := UpdateModelInstanceCnt(modelUUID, body.MaxInstanceCnt, body.MinInstanceCnt, body.Type)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if isAdmin {
+		err = UpdateModelLimits(modelUUID, body.RateLimit, body.MaxConcurrentTasks)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		err = UpdateModelPrice(modelUUID, body.PricePerSecond, body.PricePerOutput)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if body.Visibility != "" {
+		err = UpdateModelVisibility(modelUUID, body.Visibility)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	err = UpdateModelCatalog(model)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{"status": "updated"})
 }
 
+// removeModelHandler deletes the model, it can be restored during ModelRestoreWindow unless ?purge=true
 func removeModelHandler(c *gin.Context) {
-	modelUUID := c.Param("modelUUID")
+	model, ok := getManagedModel(c)
+	if !ok {
+		return
+	}
 
-	err := RemoveModel(modelUUID)
+	model, err := DeleteModel(model)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if c.Query("purge") == "true" {
+		if err := PurgeModel(model.UUID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "purged"})
+		return
+	}
 
-	c.JSON(http.StatusOK, gin.H{"status": "removed"})
+	c.JSON(http.StatusOK, gin.H{"status": "deleted", "restore_until": model.DeletedAt.Add(ModelRestoreWindow)})
 }
 
 func getModelHandler(c *gin.Context) {
 	modelUUID := c.Param("modelUUID")
+	model, ok := getVisibleModel(c)
+	if !ok {
+		return
+	}
 
 	// Use the GetSampleIO function to get the sample input and output
 	reqExample, resExample, err := openapi.GetSampleIO(modelUUID)
+	if errors.Is(err, openapi.ErrSpecNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error(), "spec_status": model.SpecStatus, "spec_error": model.SpecError})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -144,11 +375,19 @@ func getModelHandler(c *gin.Context) {
 		return
 	}
 
+	// Document every input field
+	fields, err := openapi.GetInputDocs(modelUUID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
 	// Return the sample input and output as JSON
 	c.JSON(http.StatusOK, gin.H{
 		"modelUUID": modelUUID,
 		"input":     inputObj,
 		"output":    outputObj,
+		"fields":    fields,
 	})
 }
 
@@ -156,9 +395,9 @@ func GetTaskHandler(c *gin.Context) {
 	// Get the task ID from the URL
 	taskID := c.Param("taskId")
 	// Get the task details from the database
-	task, err := GetTask(taskID)
+	task, err := getOwnTask(c, taskID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
 
@@ -166,25 +405,104 @@ func GetTaskHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, task)
 }
 
+func cancelTaskHandler(c *gin.Context) {
+	if _, err := getOwnTask(c, c.Param("taskId")); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	err := CancelTask(c.Param("taskId"))
+	if errors.Is(err, ErrTaskNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, ErrTaskCompleted) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "canceling"})
+}
+
 func SetupRouter() *gin.Engine {
 	router := gin.Default()
 
-	router.POST("/register-model", registerModelHandler)
-	router.POST("/prediction/:modelUUID", startPredictionHandler)
-	router.GET("/models", listModelsHandler)
-	router.GET("/model/:modelUUID", getModelHandler)
-	router.PUT("/model/:modelUUID", updateModelHandler)
-	router.DELETE("/model/:modelUUID", removeModelHandler)
-	router.GET("/pods", listPodsHandler)
-	router.GET("/bindings", listBindingsHandler)
 	router.GET("/health",
 		func(c *gin.Context) {
 			c.JSON(http.StatusOK, version.GetAppInfo())
 		})
+	// called by cog on the pods
 	router.POST("/webhook/:taskId", WebhookHandler)
-	router.GET("/sse/:taskId", SSEHandler)
-	router.GET("/ws/:taskId", WebSocketHandler)
-	router.GET("/task/:taskId", GetTaskHandler)
+	router.POST("/training-webhook/:trainingId", trainingWebhookHandler)
+
+	// Any valid api key
+	authenticated := router.Group("/", RequireAPIKey())
+	authenticated.GET("/models", listModelsHandler)
+	authenticated.GET("/model-types", listModelTypesHandler)
+	authenticated.GET("/model/:modelUUID", getModelHandler)
+	authenticated.GET("/model/:modelUUID/openapi.json", modelOpenAPIHandler)
+	authenticated.GET("/model/:modelUUID/versions", listModelVersionsHandler)
+	authenticated.GET("/model/:modelUUID/versions/:version", getModelVersionHandler)
+	authenticated.GET("/openapi.json", hubOpenAPIHandler)
+	authenticated.GET("/credits", getCreditBalanceHandler)
+	authenticated.GET("/credits/ledger", getCreditLedgerHandler)
+
+	// Predictions
+	predict := router.Group("/", RequireAPIKey(ScopePredict))
+	predict.POST("/prediction/:modelUUID", startPredictionHandler)
+	predict.POST("/task/:taskId/cancel", cancelTaskHandler)
+	// OpenAI compatible API
+	predict.POST("/v1/chat/completions", chatCompletionsHandler)
+	predict.POST("/v1/completions", completionsHandler)
+	predict.POST("/v1/images/generations", imageGenerationsHandler)
+	// Replicate compatible API
+	predict.POST("/v1/predictions", createReplicatePredictionHandler)
+	predict.POST("/v1/predictions/:predictionId/cancel", cancelReplicatePredictionHandler)
+
+	// Reading the caller's own tasks
+	readTasks := router.Group("/", RequireAPIKey(ScopePredict, ScopeReadTasks))
+	readTasks.GET("/sse/:taskId", SSEHandler)
+	readTasks.GET("/ws", WebSocketHandler)
+	readTasks.GET("/ws/:taskId", WebSocketHandler)
+	readTasks.GET("/task/:taskId", GetTaskHandler)
+	readTasks.GET("/task/:taskId/webhooks", listTaskWebhooksHandler)
+	readTasks.GET("/v1/predictions/:predictionId", getReplicatePredictionHandler)
+	readTasks.GET("/usage", usageHandler)
+
+	// Managing the models of the caller's organization
+	models := router.Group("/", RequireAPIKey(ScopeModels))
+	models.POST("/register-model", registerModelHandler)
+	models.PUT("/model/:modelUUID", updateModelHandler)
+	models.DELETE("/model/:modelUUID", removeModelHandler)
+	models.POST("/model/:modelUUID/restore", restoreModelHandler)
+	models.POST("/model/:modelUUID/spec/refresh", refreshModelSpecHandler)
+	models.POST("/model/:modelUUID/versions", createModelVersionHandler)
+	models.POST("/model/:modelUUID/versions/:version/promote", promoteModelVersionHandler)
+	models.GET("/model/:modelUUID/traffic", getTrafficHandler)
+	models.PUT("/model/:modelUUID/traffic", setTrafficHandler)
+	models.DELETE("/model/:modelUUID/traffic", clearTrafficHandler)
+	models.POST("/model/:modelUUID/rollout", startRolloutHandler)
+	models.GET("/model/:modelUUID/rollout", getRolloutHandler)
+	models.POST("/model/:modelUUID/trainings", startTrainingHandler)
+	models.GET("/model/:modelUUID/trainings", listTrainingsHandler)
+	models.GET("/model/:modelUUID/trainings/:trainingId", getTrainingHandler)
+	models.POST("/model/:modelUUID/trainings/:trainingId/cancel", cancelTrainingHandler)
+
+	// Administration
+	admin := router.Group("/", RequireAPIKey(ScopeAdmin))
+	admin.GET("/pods", listPodsHandler)
+	admin.GET("/bindings", listBindingsHandler)
+	admin.POST("/admin/api-keys", createAPIKeyHandler)
+	admin.GET("/admin/api-keys", listAPIKeysHandler)
+	admin.PUT("/admin/api-keys/:keyId/limits", updateAPIKeyLimitsHandler)
+	admin.DELETE("/admin/api-keys/:keyId", revokeAPIKeyHandler)
+	admin.POST("/admin/api-keys/:keyId/credits", addCreditsHandler)
+	admin.POST("/admin/orgs", createOrgHandler)
+	admin.GET("/admin/orgs", listOrgsHandler)
+	admin.PUT("/admin/orgs/:org/quota", updateOrgQuotaHandler)
 
 	return router
 }
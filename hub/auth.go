@@ -0,0 +1,397 @@
+package hub
+
+import (
+	"cotelligence-model-hub/config"
+	"cotelligence-model-hub/db"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+type Scope string
+
+const (
+	ScopePredict   Scope = "predict"
+	ScopeReadTasks Scope = "read-tasks"
+	// ScopeModels manages the models of the key organization
+	ScopeModels Scope = "models"
+	// ScopeAdmin grants every other scope
+	ScopeAdmin Scope = "admin"
+)
+
+var AllScopes = []Scope{ScopePredict, ScopeReadTasks, ScopeModels, ScopeAdmin}
+
+// APIKey is stored without the key itself, callers are matched by the sha256 of their key
+type APIKey struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Prefix string   `json:"prefix"`
+	Hash   string   `json:"-"`
+	Scopes []Scope  `json:"scopes"`
+	Models []string `json:"models,omitempty"`
+	// Org is the organization the key belongs to, its private models are only visible to its keys
+	Org string `json:"org,omitempty"`
+	// RateLimit is the predictions allowed per minute with bursts up to RateBurst, 0 means unlimited
+	RateLimit          float64    `json:"rate_limit,omitempty"`
+	RateBurst          int        `json:"rate_burst,omitempty"`
+	MaxConcurrentTasks int        `json:"max_concurrent_tasks,omitempty"`
+	CreatedAt          time.Time  `json:"created_at"`
+	RevokedAt          *time.Time `json:"revoked_at,omitempty"`
+}
+
+// storedAPIKey keeps the hash, which is hidden from API responses
+type storedAPIKey struct {
+	APIKey
+	Hash string `json:"hash"`
+}
+
+func (k APIKey) HasScope(scope Scope) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// CanUseModel reports whether the model is in the key allowlist, an empty allowlist allows every model
+func (k APIKey) CanUseModel(modelUUID string) bool {
+	if len(k.Models) == 0 || k.HasScope(ScopeAdmin) {
+		return true
+	}
+	for _, m := range k.Models {
+		if m == modelUUID {
+			return true
+		}
+	}
+	return false
+}
+
+// CanSeeModel reports whether the model is public or belongs to the key organization
+func (k APIKey) CanSeeModel(model Model) bool {
+	return model.IsPublic() || k.HasScope(ScopeAdmin) || (k.Org != "" && k.Org == model.Org)
+}
+
+// CanManageModel reports whether the key may update or remove the model
+func (k APIKey) CanManageModel(model Model) bool {
+	return k.HasScope(ScopeAdmin) || (k.HasScope(ScopeModels) && k.Org != "" && k.Org == model.Org)
+}
+
+// CanAccessTask reports whether the key owns the task
+func (k APIKey) CanAccessTask(task Task) bool {
+	return k.HasScope(ScopeAdmin) || task.APIKeyId == k.ID
+}
+
+const APIKeyPrefix = "cotelligence-model:apikey"
+const APIKeyHashPrefix = "cotelligence-model:apikey-hash"
+
+const apiKeyContextKey = "apiKey"
+const apiKeyTokenPrefix = "cmh_"
+
+// adminAPIKey is the bootstrap key configured with ADMIN_API_KEY
+var adminAPIKey = APIKey{ID: "admin", Name: "admin", Scopes: []Scope{ScopeAdmin}}
+
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func saveAPIKey(key APIKey) error {
+	client := db.GetRedisClient()
+	serialized, err := json.Marshal(storedAPIKey{APIKey: key, Hash: key.Hash})
+	if err != nil {
+		return err
+	}
+	return client.Set(ctx, APIKeyPrefix+":"+key.ID, serialized, 0).Err()
+}
+
+// APIKeyLimits are the rate and concurrency limits of a key
+type APIKeyLimits struct {
+	RateLimit          float64 `json:"rate_limit"`
+	RateBurst          int     `json:"rate_burst"`
+	MaxConcurrentTasks int     `json:"max_concurrent_tasks"`
+}
+
+// CreateAPIKey issues a new key, the plain key is only returned here
+func CreateAPIKey(name, org string, scopes []Scope, models []string, limits APIKeyLimits) (string, APIKey, error) {
+	for _, scope := range scopes {
+		if !isScope(scope) {
+			return "", APIKey{}, &InvalidRequestError{Message: "invalid scope: " + string(scope)}
+		}
+	}
+	if org != "" {
+		if _, err := GetOrg(org); err != nil {
+			return "", APIKey{}, &InvalidRequestError{Message: err.Error() + ": " + org}
+		}
+	}
+	random := make([]byte, 24)
+	if _, err := rand.Read(random); err != nil {
+		return "", APIKey{}, err
+	}
+	plainKey := apiKeyTokenPrefix + base64.RawURLEncoding.EncodeToString(random)
+
+	key := APIKey{
+		ID:        uuid.New().String(),
+		Name:      name,
+		Prefix:    plainKey[:len(apiKeyTokenPrefix)+6],
+		Hash:      hashAPIKey(plainKey),
+		Scopes:    scopes,
+		Models:    models,
+		Org:       org,
+		CreatedAt: time.Now(),
+
+		RateLimit:          limits.RateLimit,
+		RateBurst:          limits.RateBurst,
+		MaxConcurrentTasks: limits.MaxConcurrentTasks,
+	}
+	if err := saveAPIKey(key); err != nil {
+		return "", APIKey{}, err
+	}
+	client := db.GetRedisClient()
+	if err := client.Set(ctx, APIKeyHashPrefix+":"+key.Hash, key.ID, 0).Err(); err != nil {
+		return "", APIKey{}, err
+	}
+	return plainKey, key, nil
+}
+
+func isScope(scope Scope) bool {
+	for _, s := range AllScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func GetAPIKey(id string) (APIKey, error) {
+	client := db.GetRedisClient()
+	val, err := client.Get(ctx, APIKeyPrefix+":"+id).Result()
+	if errors.Is(err, redis.Nil) {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return APIKey{}, err
+	}
+	var stored storedAPIKey
+	if err := json.Unmarshal([]byte(val), &stored); err != nil {
+		return APIKey{}, err
+	}
+	stored.APIKey.Hash = stored.Hash
+	return stored.APIKey, nil
+}
+
+func GetAllAPIKeys() ([]APIKey, error) {
+	client := db.GetRedisClient()
+	keys, err := client.Keys(ctx, APIKeyPrefix+":*").Result()
+	if err != nil {
+		return nil, err
+	}
+	apiKeys := make([]APIKey, 0, len(keys))
+	for _, key := range keys {
+		apiKey, err := GetAPIKey(strings.TrimPrefix(key, APIKeyPrefix+":"))
+		if err != nil {
+			return nil, err
+		}
+		apiKeys = append(apiKeys, apiKey)
+	}
+	return apiKeys, nil
+}
+
+// UpdateAPIKeyLimits replaces the rate and concurrency limits of the key
+func UpdateAPIKeyLimits(id string, limits APIKeyLimits) (APIKey, error) {
+	key, err := GetAPIKey(id)
+	if err != nil {
+		return APIKey{}, err
+	}
+	key.RateLimit = limits.RateLimit
+	key.RateBurst = limits.RateBurst
+	key.MaxConcurrentTasks = limits.MaxConcurrentTasks
+	return key, saveAPIKey(key)
+}
+
+// RevokeAPIKey stops the key from authenticating, the record is kept for auditing
+func RevokeAPIKey(id string) error {
+	key, err := GetAPIKey(id)
+	if err != nil {
+		return err
+	}
+	if key.RevokedAt != nil {
+		return nil
+	}
+	now := time.Now()
+	key.RevokedAt = &now
+	if err := saveAPIKey(key); err != nil {
+		return err
+	}
+	client := db.GetRedisClient()
+	return client.Del(ctx, APIKeyHashPrefix+":"+key.Hash).Err()
+}
+
+// AuthenticateAPIKey returns the active key matching the plain key
+func AuthenticateAPIKey(plainKey string) (APIKey, error) {
+	adminKey := config.GetConfig().AdminAPIKey
+	if adminKey != "" && subtle.ConstantTimeCompare([]byte(plainKey), []byte(adminKey)) == 1 {
+		return adminAPIKey, nil
+	}
+	client := db.GetRedisClient()
+	id, err := client.Get(ctx, APIKeyHashPrefix+":"+hashAPIKey(plainKey)).Result()
+	if errors.Is(err, redis.Nil) {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return APIKey{}, err
+	}
+	key, err := GetAPIKey(id)
+	if err != nil {
+		return APIKey{}, err
+	}
+	if key.RevokedAt != nil {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	return key, nil
+}
+
+// bearerToken reads the key from "Authorization: Bearer <key>", replicate clients send "Token <key>"
+func bearerToken(c *gin.Context) string {
+	authorization := c.GetHeader("Authorization")
+	for _, prefix := range []string{"Bearer ", "Token "} {
+		if strings.HasPrefix(authorization, prefix) {
+			return strings.TrimSpace(strings.TrimPrefix(authorization, prefix))
+		}
+	}
+	return ""
+}
+
+// RequireAPIKey authenticates the caller and checks it has at least one of the scopes, no scope means any valid key
+func RequireAPIKey(scopes ...Scope) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := bearerToken(c)
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing api key"})
+			return
+		}
+		key, err := AuthenticateAPIKey(token)
+		if errors.Is(err, ErrAPIKeyNotFound) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid api key"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		allowed := len(scopes) == 0
+		for _, scope := range scopes {
+			if key.HasScope(scope) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "api key lacks the required scope"})
+			return
+		}
+		c.Set(apiKeyContextKey, key)
+		c.Next()
+	}
+}
+
+// currentAPIKey returns the key set by RequireAPIKey
+func currentAPIKey(c *gin.Context) APIKey {
+	if value, ok := c.Get(apiKeyContextKey); ok {
+		return value.(APIKey)
+	}
+	return APIKey{}
+}
+
+// getOwnTask returns the task if the caller can access it, other callers' tasks are reported as not found
+func getOwnTask(c *gin.Context, taskID string) (Task, error) {
+	task, err := GetTask(taskID)
+	if err != nil || task.ModelId == "" || !currentAPIKey(c).CanAccessTask(task) {
+		return Task{}, ErrTaskNotFound
+	}
+	return task, nil
+}
+
+func createAPIKeyHandler(c *gin.Context) {
+	var body struct {
+		Name   string   `json:"name" binding:"required"`
+		Scopes []Scope  `json:"scopes" binding:"required"`
+		Models []string `json:"models"`
+		Org    string   `json:"org"`
+		APIKeyLimits
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	plainKey, key, err := CreateAPIKey(body.Name, body.Org, body.Scopes, body.Models, body.APIKeyLimits)
+	if err != nil {
+		var invalidRequestError *InvalidRequestError
+		if errors.As(err, &invalidRequestError) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"key": plainKey, "api_key": key})
+}
+
+func listAPIKeysHandler(c *gin.Context) {
+	keys, err := GetAllAPIKeys()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, keys)
+}
+
+func updateAPIKeyLimitsHandler(c *gin.Context) {
+	var body APIKeyLimits
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	key, err := UpdateAPIKeyLimits(c.Param("keyId"), body)
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, key)
+}
+
+func revokeAPIKeyHandler(c *gin.Context) {
+	err := RevokeAPIKey(c.Param("keyId"))
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "revoked"})
+}
@@ -0,0 +1,166 @@
+package hub
+
+import (
+	"cotelligence-model-hub/db"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// modelIndexKey is the set of the uuids of all models, so listing them does not scan the keyspace
+const modelIndexKey = "cotelligence-model:models"
+
+const (
+	maxModelTags           = 20
+	maxModelDescription    = 4000
+	maxModelExampleOutputs = 10
+)
+
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,31}$`)
+
+// ModelFilter selects models of the catalog, empty fields match every model
+type ModelFilter struct {
+	Type ModelType
+	// Tags must all be on the model
+	Tags []string
+	// Query is searched, case-insensitively, in the name, description, tags and owner of the model
+	Query string
+}
+
+// normalizeTags lowercases and deduplicates the tags of a model
+func normalizeTags(tags []string) ([]string, error) {
+	normalized := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if !tagPattern.MatchString(tag) {
+			return nil, &InvalidRequestError{Message: fmt.Sprintf("tag %q must be up to 32 lowercase letters, digits, '.', '_' or '-'", tag)}
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	if len(normalized) > maxModelTags {
+		return nil, &InvalidRequestError{Message: fmt.Sprintf("a model has at most %d tags", maxModelTags)}
+	}
+	return normalized, nil
+}
+
+// validateCatalog checks the catalog metadata of the model and normalizes its tags
+func validateCatalog(model *Model) error {
+	if len(model.Description) > maxModelDescription {
+		return &InvalidRequestError{Message: fmt.Sprintf("description is longer than %d characters", maxModelDescription)}
+	}
+	if len(model.ExampleOutputs) > maxModelExampleOutputs {
+		return &InvalidRequestError{Message: fmt.Sprintf("a model has at most %d example outputs", maxModelExampleOutputs)}
+	}
+	tags, err := normalizeTags(model.Tags)
+	if err != nil {
+		return err
+	}
+	model.Tags = tags
+	return nil
+}
+
+// catalogFields are the hash fields of the catalog metadata of the model
+func catalogFields(model Model) map[string]interface{} {
+	exampleOutputs, _ := json.Marshal(model.ExampleOutputs)
+	return map[string]interface{}{
+		"description":     model.Description,
+		"tags":            strings.Join(model.Tags, ","),
+		"license":         model.License,
+		"owner":           model.Owner,
+		"example_outputs": string(exampleOutputs),
+	}
+}
+
+// setCatalogFromHash reads the catalog metadata of the model from its redis hash
+func setCatalogFromHash(model *Model, result map[string]string) {
+	model.Description = result["description"]
+	if result["tags"] != "" {
+		model.Tags = strings.Split(result["tags"], ",")
+	}
+	model.License = result["license"]
+	model.Owner = result["owner"]
+	if result["example_outputs"] != "" {
+		_ = json.Unmarshal([]byte(result["example_outputs"]), &model.ExampleOutputs)
+	}
+}
+
+// UpdateModelCatalog sets the description, tags, license, owner and example outputs of the model
+func UpdateModelCatalog(model Model) error {
+	if err := validateCatalog(&model); err != nil {
+		return err
+	}
+	client := db.GetRedisClient()
+	return client.HSet(ctx, ModelPrefix+":"+model.UUID, catalogFields(model)).Err()
+}
+
+// indexModels adds the models stored before the model index to it
+func indexModels() error {
+	client := db.GetRedisClient()
+	iter := client.Scan(ctx, 0, ModelPrefix+":*", 100).Iterator()
+	for iter.Next(ctx) {
+		modelUUID := strings.TrimPrefix(iter.Val(), ModelPrefix+":")
+		if err := client.SAdd(ctx, modelIndexKey, modelUUID).Err(); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+// Match reports whether the model is selected by the filter
+func (f ModelFilter) Match(model Model) bool {
+	if f.Type != "" && !strings.EqualFold(string(f.Type), string(model.Type)) {
+		return false
+	}
+	for _, tag := range f.Tags {
+		if !containsString(model.Tags, tag) {
+			return false
+		}
+	}
+	if f.Query == "" {
+		return true
+	}
+	query := strings.ToLower(f.Query)
+	for _, text := range append([]string{model.FullName(), model.Description, model.Owner}, model.Tags...) {
+		if strings.Contains(strings.ToLower(text), query) {
+			return true
+		}
+	}
+	return false
+}
+
+// SearchModels returns the page of the models selected by the filter, sorted by full name, and how many were selected
+func SearchModels(models []Model, filter ModelFilter, offset, limit int) ([]Model, int) {
+	matched := make([]Model, 0, len(models))
+	for _, model := range models {
+		if filter.Match(model) {
+			matched = append(matched, model)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].FullName() < matched[j].FullName() })
+
+	total := len(matched)
+	if offset >= total {
+		return []Model{}, total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return matched[offset:end], total
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
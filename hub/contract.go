@@ -0,0 +1,127 @@
+package hub
+
+import (
+	"cotelligence-model-hub/openapi"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// promptInput and the other inputs are shared by the contracts of several model types
+var (
+	promptInput = openapi.ContractInput{Names: []string{"prompt"}, Kind: openapi.KindText}
+	imageInput  = openapi.ContractInput{Names: []string{"image", "input_image", "img"}, Kind: openapi.KindFile}
+	audioInput  = openapi.ContractInput{Names: []string{"audio", "audio_file", "file"}, Kind: openapi.KindFile}
+	textInput   = openapi.ContractInput{Names: []string{"text", "prompt", "input"}, Kind: openapi.KindText}
+)
+
+// modelContracts are the canonical input and output of each model type
+var modelContracts = map[ModelType]openapi.Contract{
+	Text2Text: {InputSchema: "Input", Inputs: []openapi.ContractInput{promptInput}, OutputSchema: "Output", Output: openapi.KindText},
+	Text2Img:  {InputSchema: "Input", Inputs: []openapi.ContractInput{promptInput}, OutputSchema: "Output", Output: openapi.KindFile},
+	Text2Vid:  {InputSchema: "Input", Inputs: []openapi.ContractInput{promptInput}, OutputSchema: "Output", Output: openapi.KindFile},
+	Img2Img:   {InputSchema: "Input", Inputs: []openapi.ContractInput{imageInput}, OutputSchema: "Output", Output: openapi.KindFile},
+	Img2Text:  {InputSchema: "Input", Inputs: []openapi.ContractInput{imageInput}, OutputSchema: "Output", Output: openapi.KindText},
+	Speech2Text: {InputSchema: "Input", Inputs: []openapi.ContractInput{audioInput}, OutputSchema: "Output",
+		Output: openapi.KindText},
+	Text2Speech: {InputSchema: "Input", Inputs: []openapi.ContractInput{textInput}, OutputSchema: "Output",
+		Output: openapi.KindFile},
+	Embedding: {InputSchema: "Input", Inputs: []openapi.ContractInput{textInput}, OutputSchema: "Output",
+		Output: openapi.KindEmbedding},
+	// training models take a dataset file and output the url of the trained weights
+	Training: {InputSchema: "TrainingInput", Inputs: []openapi.ContractInput{{Kind: openapi.KindFile}},
+		OutputSchema: "TrainingOutput", Output: openapi.KindWeights},
+}
+
+// Contract returns the canonical input and output of the model type, models without a type have none
+func (t ModelType) Contract() (openapi.Contract, bool) {
+	contract, ok := modelContracts[t]
+	return contract, ok
+}
+
+// validateModelType checks the type is known, models registered without a type keep having none
+func validateModelType(modelType ModelType) error {
+	if _, ok := modelType.Contract(); ok || modelType == "" {
+		return nil
+	}
+	return &InvalidRequestError{Message: fmt.Sprintf("unknown model type %s", modelType)}
+}
+
+// checkModelContract checks the spec of the model image against the contract of the model type
+func checkModelContract(modelType ModelType, modelUUID, image string) error {
+	contract, ok := modelType.Contract()
+	if !ok {
+		return nil
+	}
+	return openapi.CheckContract(modelUUID, image, contract)
+}
+
+// knownImageSpec returns the spec of the image when it is known without booting it: stored for the image, served by a
+// warm pod running it, which is stored then, or in the model_spec/ file of a model without versions yet
+func knownImageSpec(model Model, image string) ([]byte, error) {
+	modelUUID := model.UUID
+	data, err := openapi.GetImageSpec(modelUUID, image)
+	if !errors.Is(err, openapi.ErrSpecNotFound) {
+		return data, err
+	}
+	if podID, warm := warmImagePod(image); warm {
+		if data, err := fetchPodSpec(podID); err == nil && openapi.SaveSpec(modelUUID, image, data) == nil {
+			return data, nil
+		}
+	}
+	// the file describes the image the model was first registered with
+	if model.LatestVersion > 0 {
+		return nil, err
+	}
+	return openapi.ReadSpecFile(modelUUID)
+}
+
+// checkImageContract checks the image against the contract of the model type before a version runs it, when its spec
+// is known. The spec of other images is checked once it is discovered
+func checkImageContract(model Model, image string) error {
+	contract, ok := model.Type.Contract()
+	if !ok {
+		return nil
+	}
+	data, err := knownImageSpec(model, image)
+	if errors.Is(err, openapi.ErrSpecNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return openapi.CheckSpecContract(data, contract)
+}
+
+// ErrVersionBreaksContract is returned for predictions on a version whose spec breaks the contract of the model type
+var ErrVersionBreaksContract = errors.New("model version does not match the contract of its type")
+
+// checkServableVersion refuses versions whose spec breaks the contract of the model type, a version whose discovery
+// failed may still boot and is served
+func checkServableVersion(model Model, version ModelVersion) error {
+	if version.SpecStatus != SpecFailed {
+		return nil
+	}
+	var contractError *openapi.ContractError
+	if err := checkModelContract(model.Type, model.UUID, version.Image()); errors.As(err, &contractError) {
+		return fmt.Errorf("%w: version %d: %s", ErrVersionBreaksContract, version.Number, err)
+	}
+	return nil
+}
+
+func listModelTypesHandler(c *gin.Context) {
+	types := make([]ModelType, 0, len(modelContracts))
+	for modelType := range modelContracts {
+		types = append(types, modelType)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	modelTypes := make([]gin.H, 0, len(types))
+	for _, modelType := range types {
+		modelTypes = append(modelTypes, gin.H{"type": modelType, "contract": modelContracts[modelType]})
+	}
+	c.JSON(http.StatusOK, modelTypes)
+}
@@ -0,0 +1,53 @@
+package hub
+
+import (
+	"cotelligence-model-hub/openapi"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// textOutputSpec is a cog spec with a prompt input and a text output
+const textOutputSpec = `{
+  "openapi": "3.0.2",
+  "info": {"title": "Cog", "version": "0.1.0"},
+  "paths": {},
+  "components": {
+    "schemas": {
+      "Input": {
+        "title": "Input",
+        "type": "object",
+        "required": ["prompt"],
+        "properties": {"prompt": {"title": "Prompt", "type": "string", "x-order": 0}}
+      },
+      "Output": {"title": "Output", "type": "string"}
+    }
+  }
+}`
+
+func TestRegisterModelChecksKnownSpec(t *testing.T) {
+	name := "test-" + uuid.NewString()
+	modelUUID := uuid.NewSHA1(uuid.MustParse(namespaceUUIDStr), []byte(name)).String()
+	image := imageRef("r8.im/test/model", testDigest("a"))
+	if err := openapi.SaveSpec(modelUUID, image, []byte(textOutputSpec)); err != nil {
+		t.Fatalf("SaveSpec() = %v", err)
+	}
+
+	_, err := RegisterModel(Model{Name: name, Type: Text2Img, ImageURL: "r8.im/test/model", Digest: testDigest("a")})
+	var contractError *openapi.ContractError
+	if !errors.As(err, &contractError) {
+		t.Fatalf("RegisterModel() of an image breaking the contract = %v, want a ContractError", err)
+	}
+	if _, ok := GetModel(modelUUID); ok {
+		t.Errorf("GetModel() found the rejected model")
+	}
+
+	registered, err := RegisterModel(Model{Name: name, Type: Text2Text, ImageURL: "r8.im/test/model", Digest: testDigest("a")})
+	if err != nil {
+		t.Fatalf("RegisterModel() of an image following the contract = %v", err)
+	}
+	if registered.UUID != modelUUID {
+		t.Errorf("UUID = %s, want %s", registered.UUID, modelUUID)
+	}
+}
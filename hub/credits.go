@@ -0,0 +1,304 @@
+package hub
+
+import (
+	"cotelligence-model-hub/db"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// Credits are whole units so that the ledger never drifts, model prices are expressed in credits
+
+type CreditEntryType string
+
+const (
+	CreditTopUp      CreditEntryType = "top_up"
+	CreditAdjustment CreditEntryType = "adjustment"
+	CreditReserve    CreditEntryType = "reserve"
+	CreditSettle     CreditEntryType = "settle"
+	CreditRefund     CreditEntryType = "refund"
+)
+
+// CreditEntry is an append-only ledger line, Balance is the balance of the account right after it
+type CreditEntry struct {
+	ID        string          `json:"id"`
+	APIKeyId  string          `json:"api_key_id"`
+	Type      CreditEntryType `json:"type"`
+	Amount    int64           `json:"amount"`
+	Balance   int64           `json:"balance"`
+	TaskId    string          `json:"task_id,omitempty"`
+	ModelId   string          `json:"model_id,omitempty"`
+	Note      string          `json:"note,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+var ErrInsufficientCredits = errors.New("insufficient credits")
+
+const creditBalancePrefix = "hub:credits:balance:"
+const creditLedgerPrefix = "hub:credits:ledger:"
+
+// creditReservationSeconds is the compute time reserved for per second priced models
+const creditReservationSeconds = 60
+
+// appendCreditEntryScript adds the amount to the balance and appends the entry with the new balance,
+// when ARGV[3] is 1 the entry is refused if it would make the balance negative.
+// It returns {1, balance} when appended and {0, balance} when refused
+var appendCreditEntryScript = redis.NewScript(`
+local amount = tonumber(ARGV[1])
+local balance = tonumber(redis.call('GET', KEYS[1]) or '0')
+if ARGV[3] == '1' and balance + amount < 0 then
+	return {0, balance}
+end
+balance = redis.call('INCRBY', KEYS[1], amount)
+local entry = cjson.decode(ARGV[2])
+entry['balance'] = balance
+redis.call('RPUSH', KEYS[2], cjson.encode(entry))
+return {1, balance}
+`)
+
+// appendCreditEntry atomically applies the entry to the account balance and records it in the ledger
+func appendCreditEntry(entry CreditEntry, requireFunds bool) (CreditEntry, error) {
+	entry.ID = uuid.New().String()
+	entry.CreatedAt = time.Now().UTC()
+	serializedEntry, err := json.Marshal(entry)
+	if err != nil {
+		return CreditEntry{}, err
+	}
+	check := "0"
+	if requireFunds {
+		check = "1"
+	}
+	client := db.GetRedisClient()
+	result, err := appendCreditEntryScript.Run(ctx, client,
+		[]string{creditBalancePrefix + entry.APIKeyId, creditLedgerPrefix + entry.APIKeyId},
+		entry.Amount, string(serializedEntry), check).Int64Slice()
+	if err != nil {
+		return CreditEntry{}, err
+	}
+	entry.Balance = result[1]
+	if result[0] == 0 {
+		return entry, ErrInsufficientCredits
+	}
+	return entry, nil
+}
+
+// GetCreditBalance returns the balance of the account, reserved credits are already deducted
+func GetCreditBalance(apiKeyId string) (int64, error) {
+	client := db.GetRedisClient()
+	balance, err := client.Get(ctx, creditBalancePrefix+apiKeyId).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return balance, err
+}
+
+// GetCreditLedger returns the ledger entries of the account, oldest first
+func GetCreditLedger(apiKeyId string, offset, limit int64) ([]CreditEntry, error) {
+	client := db.GetRedisClient()
+	lines, err := client.LRange(ctx, creditLedgerPrefix+apiKeyId, offset, offset+limit-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]CreditEntry, 0, len(lines))
+	for _, line := range lines {
+		var entry CreditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// AddCredits tops up the account, a negative amount is recorded as an adjustment
+func AddCredits(apiKeyId string, amount int64, note string) (CreditEntry, error) {
+	entryType := CreditTopUp
+	if amount < 0 {
+		entryType = CreditAdjustment
+	}
+	return appendCreditEntry(CreditEntry{APIKeyId: apiKeyId, Type: entryType, Amount: amount, Note: note}, false)
+}
+
+// requestedOutputs is the number of outputs asked by the prediction input, defaulting to one
+func requestedOutputs(predictionParams map[string]interface{}) int64 {
+	input, _ := predictionParams["input"].(map[string]interface{})
+	if n, ok := input["num_outputs"].(float64); ok && n >= 1 {
+		return int64(n)
+	}
+	return 1
+}
+
+// ReserveTaskCredits reserves the estimated price of the prediction, it returns the reserved amount
+func ReserveTaskCredits(apiKey APIKey, model Model, taskID string, predictionParams map[string]interface{}) (int64, error) {
+	reserved := model.PricePerSecond*creditReservationSeconds + model.PricePerOutput*requestedOutputs(predictionParams)
+	return reserveCredits(apiKey.ID, model.UUID, taskID, reserved)
+}
+
+// reserveCredits holds the amount for the task or training until it is settled, it returns the reserved amount
+func reserveCredits(apiKeyId, modelId, taskID string, reserved int64) (int64, error) {
+	if reserved == 0 {
+		return 0, nil
+	}
+	entry, err := appendCreditEntry(CreditEntry{
+		APIKeyId: apiKeyId,
+		Type:     CreditReserve,
+		Amount:   -reserved,
+		TaskId:   taskID,
+		ModelId:  modelId,
+	}, true)
+	if errors.Is(err, ErrInsufficientCredits) {
+		return 0, fmt.Errorf("%w: %d credits are needed, the balance is %d", ErrInsufficientCredits, reserved, entry.Balance)
+	}
+	return reserved, err
+}
+
+// refundCredits gives the reservation of a task back
+func refundCredits(apiKeyId, modelId, taskID string, reserved int64, note string) error {
+	if reserved == 0 {
+		return nil
+	}
+	_, err := appendCreditEntry(CreditEntry{
+		APIKeyId: apiKeyId,
+		Type:     CreditRefund,
+		Amount:   reserved,
+		TaskId:   taskID,
+		ModelId:  modelId,
+		Note:     note,
+	}, false)
+	return err
+}
+
+// outputCount is the number of outputs produced by a prediction
+func outputCount(output interface{}) int64 {
+	switch o := output.(type) {
+	case nil:
+		return 0
+	case []interface{}:
+		return int64(len(o))
+	default:
+		return 1
+	}
+}
+
+// SettleTaskCredits charges the metered usage and the output of a finished task against its reservation, failed tasks
+// and tasks canceled before reaching a pod are refunded, other canceled tasks only pay their metered usage. The output
+// is passed in as the task response is only written once the task is settled
+func SettleTaskCredits(taskID string, output interface{}) error {
+	client := db.GetRedisClient()
+	taskKey := taskPrefix + taskID
+	// only the first terminal event is settled
+	first, err := client.HSetNX(ctx, taskKey, "CreditsSettled", "1").Result()
+	if err != nil || !first {
+		return err
+	}
+
+	task, err := GetTask(taskID)
+	if err != nil {
+		return err
+	}
+	if task.PricePerSecond == 0 && task.PricePerOutput == 0 {
+		return nil
+	}
+	if task.Status == Failed {
+		return refundCredits(task.APIKeyId, task.ModelId, taskID, task.CreditsReserved, "task failed")
+	}
+	if task.Status == Canceled && task.PodId == "" {
+		return refundCredits(task.APIKeyId, task.ModelId, taskID, task.CreditsReserved, "task canceled before it ran")
+	}
+
+	var gpuSeconds float64
+	if task.Usage != nil {
+		gpuSeconds = task.Usage.GpuSeconds
+	}
+	charged := int64(math.Ceil(gpuSeconds * float64(task.PricePerSecond)))
+	// a canceled task has no output to pay for, whatever partial output it streamed
+	if task.Status != Canceled {
+		charged += task.PricePerOutput * outputCount(output)
+	}
+	if err := settleCredits(task.APIKeyId, task.ModelId, taskID, task.CreditsReserved, charged); err != nil {
+		return err
+	}
+	return client.HSet(ctx, taskKey, "CreditsCharged", charged).Err()
+}
+
+// settleCredits charges the task or training against its reservation, the difference is given back or taken
+func settleCredits(apiKeyId, modelId, taskID string, reserved, charged int64) error {
+	_, err := appendCreditEntry(CreditEntry{
+		APIKeyId: apiKeyId,
+		Type:     CreditSettle,
+		Amount:   reserved - charged,
+		TaskId:   taskID,
+		ModelId:  modelId,
+		Note:     fmt.Sprintf("reserved %d, charged %d", reserved, charged),
+	}, false)
+	return err
+}
+
+// creditAccount is the account the request looks at, admins may look at any account
+func creditAccount(c *gin.Context) string {
+	apiKey := currentAPIKey(c)
+	if accountId := c.Query("api_key_id"); accountId != "" && apiKey.HasScope(ScopeAdmin) {
+		return accountId
+	}
+	return apiKey.ID
+}
+
+func getCreditBalanceHandler(c *gin.Context) {
+	apiKeyId := creditAccount(c)
+	balance, err := GetCreditBalance(apiKeyId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"api_key_id": apiKeyId, "balance": balance})
+}
+
+func getCreditLedgerHandler(c *gin.Context) {
+	offset, _ := strconv.ParseInt(c.DefaultQuery("offset", "0"), 10, 64)
+	limit, _ := strconv.ParseInt(c.DefaultQuery("limit", "100"), 10, 64)
+	if offset < 0 || limit <= 0 || limit > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "offset must be positive and limit between 1 and 1000"})
+		return
+	}
+
+	entries, err := GetCreditLedger(creditAccount(c), offset, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
+
+func addCreditsHandler(c *gin.Context) {
+	var body struct {
+		Amount int64  `json:"amount" binding:"required"`
+		Note   string `json:"note"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	keyId := c.Param("keyId")
+	if _, err := GetAPIKey(keyId); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	entry, err := AddCredits(keyId, body.Amount, body.Note)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, entry)
+}
@@ -0,0 +1,243 @@
+package hub
+
+import (
+	"cotelligence-model-hub/db"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func creditBalance(t *testing.T, apiKeyId string) int64 {
+	t.Helper()
+	balance, err := GetCreditBalance(apiKeyId)
+	if err != nil {
+		t.Fatalf("GetCreditBalance() = %v", err)
+	}
+	return balance
+}
+
+// ledgerOf returns the type, amount and balance of every ledger entry of the account
+func ledgerOf(t *testing.T, apiKeyId string) [][3]interface{} {
+	t.Helper()
+	entries, err := GetCreditLedger(apiKeyId, 0, 100)
+	if err != nil {
+		t.Fatalf("GetCreditLedger() = %v", err)
+	}
+	ledger := make([][3]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		ledger = append(ledger, [3]interface{}{entry.Type, entry.Amount, entry.Balance})
+	}
+	return ledger
+}
+
+// recordPricedTask records a task with its reservation the way SubmitPrediction does
+func recordPricedTask(t *testing.T, apiKey APIKey, model Model, params map[string]interface{}) string {
+	t.Helper()
+	taskId := GenerateTaskID()
+	reserved, err := ReserveTaskCredits(apiKey, model, taskId, params)
+	if err != nil {
+		t.Fatalf("ReserveTaskCredits() = %v", err)
+	}
+	err = RecordTask(Task{
+		ID:              taskId,
+		ModelId:         model.UUID,
+		APIKeyId:        apiKey.ID,
+		Body:            params,
+		PricePerSecond:  model.PricePerSecond,
+		PricePerOutput:  model.PricePerOutput,
+		CreditsReserved: reserved,
+	})
+	if err != nil {
+		t.Fatalf("RecordTask() = %v", err)
+	}
+	return taskId
+}
+
+func TestReserveTaskCredits(t *testing.T) {
+	apiKey := APIKey{ID: uuid.NewString()}
+	model := Model{UUID: uuid.NewString(), PricePerSecond: 1, PricePerOutput: 10}
+	if _, err := AddCredits(apiKey.ID, 100, "test"); err != nil {
+		t.Fatalf("AddCredits() = %v", err)
+	}
+
+	// 60 reserved seconds and two requested outputs
+	params := map[string]interface{}{"input": map[string]interface{}{"num_outputs": float64(2)}}
+	reserved, err := ReserveTaskCredits(apiKey, model, "task-1", params)
+	if err != nil {
+		t.Fatalf("ReserveTaskCredits() = %v", err)
+	}
+	if reserved != 80 {
+		t.Errorf("ReserveTaskCredits() = %d, want 80", reserved)
+	}
+	if balance := creditBalance(t, apiKey.ID); balance != 20 {
+		t.Errorf("balance = %d, want 20", balance)
+	}
+}
+
+func TestReserveTaskCreditsInsufficient(t *testing.T) {
+	apiKey := APIKey{ID: uuid.NewString()}
+	model := Model{UUID: uuid.NewString(), PricePerOutput: 50}
+	if _, err := AddCredits(apiKey.ID, 40, "test"); err != nil {
+		t.Fatalf("AddCredits() = %v", err)
+	}
+
+	_, err := ReserveTaskCredits(apiKey, model, "task-1", map[string]interface{}{})
+	if !errors.Is(err, ErrInsufficientCredits) {
+		t.Fatalf("ReserveTaskCredits() = %v, want ErrInsufficientCredits", err)
+	}
+	// a refused reservation leaves no trace in the ledger
+	want := [][3]interface{}{{CreditTopUp, int64(40), int64(40)}}
+	if ledger := ledgerOf(t, apiKey.ID); !reflect.DeepEqual(ledger, want) {
+		t.Errorf("ledger = %v, want %v", ledger, want)
+	}
+}
+
+func TestReserveTaskCreditsFreeModel(t *testing.T) {
+	apiKey := APIKey{ID: uuid.NewString()}
+	reserved, err := ReserveTaskCredits(apiKey, Model{UUID: uuid.NewString()}, "task-1", map[string]interface{}{})
+	if err != nil || reserved != 0 {
+		t.Errorf("ReserveTaskCredits() = %d, %v, want nothing reserved without a balance", reserved, err)
+	}
+	if ledger := ledgerOf(t, apiKey.ID); len(ledger) != 0 {
+		t.Errorf("ledger = %v, want it empty", ledger)
+	}
+}
+
+func TestSettleTaskCredits(t *testing.T) {
+	apiKey := APIKey{ID: uuid.NewString()}
+	model := Model{UUID: uuid.NewString(), PricePerSecond: 2, PricePerOutput: 5}
+	if _, err := AddCredits(apiKey.ID, 1000, "test"); err != nil {
+		t.Fatalf("AddCredits() = %v", err)
+	}
+	taskId := recordPricedTask(t, apiKey, model, map[string]interface{}{})
+
+	err := db.GetRedisClient().HSet(ctx, taskPrefix+taskId, "Status", string(Succeeded), "Usage", `{"gpu_seconds":10.2}`).Err()
+	if err != nil {
+		t.Fatalf("failed to complete the task: %v", err)
+	}
+	// 21 credits for the rounded up GPU seconds and 10 for the two outputs
+	output := []interface{}{"https://example.com/1.png", "https://example.com/2.png"}
+	for i := 0; i < 2; i++ {
+		// only the first terminal event is settled
+		if err := SettleTaskCredits(taskId, output); err != nil {
+			t.Fatalf("SettleTaskCredits() = %v", err)
+		}
+	}
+
+	want := [][3]interface{}{
+		{CreditTopUp, int64(1000), int64(1000)},
+		{CreditReserve, int64(-125), int64(875)},
+		{CreditSettle, int64(94), int64(969)},
+	}
+	if ledger := ledgerOf(t, apiKey.ID); !reflect.DeepEqual(ledger, want) {
+		t.Errorf("ledger = %v, want %v", ledger, want)
+	}
+	task, err := GetTask(taskId)
+	if err != nil {
+		t.Fatalf("GetTask() = %v", err)
+	}
+	if task.CreditsCharged != 31 {
+		t.Errorf("CreditsCharged = %d, want 31", task.CreditsCharged)
+	}
+}
+
+func TestSettleTaskCreditsRefundsFailedTask(t *testing.T) {
+	apiKey := APIKey{ID: uuid.NewString()}
+	model := Model{UUID: uuid.NewString(), PricePerOutput: 5}
+	if _, err := AddCredits(apiKey.ID, 100, "test"); err != nil {
+		t.Fatalf("AddCredits() = %v", err)
+	}
+	taskId := recordPricedTask(t, apiKey, model, map[string]interface{}{})
+
+	if err := db.GetRedisClient().HSet(ctx, taskPrefix+taskId, "Status", string(Failed)).Err(); err != nil {
+		t.Fatalf("failed to fail the task: %v", err)
+	}
+	if err := SettleTaskCredits(taskId, nil); err != nil {
+		t.Fatalf("SettleTaskCredits() = %v", err)
+	}
+
+	want := [][3]interface{}{
+		{CreditTopUp, int64(100), int64(100)},
+		{CreditReserve, int64(-5), int64(95)},
+		{CreditRefund, int64(5), int64(100)},
+	}
+	if ledger := ledgerOf(t, apiKey.ID); !reflect.DeepEqual(ledger, want) {
+		t.Errorf("ledger = %v, want %v", ledger, want)
+	}
+}
+
+func TestSettleTaskCreditsRefundsCanceledQueuedTask(t *testing.T) {
+	apiKey := APIKey{ID: uuid.NewString()}
+	model := Model{UUID: uuid.NewString(), PricePerSecond: 1, PricePerOutput: 5}
+	if _, err := AddCredits(apiKey.ID, 100, "test"); err != nil {
+		t.Fatalf("AddCredits() = %v", err)
+	}
+	taskId := recordPricedTask(t, apiKey, model, map[string]interface{}{})
+
+	// the task was canceled while queued, it never got a pod
+	if err := db.GetRedisClient().HSet(ctx, taskPrefix+taskId, "Status", string(Canceled)).Err(); err != nil {
+		t.Fatalf("failed to cancel the task: %v", err)
+	}
+	if err := SettleTaskCredits(taskId, nil); err != nil {
+		t.Fatalf("SettleTaskCredits() = %v", err)
+	}
+
+	want := [][3]interface{}{
+		{CreditTopUp, int64(100), int64(100)},
+		{CreditReserve, int64(-65), int64(35)},
+		{CreditRefund, int64(65), int64(100)},
+	}
+	if ledger := ledgerOf(t, apiKey.ID); !reflect.DeepEqual(ledger, want) {
+		t.Errorf("ledger = %v, want %v", ledger, want)
+	}
+}
+
+func TestSettleTaskCreditsChargesCanceledRunningTask(t *testing.T) {
+	apiKey := APIKey{ID: uuid.NewString()}
+	model := Model{UUID: uuid.NewString(), PricePerSecond: 2, PricePerOutput: 5}
+	if _, err := AddCredits(apiKey.ID, 1000, "test"); err != nil {
+		t.Fatalf("AddCredits() = %v", err)
+	}
+	taskId := recordPricedTask(t, apiKey, model, map[string]interface{}{})
+
+	err := db.GetRedisClient().HSet(ctx, taskPrefix+taskId, "Status", string(Canceled), "PodId", "pod-1",
+		"Usage", `{"gpu_seconds":4.5}`).Err()
+	if err != nil {
+		t.Fatalf("failed to cancel the task: %v", err)
+	}
+	// the partial output streamed before the cancel is not paid for
+	if err := SettleTaskCredits(taskId, []interface{}{"https://example.com/1.png"}); err != nil {
+		t.Fatalf("SettleTaskCredits() = %v", err)
+	}
+
+	task, err := GetTask(taskId)
+	if err != nil {
+		t.Fatalf("GetTask() = %v", err)
+	}
+	if task.CreditsCharged != 9 {
+		t.Errorf("CreditsCharged = %d, want the 9 credits of the GPU seconds", task.CreditsCharged)
+	}
+	if balance := creditBalance(t, apiKey.ID); balance != 991 {
+		t.Errorf("balance = %d, want 991", balance)
+	}
+}
+
+func TestSettleCreditsOverReservation(t *testing.T) {
+	apiKeyId := uuid.NewString()
+	if _, err := AddCredits(apiKeyId, 10, "test"); err != nil {
+		t.Fatalf("AddCredits() = %v", err)
+	}
+	reserved, err := reserveCredits(apiKeyId, "model", "task-1", 10)
+	if err != nil {
+		t.Fatalf("reserveCredits() = %v", err)
+	}
+	// a task running longer than its reservation is still charged in full, the balance may go negative
+	if err := settleCredits(apiKeyId, "model", "task-1", reserved, 15); err != nil {
+		t.Fatalf("settleCredits() = %v", err)
+	}
+	if balance := creditBalance(t, apiKeyId); balance != -5 {
+		t.Errorf("balance = %d, want -5", balance)
+	}
+}
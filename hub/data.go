@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"go.uber.org/zap"
@@ -16,10 +17,25 @@ import (
 
 type ModelType string
 
+// the contract of each model type is in modelContracts
 const (
-	Text2Text ModelType = "Text2Text"
-	Text2Img  ModelType = "Text2Img"
-	Text2Vid  ModelType = "Text2Vid"
+	Text2Text   ModelType = "Text2Text"
+	Text2Img    ModelType = "Text2Img"
+	Text2Vid    ModelType = "Text2Vid"
+	Img2Img     ModelType = "Img2Img"
+	Img2Text    ModelType = "Img2Text"
+	Speech2Text ModelType = "Speech2Text"
+	Text2Speech ModelType = "Text2Speech"
+	Embedding   ModelType = "Embedding"
+	Training    ModelType = "Training"
+)
+
+type ModelVisibility string
+
+const (
+	// Public models can be used by every api key, private ones only by the keys of their organization
+	Public  ModelVisibility = "public"
+	Private ModelVisibility = "private"
 )
 
 type Model struct {
@@ -29,6 +45,55 @@ type Model struct {
 	MinInstanceCnt int       `json:"min_instance_cnt"`
 	MaxInstanceCnt int       `json:"max_instance_cnt"`
 	Type           ModelType `json:"type"`
+	// Org owns the model, models registered before organizations have none
+	Org        string          `json:"org,omitempty"`
+	Visibility ModelVisibility `json:"visibility,omitempty"`
+	// RateLimit is the predictions allowed per minute, 0 means unlimited
+	RateLimit          float64 `json:"rate_limit,omitempty"`
+	MaxConcurrentTasks int     `json:"max_concurrent_tasks,omitempty"`
+	// PricePerSecond is charged per GPU second and PricePerOutput per output, in credits
+	PricePerSecond int64 `json:"price_per_second,omitempty"`
+	PricePerOutput int64 `json:"price_per_output,omitempty"`
+	// SpecStatus tells whether the cog OpenAPI spec of the image has been discovered, SpecError why it failed
+	SpecStatus SpecStatus `json:"spec_status,omitempty"`
+	SpecError  string     `json:"spec_error,omitempty"`
+	// ImageURL, Digest and Hardware are those of LatestVersion, models registered before versions have none
+	Digest        string          `json:"digest,omitempty"`
+	Hardware      HardwareProfile `json:"hardware"`
+	LatestVersion int             `json:"latest_version,omitempty"`
+	// DeletedAt is set while a deleted model can still be restored
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Description, Tags, License, Owner and ExampleOutputs describe the model in the catalog
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	License     string   `json:"license,omitempty"`
+	// Owner is the person or team maintaining the model, Org the organization it belongs to
+	Owner string `json:"owner,omitempty"`
+	// ExampleOutputs are outputs of the model, usually urls of generated files
+	ExampleOutputs []string `json:"example_outputs,omitempty"`
+}
+
+// FullName is the "<org>/<name>" the model is registered under
+func (m Model) FullName() string {
+	if m.Org == "" {
+		return m.Name
+	}
+	return m.Org + "/" + m.Name
+}
+
+// Image is the image reference the latest version of the model runs
+func (m Model) Image() string {
+	return imageRef(m.ImageURL, m.Digest)
+}
+
+// IsDeleted reports whether the model was deleted, deleted models accept no prediction
+func (m Model) IsDeleted() bool {
+	return m.DeletedAt != nil
+}
+
+// IsPublic reports whether every api key can use the model, models without a visibility are public
+func (m Model) IsPublic() bool {
+	return m.Visibility != Private
 }
 
 type Pod struct {
@@ -36,6 +101,27 @@ type Pod struct {
 	IsPodUp  bool      `json:"is_pod_up"`
 	Image    string    `json:"image"`
 	LastUsed time.Time `json:"last_used"`
+	// Hardware is the GPU the pod runs on and CostPerHr its hourly price in USD, as reported by the provider
+	Hardware  HardwareProfile `json:"hardware,omitempty"`
+	CostPerHr float64         `json:"cost_per_hr,omitempty"`
+}
+
+// hardwareFields are the hash fields of the hardware of the pod, pods the provider did not describe have none
+func (p *Pod) hardwareFields() []interface{} {
+	if p.Hardware.GpuTypeId == "" {
+		return nil
+	}
+	return []interface{}{
+		"GpuTypeId", p.Hardware.GpuTypeId,
+		"GpuCount", p.Hardware.GpuCount,
+		"CostPerHr", p.CostPerHr,
+	}
+}
+
+// readHardware reads the hardware of the pod from its hash
+func (p *Pod) readHardware(hash map[string]string) {
+	p.Hardware = HardwareProfile{GpuTypeId: hash["GpuTypeId"], GpuCount: atoi(hash["GpuCount"])}
+	p.CostPerHr, _ = strconv.ParseFloat(hash["CostPerHr"], 64)
 }
 
 func (p *Pod) OccupiedUntil() time.Time {
@@ -49,6 +135,10 @@ func (p *Pod) IsOccupied() bool {
 type ModelPodBinding struct {
 	ModelUUID string `json:"model_uuid"`
 	PodID     string `json:"pod_id"`
+	// Version is the model version the pod runs, 0 for models registered before versions
+	Version int `json:"version,omitempty"`
+	// Draining pods finish their tasks but get no new ones, a rollout is about to update them
+	Draining bool `json:"draining,omitempty"`
 }
 
 var ctx = context.Background()
@@ -68,20 +158,88 @@ func AddModel(model Model) error {
 	modelMap["min_instance_cnt"] = model.MinInstanceCnt
 	modelMap["max_instance_cnt"] = model.MaxInstanceCnt
 	modelMap["type"] = string(model.Type)
+	modelMap["org"] = model.Org
+	modelMap["visibility"] = string(model.Visibility)
+	modelMap["rate_limit"] = model.RateLimit
+	modelMap["max_concurrent_tasks"] = model.MaxConcurrentTasks
+	modelMap["price_per_second"] = model.PricePerSecond
+	modelMap["price_per_output"] = model.PricePerOutput
+	modelMap["spec_status"] = string(model.SpecStatus)
+	modelMap["spec_error"] = model.SpecError
+	modelMap["digest"] = model.Digest
+	modelMap["gpu_type_id"] = model.Hardware.GpuTypeId
+	modelMap["gpu_count"] = model.Hardware.GpuCount
+	modelMap["latest_version"] = model.LatestVersion
+	for field, value := range catalogFields(model) {
+		modelMap[field] = value
+	}
 
-	return client.HSet(ctx, key, modelMap).Err()
+	pipe := client.TxPipeline()
+	pipe.HSet(ctx, key, modelMap)
+	pipe.SAdd(ctx, modelIndexKey, model.UUID)
+	_, err := pipe.Exec(ctx)
+	return err
 }
 
-func UpdateModelInstanceCnt(modelUUID string, maxInstanceCnt int, minInstanceCnt int, modelType ModelType) error {
+// UpdateModelLimits sets the rate and concurrency limits that are given
+func UpdateModelLimits(modelUUID string, rateLimit *float64, maxConcurrentTasks *int) error {
+	var fields []interface{}
+	if rateLimit != nil {
+		fields = append(fields, "rate_limit", *rateLimit)
+	}
+	if maxConcurrentTasks != nil {
+		fields = append(fields, "max_concurrent_tasks", *maxConcurrentTasks)
+	}
+	if len(fields) == 0 {
+		return nil
+	}
 	client := db.GetRedisClient()
+	modelKey := ModelPrefix + ":" + modelUUID
+	return client.HSet(ctx, modelKey, fields...).Err()
+}
 
-	// Update the max_instance_cnt and min_instance_cnt fields for the model
+// UpdateModelPrice sets the prices that are given, running tasks keep the price they were submitted at
+func UpdateModelPrice(modelUUID string, pricePerSecond, pricePerOutput *int64) error {
+	var fields []interface{}
+	if pricePerSecond != nil {
+		fields = append(fields, "price_per_second", *pricePerSecond)
+	}
+	if pricePerOutput != nil {
+		fields = append(fields, "price_per_output", *pricePerOutput)
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	client := db.GetRedisClient()
 	modelKey := ModelPrefix + ":" + modelUUID
-	_, err := client.HSet(ctx, modelKey,
-		"max_instance_cnt", maxInstanceCnt,
-		"min_instance_cnt", minInstanceCnt,
-		"type", string(modelType)).Result()
-	return err
+	return client.HSet(ctx, modelKey, fields...).Err()
+}
+
+// UpdateModelVisibility makes the model public or private
+func UpdateModelVisibility(modelUUID string, visibility ModelVisibility) error {
+	client := db.GetRedisClient()
+	modelKey := ModelPrefix + ":" + modelUUID
+	return client.HSet(ctx, modelKey, "visibility", string(visibility)).Err()
+}
+
+// UpdateModelInstanceCnt sets the instance counts and the type that are given
+func UpdateModelInstanceCnt(modelUUID string, maxInstanceCnt *int, minInstanceCnt *int, modelType *ModelType) error {
+	var fields []interface{}
+	if maxInstanceCnt != nil {
+		fields = append(fields, "max_instance_cnt", *maxInstanceCnt)
+	}
+	if minInstanceCnt != nil {
+		fields = append(fields, "min_instance_cnt", *minInstanceCnt)
+	}
+	if modelType != nil {
+		fields = append(fields, "type", string(*modelType))
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	client := db.GetRedisClient()
+	modelKey := ModelPrefix + ":" + modelUUID
+	return client.HSet(ctx, modelKey, fields...).Err()
 }
 
 func GetModel(uuid string) (Model, bool) {
@@ -92,45 +250,98 @@ func GetModel(uuid string) (Model, bool) {
 		return Model{}, false
 	}
 
+	return modelFromHash(result), true
+}
+
+// modelFromHash builds a model from its redis hash
+func modelFromHash(result map[string]string) Model {
+	rateLimit, _ := strconv.ParseFloat(result["rate_limit"], 64)
 	model := Model{
-		Name:           result["name"],
-		ImageURL:       result["image_url"],
-		UUID:           result["uuid"],
-		MinInstanceCnt: atoi(result["min_instance_cnt"]),
-		MaxInstanceCnt: atoi(result["max_instance_cnt"]),
-		Type:           ModelType(result["type"]),
+		Name:               result["name"],
+		ImageURL:           result["image_url"],
+		UUID:               result["uuid"],
+		MinInstanceCnt:     atoi(result["min_instance_cnt"]),
+		MaxInstanceCnt:     atoi(result["max_instance_cnt"]),
+		Type:               ModelType(result["type"]),
+		Org:                result["org"],
+		Visibility:         ModelVisibility(result["visibility"]),
+		RateLimit:          rateLimit,
+		MaxConcurrentTasks: atoi(result["max_concurrent_tasks"]),
+		PricePerSecond:     int64(atoi(result["price_per_second"])),
+		PricePerOutput:     int64(atoi(result["price_per_output"])),
+		SpecStatus:         SpecStatus(result["spec_status"]),
+		SpecError:          result["spec_error"],
+		Digest:             result["digest"],
+		Hardware:           HardwareProfile{GpuTypeId: result["gpu_type_id"], GpuCount: atoi(result["gpu_count"])},
+		LatestVersion:      atoi(result["latest_version"]),
+		DeletedAt:          parseOptionalTime(time.RFC3339, result["deleted_at"]),
 	}
-
-	return model, true
+	setCatalogFromHash(&model, result)
+	return model
 }
 
+// modelsIndexed tells whether the models stored before the model index were indexed by this instance
+var modelsIndexed = struct {
+	sync.Mutex
+	done bool
+}{}
+
 func GetAllModels() ([]Model, error) {
+	modelsIndexed.Lock()
+	if !modelsIndexed.done {
+		if err := indexModels(); err != nil {
+			modelsIndexed.Unlock()
+			return nil, err
+		}
+		modelsIndexed.done = true
+	}
+	modelsIndexed.Unlock()
 	client := db.GetRedisClient()
-	keys, err := client.Keys(ctx, ModelPrefix+":*").Result()
+	uuids, err := client.SMembers(ctx, modelIndexKey).Result()
 	if err != nil {
 		return nil, err
 	}
 
-	var models = make([]Model, 0)
-	for _, key := range keys {
-		result, err := client.HGetAll(ctx, key).Result()
-		if err != nil {
+	pipe := client.Pipeline()
+	results := make([]*redis.StringStringMapCmd, len(uuids))
+	for i, modelUUID := range uuids {
+		results[i] = pipe.HGetAll(ctx, ModelPrefix+":"+modelUUID)
+	}
+	if len(uuids) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
 			return nil, err
 		}
-		model := Model{
-			Name:           result["name"],
-			ImageURL:       result["image_url"],
-			UUID:           result["uuid"],
-			MinInstanceCnt: atoi(result["min_instance_cnt"]),
-			MaxInstanceCnt: atoi(result["max_instance_cnt"]),
-			Type:           ModelType(result["type"]),
+	}
+
+	var models = make([]Model, 0, len(uuids))
+	for _, result := range results {
+		// models removed by another instance may still be indexed for a moment
+		if len(result.Val()) == 0 {
+			continue
 		}
-		models = append(models, model)
+		models = append(models, modelFromHash(result.Val()))
 	}
 
 	return models, nil
 }
 
+// FindModel looks a model up by its uuid, then by its "<org>/<name>", models without an organization by their name
+func FindModel(nameOrUUID string) (Model, bool) {
+	if model, ok := GetModel(nameOrUUID); ok {
+		return model, true
+	}
+	models, err := GetAllModels()
+	if err != nil {
+		return Model{}, false
+	}
+	for _, model := range models {
+		if model.FullName() == nameOrUUID {
+			return model, true
+		}
+	}
+	return Model{}, false
+}
+
 func atoi(s string) int {
 	i, err := strconv.Atoi(s)
 	if err != nil {
@@ -139,19 +350,33 @@ func atoi(s string) int {
 	return i
 }
 
+// parseOptionalTime parses a time of a redis hash, nil when it is not set
+func parseOptionalTime(layout, s string) *time.Time {
+	t, err := time.Parse(layout, s)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
 func RemoveModel(uuid string) error {
 	client := db.GetRedisClient()
 	key := ModelPrefix + ":" + uuid
-	return client.Del(ctx, key).Err()
+	pipe := client.TxPipeline()
+	pipe.Del(ctx, key)
+	pipe.SRem(ctx, modelIndexKey, uuid)
+	_, err := pipe.Exec(ctx)
+	return err
 }
 
 func AddPod(pod Pod) error {
 	client := db.GetRedisClient()
 	key := PodRedisPrefix + ":" + pod.ID
-	_, err := client.HSet(ctx, key, map[string]interface{}{
-		"LastUsed": pod.LastUsed.Format(time.RFC3339),
-		"Image":    pod.Image,
-	}).Result()
+	fields := append([]interface{}{
+		"LastUsed", pod.LastUsed.Format(time.RFC3339),
+		"Image", pod.Image,
+	}, pod.hardwareFields()...)
+	_, err := client.HSet(ctx, key, fields...).Result()
 	return err
 }
 
@@ -170,6 +395,7 @@ func GetPod(id string) (Pod, error) {
 	if err != nil {
 		return Pod{}, err
 	}
+	pod.readHardware(result)
 
 	return pod, nil
 }
@@ -177,10 +403,13 @@ func GetPod(id string) (Pod, error) {
 func ModifyPod(pod Pod) error {
 	client := db.GetRedisClient()
 	key := PodRedisPrefix + ":" + pod.ID
-	_, err := client.HSet(ctx, key,
+	// the hardware of a pod never changes, it is only written when known
+	fields := append([]interface{}{
 		"LastUsed", pod.LastUsed.Format(time.RFC3339),
 		"Image", pod.Image,
-		"IsPodUp", pod.IsPodUp).Result()
+		"IsPodUp", pod.IsPodUp,
+	}, pod.hardwareFields()...)
+	_, err := client.HSet(ctx, key, fields...).Result()
 	return err
 }
 
@@ -201,6 +430,53 @@ func BindModelToPod(binding ModelPodBinding) error {
 	return client.Set(ctx, key, jsonBinding, 0).Err()
 }
 
+// bindPodScript sets the binding of the pod unless the pod is draining, so a dispatch does not clear the drain of a
+// rollout or a training. It returns 1 when bound and 0 when the pod is draining
+var bindPodScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if current and cjson.decode(current)['draining'] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1])
+return 1
+`)
+
+// claimPodScript tracks the task on the pod when the pod is bound to the model version and not draining, so a drain
+// never misses a task about to land. It returns 1 when claimed and 0 otherwise
+var claimPodScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if not current then
+	return 0
+end
+local binding = cjson.decode(current)
+if binding['model_uuid'] ~= ARGV[1] or (binding['version'] or 0) ~= tonumber(ARGV[2]) or binding['draining'] then
+	return 0
+end
+if ARGV[3] ~= '' then
+	redis.call('SADD', KEYS[2], ARGV[3])
+end
+return 1
+`)
+
+// bindModelToPodUnlessDraining binds the pod like BindModelToPod unless it is draining, it reports whether it bound it
+func bindModelToPodUnlessDraining(binding ModelPodBinding) (bool, error) {
+	client := db.GetRedisClient()
+	jsonBinding, err := json.Marshal(binding)
+	if err != nil {
+		return false, err
+	}
+	bound, err := bindPodScript.Run(ctx, client, []string{BindingPrefix + ":" + binding.PodID}, string(jsonBinding)).Int()
+	return bound == 1, err
+}
+
+// claimPod tracks the task on the pod if the pod still serves the model version, an empty task only checks the binding
+func claimPod(podID, modelUUID string, version int, taskID string) (bool, error) {
+	client := db.GetRedisClient()
+	claimed, err := claimPodScript.Run(ctx, client, []string{BindingPrefix + ":" + podID, podTasksPrefix + podID},
+		modelUUID, version, taskID).Int()
+	return claimed == 1, err
+}
+
 func GetModelPodBinding(podID string) (ModelPodBinding, bool) {
 	client := db.GetRedisClient()
 	key := BindingPrefix + ":" + podID
@@ -289,6 +565,7 @@ func GetAllPods() ([]Pod, error) {
 			ID:    strings.TrimPrefix(cmd.Args()[1].(string), PodRedisPrefix+":"),
 			Image: hash["Image"],
 		}
+		pod.readHardware(hash)
 		// Parse LastUsed time if needed
 		if LastUsed, ok := hash["LastUsed"]; ok {
 			pod.LastUsed, err = time.Parse(time.RFC3339, LastUsed)
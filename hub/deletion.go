@@ -0,0 +1,211 @@
+package hub
+
+import (
+	"cotelligence-model-hub/db"
+	"cotelligence-model-hub/log"
+	"cotelligence-model-hub/openapi"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+// ModelRestoreWindow is how long a deleted model can be restored before it is purged
+const ModelRestoreWindow = 7 * 24 * time.Hour
+
+var ErrModelDeleted = errors.New("model has been deleted")
+
+// DeleteModel stops accepting predictions for the model, fails its queued tasks and releases its pods once their
+// running tasks are done. The model can be restored until ModelRestoreWindow has passed
+func DeleteModel(model Model) (Model, error) {
+	if model.IsDeleted() {
+		return model, nil
+	}
+	now := time.Now()
+	model.DeletedAt = &now
+	client := db.GetRedisClient()
+	err := client.HSet(ctx, ModelPrefix+":"+model.UUID, "deleted_at", model.DeletedAt.Format(time.RFC3339)).Err()
+	if err != nil {
+		return Model{}, err
+	}
+	stopModelWorker(model.UUID)
+	log.ZapLogger.Info("Model deleted", zap.String("modelUUID", model.UUID))
+
+	if err := failQueuedTasks(model.UUID); err != nil {
+		return Model{}, err
+	}
+	go releaseModelPods(model.UUID)
+	return model, nil
+}
+
+// failQueuedTasks fails the tasks still waiting in the queue of the deleted model, their credits are refunded
+func failQueuedTasks(modelUUID string) error {
+	client := db.GetRedisClient()
+	for {
+		taskID, err := client.RPop(ctx, taskQueuePrefix+modelUUID).Result()
+		if errors.Is(err, redis.Nil) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		failTask(taskID, ErrModelDeleted)
+	}
+}
+
+// releasePod makes the pod cold right away so it is stopped or picked by another model
+func releasePod(podID string) error {
+	client := db.GetRedisClient()
+	released := time.Now().Add(-HotOccupiedMinutes * time.Minute)
+	return client.HSet(ctx, PodRedisPrefix+":"+podID, "LastUsed", released.Format(time.RFC3339)).Err()
+}
+
+// releaseModelPods drains the pods bound to the deleted model, then unbinds and releases them
+func releaseModelPods(modelUUID string) {
+	bindings, err := GetAllBindings()
+	if err != nil {
+		log.ZapLogger.Error("Failed to list bindings of deleted model", zap.String("modelUUID", modelUUID), zap.Error(err))
+		return
+	}
+	for _, binding := range bindings {
+		if binding.ModelUUID != modelUUID {
+			continue
+		}
+		binding.Draining = true
+		if err := BindModelToPod(binding); err != nil {
+			log.ZapLogger.Error("Failed to drain pod", zap.String("podID", binding.PodID), zap.Error(err))
+			continue
+		}
+		go func(podID string) {
+			deadline := time.Now().Add(drainTimeout)
+			for time.Now().Before(deadline) {
+				running, err := podTaskCount(podID)
+				if err == nil && running == 0 {
+					break
+				}
+				time.Sleep(5 * time.Second)
+			}
+			log.ZapLogger.Info("Release pod of deleted model", zap.String("modelUUID", modelUUID), zap.String("podID", podID))
+			if err := UnbindModelFromPod(podID); err != nil {
+				log.ZapLogger.Error("Failed to unbind pod", zap.String("podID", podID), zap.Error(err))
+			}
+			if err := releasePod(podID); err != nil {
+				log.ZapLogger.Error("Failed to release pod", zap.String("podID", podID), zap.Error(err))
+			}
+		}(binding.PodID)
+	}
+}
+
+// RestoreModel accepts predictions for a deleted model again, its pods are deployed on demand
+func RestoreModel(model Model) (Model, error) {
+	if !model.IsDeleted() {
+		return model, nil
+	}
+	client := db.GetRedisClient()
+	if err := client.HSet(ctx, ModelPrefix+":"+model.UUID, "deleted_at", "").Err(); err != nil {
+		return Model{}, err
+	}
+	model.DeletedAt = nil
+	startModelWorker(model.UUID)
+	log.ZapLogger.Info("Model restored", zap.String("modelUUID", model.UUID))
+	return model, nil
+}
+
+// scanKeys lists the keys matching the pattern without blocking redis like KEYS does
+func scanKeys(pattern string) ([]string, error) {
+	var keys []string
+	iter := db.GetRedisClient().Scan(ctx, 0, pattern, 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+// PurgeModel removes a deleted model for good, with its versions, specs, traffic policy and queue.
+// Its usage and credit history are kept
+func PurgeModel(modelUUID string) error {
+	client := db.GetRedisClient()
+	keys, err := scanKeys(VersionPrefix + ":" + modelUUID + ":*")
+	if err != nil {
+		return err
+	}
+	statsKeys, err := scanKeys(versionStatsPrefix + modelUUID + ":*")
+	if err != nil {
+		return err
+	}
+	latencyKeys, err := scanKeys(versionLatencyPrefix + modelUUID + ":*")
+	if err != nil {
+		return err
+	}
+	trainingIDs, err := client.ZRange(ctx, trainingIndexPrefix+modelUUID, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	for _, trainingID := range trainingIDs {
+		keys = append(keys, trainingPrefix+trainingID)
+	}
+	keys = append(keys, statsKeys...)
+	keys = append(keys, latencyKeys...)
+	keys = append(keys,
+		versionIndexPrefix+":"+modelUUID,
+		versionSeqPrefix+":"+modelUUID,
+		trafficKey(modelUUID),
+		rolloutPrefix+modelUUID,
+		trainingIndexPrefix+modelUUID,
+		taskQueuePrefix+modelUUID,
+		rateLimitPrefix+"model:"+modelUUID,
+		activeTasksPrefix+"model:"+modelUUID,
+	)
+	if err := client.Del(ctx, keys...).Err(); err != nil {
+		return err
+	}
+	if err := openapi.RemoveSpecs(modelUUID); err != nil {
+		return err
+	}
+	log.ZapLogger.Info("Model purged", zap.String("modelUUID", modelUUID))
+	return RemoveModel(modelUUID)
+}
+
+// purgeDeletedModels purges the models deleted more than ModelRestoreWindow ago
+func purgeDeletedModels() {
+	models, err := GetAllModels()
+	if err != nil {
+		log.ZapLogger.Error("Failed to list models to purge", zap.Error(err))
+		return
+	}
+	for _, model := range models {
+		if model.IsDeleted() && time.Since(*model.DeletedAt) > ModelRestoreWindow {
+			if err := PurgeModel(model.UUID); err != nil {
+				log.ZapLogger.Error("Failed to purge model", zap.String("modelUUID", model.UUID), zap.Error(err))
+			}
+		}
+	}
+}
+
+func init() {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			purgeDeletedModels()
+		}
+	}()
+}
+
+func restoreModelHandler(c *gin.Context) {
+	model, ok := getManagedModel(c)
+	if !ok {
+		return
+	}
+
+	model, err := RestoreModel(model)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, model)
+}
@@ -24,24 +24,83 @@ func RegisterModel(body Model) (Model, error) {
 	// Define a namespace UUID (can be any UUID)
 	namespaceUUID := uuid.Must(uuid.Parse(namespaceUUIDStr))
 
-	// Generate a name-based UUID using the unique key (in this case, the name)s
-	newUUID := uuid.NewSHA1(namespaceUUID, []byte(body.Name)).String()
+	if body.Org != "" {
+		if _, err := GetOrg(body.Org); err != nil {
+			return Model{}, err
+		}
+	}
+	if body.Visibility == "" {
+		body.Visibility = Public
+	}
+	if body.Visibility != Public && body.Visibility != Private {
+		return Model{}, &InvalidRequestError{Message: "visibility must be public or private"}
+	}
+	if err := validateCatalog(&body); err != nil {
+		return Model{}, err
+	}
+	if err := validateModelType(body.Type); err != nil {
+		return Model{}, err
+	}
+
+	// Generate a name-based UUID using the unique key (in this case, the "<org>/<name>"),
+	// models without an organization keep the uuid of their name
+	newUUID := uuid.NewSHA1(namespaceUUID, []byte(body.FullName())).String()
+
+	// registering a new image adds a version, the previous ones stay available to pinned predictions. The prices,
+	// limits, visibility and catalog of the model are left as they are, they only change through its update
+	if existing, exists := GetModel(newUUID); exists {
+		if existing.IsDeleted() {
+			return Model{}, ErrModelDeleted
+		}
+		version, err := PublishModelVersion(existing, body.ImageURL, body.Digest, body.Hardware)
+		if err != nil {
+			return Model{}, err
+		}
+		setLatestVersion(&existing, version)
+		existing.SpecStatus, existing.SpecError = version.SpecStatus, version.SpecError
+		startModelWorker(existing.UUID)
+		return existing, nil
+	}
 
-	model := Model{Name: body.Name, ImageURL: body.ImageURL, UUID: newUUID, MinInstanceCnt: body.MinInstanceCnt, MaxInstanceCnt: body.MaxInstanceCnt, Type: body.Type}
-	err := AddModel(model)
+	model := Model{Name: body.Name, UUID: newUUID, MinInstanceCnt: body.MinInstanceCnt, MaxInstanceCnt: body.MaxInstanceCnt, Type: body.Type,
+		Org: body.Org, Visibility: body.Visibility,
+		RateLimit: body.RateLimit, MaxConcurrentTasks: body.MaxConcurrentTasks, PricePerSecond: body.PricePerSecond, PricePerOutput: body.PricePerOutput,
+		Description: body.Description, Tags: body.Tags, License: body.License, Owner: body.Owner, ExampleOutputs: body.ExampleOutputs}
+	version, _, err := CreateModelVersion(model, body.ImageURL, body.Digest, body.Hardware)
+	if err != nil {
+		return Model{}, err
+	}
+	setLatestVersion(&model, version)
+	// the spec of the image is discovered in the background
+	model.SpecStatus = SpecPending
+	err = AddModel(model)
 	if err != nil {
 		return Model{}, err
 	}
+	startModelWorker(model.UUID)
+	discoverModelSpecAsync(model, version, false)
 	return model, nil
 }
 
-func DeployModelToPod(modelUUID string, runPodAPI PodProviderAPI) (*Pod, error) {
+// ErrPodDraining is returned when the pod picked for a task started draining before the task was tracked on it
+var ErrPodDraining = errors.New("the pod picked for the task is draining")
+
+// DeployModelToPod returns a pod running the version of the model, 0 is its latest version. The task, when there is
+// one, is tracked on the pod before it is returned so that a drain waits for it
+func DeployModelToPod(modelUUID string, versionNumber int, taskID string, runPodAPI PodProviderAPI) (*Pod, error) {
 	// check model existance
 	model, modelExists := GetModel(modelUUID)
 	if !modelExists {
 		return nil, errors.New("model not found")
 	}
-	var modelImage = model.ImageURL
+	if model.IsDeleted() {
+		return nil, ErrModelDeleted
+	}
+	version, err := modelVersion(model, versionNumber)
+	if err != nil {
+		return nil, err
+	}
+	var modelImage = version.Image()
 	// Separate pods into two groups
 	var notOccupiedPods []Pod
 	// not-occupied pods with the same model image
@@ -56,28 +115,33 @@ func DeployModelToPod(modelUUID string, runPodAPI PodProviderAPI) (*Pod, error)
 			} else {
 				notOccupiedPods = append(notOccupiedPods, pod)
 			}
-		} else if exists && binding.ModelUUID == modelUUID {
+		} else if exists && binding.ModelUUID == modelUUID && binding.Version == version.Number && !binding.Draining {
 			sameModelPods = append(sameModelPods, pod)
 		}
 	}
 
-	// Prioritize pods with the same model binding, then not-occupied pods with the same image
-	selectedPod := roundRobinPod(sameModelPods)
-	if selectedPod == nil {
-		selectedPod = roundRobinPod(sameImagePods)
-		if selectedPod == nil {
-			selectedPod = roundRobinPod(notOccupiedPods)
-		}
-	} else {
-		// use existing pod
-		log.ZapLogger.Info("Pod already occupied by the same model, extend occupation time", zap.String("podID", selectedPod.ID))
-		// Extend the occupation time
-		selectedPod.LastUsed = time.Now()
-		err := ModifyPod(*selectedPod)
+	// Prioritize pods with the same model version binding, then not-occupied pods with the same image
+	if selectedPod := roundRobinPod(sameModelPods); selectedPod != nil {
+		claimed, err := claimPod(selectedPod.ID, modelUUID, version.Number, taskID)
 		if err != nil {
 			return nil, err
 		}
-		return selectedPod, nil
+		// a pod that started draining since it was listed is skipped
+		if claimed {
+			// use existing pod
+			log.ZapLogger.Info("Pod already occupied by the same model, extend occupation time", zap.String("podID", selectedPod.ID))
+			// Extend the occupation time
+			selectedPod.LastUsed = time.Now()
+			err = ModifyPod(*selectedPod)
+			if err != nil {
+				return nil, err
+			}
+			return selectedPod, nil
+		}
+	}
+	selectedPod := roundRobinPod(sameImagePods)
+	if selectedPod == nil {
+		selectedPod = roundRobinPod(notOccupiedPods)
 	}
 
 	// scale model to new pod
@@ -90,11 +154,19 @@ func DeployModelToPod(modelUUID string, runPodAPI PodProviderAPI) (*Pod, error)
 	if !canScale {
 		return nil, errors.New("model cannot be scaled")
 	}
+	// the new pod counts against the quota of the model organization
+	if err := CheckOrgPodQuota(model, pods); err != nil {
+		return nil, err
+	}
 
 	// if no more available not-occupied pod, try to create a new one
-	if selectedPod == nil && len(pods) < chain.MaxPodsCnt {
+	if selectedPod == nil {
+		// the organization quotas come on top of the global pod cap
+		if len(pods) >= chain.MaxPodsCnt {
+			return nil, fmt.Errorf("the hub has reached its cap of %d pods", chain.MaxPodsCnt)
+		}
 		log.ZapLogger.Info("Create a new pod", zap.String("modelUUID", modelUUID))
-		newPod, err := runPodAPI.CreatePod(model.ImageURL)
+		newPod, err := runPodAPI.CreatePod(modelImage, version.Hardware)
 		// trigger syncPods immediately
 		go SyncPods(runPodAPI)
 
@@ -106,7 +178,7 @@ func DeployModelToPod(modelUUID string, runPodAPI PodProviderAPI) (*Pod, error)
 
 	// Scale the model to the selected pod
 	log.ZapLogger.Info("Scale model to pod", zap.String("modelUUID", modelUUID), zap.String("podID", selectedPod.ID))
-	if err := runPodAPI.EditPod(selectedPod.ID, model.ImageURL); err != nil {
+	if err := runPodAPI.EditPod(selectedPod.ID, modelImage); err != nil {
 		return nil, err
 	}
 	// resume the pod if it's down
@@ -123,7 +195,7 @@ func DeployModelToPod(modelUUID string, runPodAPI PodProviderAPI) (*Pod, error)
 					return nil, err
 				}
 				log.ZapLogger.Info("Create a new pod", zap.String("modelUUID", modelUUID))
-				newPod, err := runPodAPI.CreatePod(model.ImageURL)
+				newPod, err := runPodAPI.CreatePod(modelImage, version.Hardware)
 				// trigger syncPods immediately
 				go SyncPods(runPodAPI)
 
@@ -145,11 +217,18 @@ func DeployModelToPod(modelUUID string, runPodAPI PodProviderAPI) (*Pod, error)
 		return nil, err
 	}
 
-	// Record the new model-pod binding
-	err = BindModelToPod(ModelPodBinding{ModelUUID: modelUUID, PodID: selectedPod.ID})
+	// Record the new model-pod binding, a pod a rollout or a training started draining meanwhile stays theirs
+	bound, err := bindModelToPodUnlessDraining(ModelPodBinding{ModelUUID: modelUUID, PodID: selectedPod.ID, Version: version.Number})
+	if err != nil {
+		return nil, err
+	}
+	claimed, err := claimPod(selectedPod.ID, modelUUID, version.Number, taskID)
 	if err != nil {
 		return nil, err
 	}
+	if !bound || !claimed {
+		return nil, ErrPodDraining
+	}
 
 	log.ZapLogger.Info("Waiting for API to be ready", zap.String("podID", selectedPod.ID))
 
@@ -161,16 +240,25 @@ func DeployModelToPod(modelUUID string, runPodAPI PodProviderAPI) (*Pod, error)
 	return selectedPod, nil
 }
 
-func GetPredictionEndPoint(modelUUID string, runPodAPI PodProviderAPI) (string, string, error) {
-	selectedPod, err := DeployModelToPod(modelUUID, runPodAPI)
+func GetPredictionEndPoint(modelUUID string, version int, taskID string, runPodAPI PodProviderAPI) (string, string, error) {
+	selectedPod, err := DeployModelToPod(modelUUID, version, taskID, runPodAPI)
+	if errors.Is(err, ErrPodDraining) {
+		// another pod is picked, or started, for the task
+		selectedPod, err = DeployModelToPod(modelUUID, version, taskID, runPodAPI)
+	}
 	if err != nil {
 		return "", "", err
 	}
 	// Return the API endpoint for the prediction
-	predictionAPIEndpoint := fmt.Sprintf("https://%s-5000.proxy.runpod.net/predictions", selectedPod.ID)
+	predictionAPIEndpoint := podAPIBaseURL(selectedPod.ID) + "/predictions"
 	return selectedPod.ID, predictionAPIEndpoint, nil
 }
 
+// podAPIBaseURL is the url of the cog API of the pod
+func podAPIBaseURL(podID string) string {
+	return fmt.Sprintf("https://%s-5000.proxy.runpod.net", podID)
+}
+
 func roundRobinPod(pods []Pod) *Pod {
 	if len(pods) == 0 {
 		return nil
@@ -0,0 +1,100 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func testDigest(b string) string {
+	return "sha256:" + strings.Repeat(b, 64)
+}
+
+func TestRegisterModelAgainKeepsSettings(t *testing.T) {
+	name := "test-" + uuid.NewString()
+	registered, err := RegisterModel(Model{
+		Name:               name,
+		ImageURL:           "r8.im/test/model",
+		Digest:             testDigest("a"),
+		Visibility:         Private,
+		RateLimit:          30,
+		MaxConcurrentTasks: 2,
+		PricePerSecond:     3,
+		PricePerOutput:     7,
+		Description:        "a test model",
+	})
+	if err != nil {
+		t.Fatalf("RegisterModel() = %v", err)
+	}
+
+	// an organization key can only send an image, prices and limits are left out
+	republished, err := RegisterModel(Model{Name: name, ImageURL: "r8.im/test/model", Digest: testDigest("b")})
+	if err != nil {
+		t.Fatalf("RegisterModel() again = %v", err)
+	}
+	if republished.LatestVersion != registered.LatestVersion+1 {
+		t.Errorf("LatestVersion = %d, want %d", republished.LatestVersion, registered.LatestVersion+1)
+	}
+
+	model, ok := GetModel(registered.UUID)
+	if !ok {
+		t.Fatalf("GetModel() found no model")
+	}
+	if model.PricePerSecond != 3 || model.PricePerOutput != 7 {
+		t.Errorf("prices = %d, %d, want 3, 7", model.PricePerSecond, model.PricePerOutput)
+	}
+	if model.RateLimit != 30 || model.MaxConcurrentTasks != 2 {
+		t.Errorf("limits = %v, %d, want 30, 2", model.RateLimit, model.MaxConcurrentTasks)
+	}
+	if model.Visibility != Private || model.Description != "a test model" {
+		t.Errorf("visibility and description = %s, %q, want them kept", model.Visibility, model.Description)
+	}
+	if model.Digest != testDigest("b") || model.LatestVersion != republished.LatestVersion {
+		t.Errorf("latest version = %d with %s, want the new image", model.LatestVersion, model.Digest)
+	}
+}
+
+func TestRegisterModelAgainKeepsDeletion(t *testing.T) {
+	registered, err := RegisterModel(Model{Name: "test-" + uuid.NewString(), ImageURL: "r8.im/test/model", Digest: testDigest("a")})
+	if err != nil {
+		t.Fatalf("RegisterModel() = %v", err)
+	}
+	if _, err := DeleteModel(registered); err != nil {
+		t.Fatalf("DeleteModel() = %v", err)
+	}
+
+	_, err = RegisterModel(Model{Name: registered.Name, ImageURL: "r8.im/test/model", Digest: testDigest("b")})
+	if !errors.Is(err, ErrModelDeleted) {
+		t.Errorf("RegisterModel() of a deleted model = %v, want ErrModelDeleted", err)
+	}
+	if model, _ := GetModel(registered.UUID); !model.IsDeleted() {
+		t.Errorf("model was restored by registering it again")
+	}
+}
+
+func TestModelDeletedAtIsOmittedUntilDeleted(t *testing.T) {
+	registered, err := RegisterModel(Model{Name: "test-" + uuid.NewString(), ImageURL: "r8.im/test/model", Digest: testDigest("a")})
+	if err != nil {
+		t.Fatalf("RegisterModel() = %v", err)
+	}
+	model, _ := GetModel(registered.UUID)
+	serialized, err := json.Marshal(model)
+	if err != nil {
+		t.Fatalf("json.Marshal() = %v", err)
+	}
+	if strings.Contains(string(serialized), "deleted_at") {
+		t.Errorf("model JSON = %s, want no deleted_at", serialized)
+	}
+
+	if _, err := DeleteModel(model); err != nil {
+		t.Fatalf("DeleteModel() = %v", err)
+	}
+	model, _ = GetModel(registered.UUID)
+	if model.DeletedAt == nil || time.Since(*model.DeletedAt) > time.Minute {
+		t.Errorf("DeletedAt = %v, want the deletion time", model.DeletedAt)
+	}
+}
@@ -0,0 +1,68 @@
+package hub
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// ErrPrivateAddress is returned when a url given by a model or a caller points at a private or internal address
+var ErrPrivateAddress = errors.New("private and internal addresses can not be reached")
+
+// sharedAddressSpace is the carrier grade NAT range, it is not routable on the internet either
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isPublicIP reports whether the address is routable on the internet
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() &&
+		!sharedAddressSpace.Contains(ip)
+}
+
+// checkPublicHost refuses hosts that are, or resolve to, non public addresses. The connections of a public http
+// client are checked again once they are made, a host may resolve differently by then
+func checkPublicHost(host string) error {
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = net.LookupIP(host); err != nil {
+			return err
+		}
+	}
+	for _, ip := range ips {
+		if !isPublicIP(ip) {
+			return ErrPrivateAddress
+		}
+	}
+	return nil
+}
+
+// publicOnlyControl refuses connections to non public addresses, it runs once the host is resolved so a name
+// resolving to an internal address is refused too
+func publicOnlyControl(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return ErrPrivateAddress
+	}
+	return nil
+}
+
+// newPublicHTTPClient is a client for urls the hub does not control, like model outputs and caller webhooks, it only
+// reaches public addresses, redirects included
+func newPublicHTTPClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: publicOnlyControl}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
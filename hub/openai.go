@@ -0,0 +1,503 @@
+package hub
+
+import (
+	"cotelligence-model-hub/log"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// OpenAI compatible API, ref: https://platform.openai.com/docs/api-reference/chat
+
+type ChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type ChatCompletionRequest struct {
+	Model       string        `json:"model" binding:"required"`
+	Messages    []ChatMessage `json:"messages" binding:"required"`
+	MaxTokens   *int          `json:"max_tokens"`
+	Temperature *float64      `json:"temperature"`
+	TopP        *float64      `json:"top_p"`
+	Stop        interface{}   `json:"stop"`
+	Seed        *int          `json:"seed"`
+	Stream      bool          `json:"stream"`
+}
+
+type CompletionRequest struct {
+	Model       string      `json:"model" binding:"required"`
+	Prompt      string      `json:"prompt"`
+	MaxTokens   *int        `json:"max_tokens"`
+	Temperature *float64    `json:"temperature"`
+	TopP        *float64    `json:"top_p"`
+	Stop        interface{} `json:"stop"`
+	Seed        *int        `json:"seed"`
+	Stream      bool        `json:"stream"`
+}
+
+type ImageGenerationRequest struct {
+	Model          string `json:"model" binding:"required"`
+	Prompt         string `json:"prompt" binding:"required"`
+	N              *int   `json:"n"`
+	Size           string `json:"size"`
+	ResponseFormat string `json:"response_format"`
+	NegativePrompt string `json:"negative_prompt"`
+	Seed           *int   `json:"seed"`
+}
+
+type ImageData struct {
+	URL     string `json:"url,omitempty"`
+	B64JSON string `json:"b64_json,omitempty"`
+}
+
+type ImageGenerationResponse struct {
+	Created int64       `json:"created"`
+	Data    []ImageData `json:"data"`
+}
+
+type OpenAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type OpenAIChoice struct {
+	Index        int          `json:"index"`
+	Message      *ChatMessage `json:"message,omitempty"`
+	Delta        *ChatMessage `json:"delta,omitempty"`
+	Text         *string      `json:"text,omitempty"`
+	FinishReason *string      `json:"finish_reason"`
+}
+
+type OpenAIResponse struct {
+	ID      string         `json:"id"`
+	Object  string         `json:"object"`
+	Created int64          `json:"created"`
+	Model   string         `json:"model"`
+	Choices []OpenAIChoice `json:"choices"`
+	Usage   *OpenAIUsage   `json:"usage,omitempty"`
+}
+
+// generationParams are the sampling parameters shared by chat and text completions
+type generationParams struct {
+	MaxTokens   *int
+	Temperature *float64
+	TopP        *float64
+	Stop        interface{}
+	Seed        *int
+}
+
+// cog input names tried in order for each OpenAI parameter
+var (
+	maxTokensInputs = []string{"max_new_tokens", "max_tokens", "max_length"}
+	stopInputs      = []string{"stop_sequences", "stop"}
+)
+
+func openAIError(c *gin.Context, status int, errType, message string) {
+	c.JSON(status, gin.H{"error": gin.H{
+		"message": message,
+		"type":    errType,
+		"param":   nil,
+		"code":    nil,
+	}})
+}
+
+// openAIPredictionError answers a failed submission, an invalid input names its first invalid field as the param and
+// lists every violation
+func openAIPredictionError(c *gin.Context, err error) {
+	var inputValidationError *InputValidationError
+	if !errors.As(err, &inputValidationError) || len(inputValidationError.Violations) == 0 {
+		openAIError(c, predictionErrorStatus(c, err), "invalid_request_error", err.Error())
+		return
+	}
+	c.JSON(http.StatusUnprocessableEntity, gin.H{"error": gin.H{
+		"message":    err.Error(),
+		"type":       "invalid_request_error",
+		"param":      inputValidationError.Violations[0].Field,
+		"code":       "invalid_input",
+		"violations": inputValidationError.Violations,
+	}})
+}
+
+// hasInput reports whether the Input schema declares the input, models without a spec declare none
+func hasInput(schema *openapi3.Schema, name string) bool {
+	if schema == nil {
+		return false
+	}
+	_, ok := schema.Properties[name]
+	return ok
+}
+
+// findModelOfType resolves the OpenAI model field to a registered model of the given type
+func findModelOfType(name string, modelType ModelType) (Model, error) {
+	model, ok := FindModel(name)
+	if !ok {
+		return Model{}, fmt.Errorf("model %s not found", name)
+	}
+	if model.Type != modelType {
+		return Model{}, fmt.Errorf("model %s is not a %s model", name, modelType)
+	}
+	return model, nil
+}
+
+// renderChatPrompt flattens chat messages into a single prompt, a system message goes to system_prompt when the model has one
+func renderChatPrompt(messages []ChatMessage, hasSystemPrompt bool) (string, string) {
+	var systemPrompt string
+	var conversation []ChatMessage
+	for _, message := range messages {
+		if message.Role == "system" && hasSystemPrompt {
+			systemPrompt = strings.TrimSpace(systemPrompt + "\n" + message.Content)
+			continue
+		}
+		conversation = append(conversation, message)
+	}
+	if len(conversation) == 1 && conversation[0].Role == "user" {
+		return conversation[0].Content, systemPrompt
+	}
+
+	var prompt strings.Builder
+	for _, message := range conversation {
+		if message.Role != "" {
+			prompt.WriteString(strings.ToUpper(message.Role[:1]) + message.Role[1:] + ": ")
+		}
+		prompt.WriteString(message.Content + "\n")
+	}
+	prompt.WriteString("Assistant:")
+	return prompt.String(), systemPrompt
+}
+
+// buildText2TextInput maps the OpenAI parameters onto the inputs declared in the Input schema of the version
+func buildText2TextInput(schema *openapi3.Schema, prompt, systemPrompt string, params generationParams) map[string]interface{} {
+	has := func(name string) bool { return hasInput(schema, name) }
+	setFirst := func(input map[string]interface{}, names []string, value interface{}) {
+		for _, name := range names {
+			if has(name) {
+				input[name] = value
+				return
+			}
+		}
+	}
+
+	input := map[string]interface{}{"prompt": prompt}
+	if systemPrompt != "" {
+		input["system_prompt"] = systemPrompt
+	}
+	if params.MaxTokens != nil {
+		setFirst(input, maxTokensInputs, *params.MaxTokens)
+	}
+	if params.Temperature != nil && has("temperature") {
+		input["temperature"] = *params.Temperature
+	}
+	if params.TopP != nil && has("top_p") {
+		input["top_p"] = *params.TopP
+	}
+	if params.Seed != nil && has("seed") {
+		input["seed"] = *params.Seed
+	}
+	switch stop := params.Stop.(type) {
+	case string:
+		setFirst(input, stopInputs, stop)
+	case []interface{}:
+		var stops []string
+		for _, s := range stop {
+			if str, ok := s.(string); ok {
+				stops = append(stops, str)
+			}
+		}
+		setFirst(input, stopInputs, strings.Join(stops, ","))
+	}
+	return input
+}
+
+// usageFromMetrics reads the token counts cog LLM models report in their metrics
+func usageFromMetrics(metrics interface{}) *OpenAIUsage {
+	usage := &OpenAIUsage{}
+	if m, ok := metrics.(map[string]interface{}); ok {
+		if v, ok := m["input_token_count"].(float64); ok {
+			usage.PromptTokens = int(v)
+		}
+		if v, ok := m["output_token_count"].(float64); ok {
+			usage.CompletionTokens = int(v)
+		}
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	return usage
+}
+
+// runText2Text submits the input and answers with a completion built by newChoice, either at once or as SSE chunks
+func runText2Text(c *gin.Context, target predictionTarget, object, idPrefix string, stream bool, input map[string]interface{},
+	newChoice func(text string, finishReason *string, chunk bool) OpenAIChoice) {
+	taskId, err := submitPredictionTo(currentAPIKey(c), target, map[string]interface{}{"input": input, "stream": stream})
+	if err != nil {
+		openAIPredictionError(c, err)
+		return
+	}
+	response := OpenAIResponse{
+		ID:      idPrefix + taskId,
+		Object:  object,
+		Created: time.Now().Unix(),
+		Model:   target.model.Name,
+	}
+	stopReason := "stop"
+
+	if !stream {
+		result, err := waitForTaskCompletion(taskId)
+		if err != nil {
+			openAIError(c, http.StatusInternalServerError, "server_error", err.Error())
+			return
+		}
+		if status, _ := result["status"].(string); TaskStatus(status) != Succeeded {
+			message, _ := result["error"].(string)
+			openAIError(c, http.StatusInternalServerError, "server_error", fmt.Sprintf("prediction %s: %s", status, message))
+			return
+		}
+		text := strings.Join(outputChunks(result["output"]), "")
+		response.Choices = []OpenAIChoice{newChoice(text, &stopReason, false)}
+		response.Usage = usageFromMetrics(result["metrics"])
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	c.Writer.Header().Set("Content-Type", "text/event-stream")
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.Header().Set("Connection", "keep-alive")
+	c.Writer.Header().Set("X-Task-Id", taskId)
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		log.ZapLogger.Error("Expected http.ResponseWriter to be an http.Flusher")
+		return
+	}
+	writeData := func(data interface{}) {
+		payload, _ := json.Marshal(data)
+		_, _ = fmt.Fprintf(c.Writer, "data: %s\n\n", payload)
+	}
+
+	response.Object = object + ".chunk"
+	if object == "text_completion" {
+		// text completion chunks keep the same object name
+		response.Object = object
+	}
+	err = watchTaskData(c.Request.Context(), taskId, func(task TaskData, chunks []string, logs string) {
+		if text := strings.Join(chunks, ""); text != "" {
+			response.Choices = []OpenAIChoice{newChoice(text, nil, true)}
+			writeData(response)
+		}
+		switch task.Status {
+		case Succeeded:
+			response.Choices = []OpenAIChoice{newChoice("", &stopReason, true)}
+			writeData(response)
+		case Failed, Canceled:
+			writeData(gin.H{"error": gin.H{"message": task.Error, "type": "server_error"}})
+		}
+		flusher.Flush()
+	})
+	if err != nil {
+		log.ZapLogger.Error("Failed to stream completion", zap.String("taskId", taskId), zap.Error(err))
+	}
+	_, _ = fmt.Fprint(c.Writer, "data: [DONE]\n\n")
+	flusher.Flush()
+}
+
+func chatCompletionsHandler(c *gin.Context) {
+	var body ChatCompletionRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		openAIError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	model, err := findModelOfType(body.Model, Text2Text)
+	if err != nil {
+		openAIError(c, http.StatusNotFound, "invalid_request_error", err.Error())
+		return
+	}
+	target, err := resolvePrediction(currentAPIKey(c), model.UUID, nil)
+	if err != nil {
+		openAIPredictionError(c, err)
+		return
+	}
+	prompt, systemPrompt := renderChatPrompt(body.Messages, hasInput(target.schema, "system_prompt"))
+	input := buildText2TextInput(target.schema, prompt, systemPrompt, generationParams{
+		MaxTokens:   body.MaxTokens,
+		Temperature: body.Temperature,
+		TopP:        body.TopP,
+		Stop:        body.Stop,
+		Seed:        body.Seed,
+	})
+
+	runText2Text(c, target, "chat.completion", "chatcmpl-", body.Stream, input,
+		func(text string, finishReason *string, chunk bool) OpenAIChoice {
+			message := &ChatMessage{Role: "assistant", Content: text}
+			if chunk {
+				return OpenAIChoice{Delta: message, FinishReason: finishReason}
+			}
+			return OpenAIChoice{Message: message, FinishReason: finishReason}
+		})
+}
+
+func completionsHandler(c *gin.Context) {
+	var body CompletionRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		openAIError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	model, err := findModelOfType(body.Model, Text2Text)
+	if err != nil {
+		openAIError(c, http.StatusNotFound, "invalid_request_error", err.Error())
+		return
+	}
+	target, err := resolvePrediction(currentAPIKey(c), model.UUID, nil)
+	if err != nil {
+		openAIPredictionError(c, err)
+		return
+	}
+	input := buildText2TextInput(target.schema, body.Prompt, "", generationParams{
+		MaxTokens:   body.MaxTokens,
+		Temperature: body.Temperature,
+		TopP:        body.TopP,
+		Stop:        body.Stop,
+		Seed:        body.Seed,
+	})
+
+	runText2Text(c, target, "text_completion", "cmpl-", body.Stream, input,
+		func(text string, finishReason *string, chunk bool) OpenAIChoice {
+			return OpenAIChoice{Text: &text, FinishReason: finishReason}
+		})
+}
+
+// parseImageSize parses an OpenAI size such as 1024x1024
+func parseImageSize(size string) (int, int, error) {
+	parts := strings.Split(size, "x")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid size: %s", size)
+	}
+	width, err := strconv.Atoi(parts[0])
+	if err != nil || width <= 0 {
+		return 0, 0, fmt.Errorf("invalid size: %s", size)
+	}
+	height, err := strconv.Atoi(parts[1])
+	if err != nil || height <= 0 {
+		return 0, 0, fmt.Errorf("invalid size: %s", size)
+	}
+	return width, height, nil
+}
+
+// buildText2ImgInput maps the OpenAI image parameters onto the inputs declared in the Input schema of the version
+func buildText2ImgInput(schema *openapi3.Schema, body ImageGenerationRequest) (map[string]interface{}, error) {
+	has := func(name string) bool { return hasInput(schema, name) }
+
+	input := map[string]interface{}{"prompt": body.Prompt}
+	if body.N != nil && has("num_outputs") {
+		input["num_outputs"] = *body.N
+	}
+	if body.Size != "" {
+		width, height, err := parseImageSize(body.Size)
+		if err != nil {
+			return nil, &InvalidRequestError{Message: err.Error()}
+		}
+		if has("width") && has("height") {
+			input["width"] = width
+			input["height"] = height
+		}
+	}
+	if body.NegativePrompt != "" && has("negative_prompt") {
+		input["negative_prompt"] = body.NegativePrompt
+	}
+	if body.Seed != nil && has("seed") {
+		input["seed"] = *body.Seed
+	}
+	return input, nil
+}
+
+// imageToBase64 returns the base64 content of an image output, which is either a data uri or a url
+func imageToBase64(image string) (string, error) {
+	if strings.HasPrefix(image, "data:") {
+		if i := strings.Index(image, ";base64,"); i >= 0 {
+			return image[i+len(";base64,"):], nil
+		}
+		return "", fmt.Errorf("unsupported data uri")
+	}
+	resp, err := mediaClient.Get(image)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download image: status %d", resp.StatusCode)
+	}
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(content), nil
+}
+
+func imageGenerationsHandler(c *gin.Context) {
+	var body ImageGenerationRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		openAIError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	if body.ResponseFormat == "" {
+		body.ResponseFormat = "url"
+	}
+	if body.ResponseFormat != "url" && body.ResponseFormat != "b64_json" {
+		openAIError(c, http.StatusBadRequest, "invalid_request_error", "response_format must be url or b64_json")
+		return
+	}
+	model, err := findModelOfType(body.Model, Text2Img)
+	if err != nil {
+		openAIError(c, http.StatusNotFound, "invalid_request_error", err.Error())
+		return
+	}
+	target, err := resolvePrediction(currentAPIKey(c), model.UUID, nil)
+	if err != nil {
+		openAIPredictionError(c, err)
+		return
+	}
+	input, err := buildText2ImgInput(target.schema, body)
+	if err != nil {
+		openAIError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+
+	taskId, err := submitPredictionTo(currentAPIKey(c), target, map[string]interface{}{"input": input})
+	if err != nil {
+		openAIPredictionError(c, err)
+		return
+	}
+	result, err := waitForTaskCompletion(taskId)
+	if err != nil {
+		openAIError(c, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	if status, _ := result["status"].(string); TaskStatus(status) != Succeeded {
+		message, _ := result["error"].(string)
+		openAIError(c, http.StatusInternalServerError, "server_error", fmt.Sprintf("prediction %s: %s", status, message))
+		return
+	}
+
+	response := ImageGenerationResponse{Created: time.Now().Unix(), Data: make([]ImageData, 0)}
+	for _, image := range outputChunks(result["output"]) {
+		if body.ResponseFormat == "url" {
+			response.Data = append(response.Data, ImageData{URL: image})
+			continue
+		}
+		b64, err := imageToBase64(image)
+		if err != nil {
+			openAIError(c, http.StatusBadGateway, "server_error", err.Error())
+			return
+		}
+		response.Data = append(response.Data, ImageData{B64JSON: b64})
+	}
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,182 @@
+package hub
+
+import (
+	"cotelligence-model-hub/chain"
+	"cotelligence-model-hub/db"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+// Organization owns models, its models are registered as "<org>/<name>"
+type Organization struct {
+	Name string `json:"name"`
+	// MaxPods is the number of pods the models of the organization may hold, 0 falls back to chain.MaxPodsCnt
+	MaxPods   int       `json:"max_pods,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const OrgPrefix = "cotelligence-model:org"
+
+var ErrOrgNotFound = errors.New("organization not found")
+
+var orgNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+func saveOrg(org Organization) error {
+	client := db.GetRedisClient()
+	serialized, err := json.Marshal(org)
+	if err != nil {
+		return err
+	}
+	return client.Set(ctx, OrgPrefix+":"+org.Name, serialized, 0).Err()
+}
+
+// CreateOrg creates an organization, the name is part of its model names and can not change
+func CreateOrg(name string, maxPods int) (Organization, error) {
+	if !orgNamePattern.MatchString(name) {
+		return Organization{}, &InvalidRequestError{Message: "organization names are lowercase letters, digits, '.', '_' and '-'"}
+	}
+	if _, err := GetOrg(name); err == nil {
+		return Organization{}, &InvalidRequestError{Message: "organization already exists: " + name}
+	}
+	org := Organization{Name: name, MaxPods: maxPods, CreatedAt: time.Now()}
+	return org, saveOrg(org)
+}
+
+func GetOrg(name string) (Organization, error) {
+	client := db.GetRedisClient()
+	val, err := client.Get(ctx, OrgPrefix+":"+name).Result()
+	if errors.Is(err, redis.Nil) {
+		return Organization{}, ErrOrgNotFound
+	}
+	if err != nil {
+		return Organization{}, err
+	}
+	var org Organization
+	err = json.Unmarshal([]byte(val), &org)
+	return org, err
+}
+
+func GetAllOrgs() ([]Organization, error) {
+	client := db.GetRedisClient()
+	keys, err := client.Keys(ctx, OrgPrefix+":*").Result()
+	if err != nil {
+		return nil, err
+	}
+	orgs := make([]Organization, 0, len(keys))
+	for _, key := range keys {
+		org, err := GetOrg(strings.TrimPrefix(key, OrgPrefix+":"))
+		if err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, org)
+	}
+	return orgs, nil
+}
+
+// UpdateOrgQuota sets the pod quota of the organization
+func UpdateOrgQuota(name string, maxPods int) (Organization, error) {
+	org, err := GetOrg(name)
+	if err != nil {
+		return Organization{}, err
+	}
+	org.MaxPods = maxPods
+	return org, saveOrg(org)
+}
+
+// orgPodQuota is the pod quota of the organization, models without an organization share chain.MaxPodsCnt
+func orgPodQuota(orgName string) int {
+	if orgName == "" {
+		return chain.MaxPodsCnt
+	}
+	org, err := GetOrg(orgName)
+	if err != nil || org.MaxPods <= 0 {
+		return chain.MaxPodsCnt
+	}
+	return org.MaxPods
+}
+
+// CheckOrgPodQuota fails when the organization of the model already holds its quota of occupied pods
+func CheckOrgPodQuota(model Model, pods []Pod) error {
+	quota := orgPodQuota(model.Org)
+	used := 0
+	for _, pod := range pods {
+		if !pod.IsOccupied() {
+			continue
+		}
+		binding, exists := GetModelPodBinding(pod.ID)
+		if !exists {
+			continue
+		}
+		if boundModel, ok := GetModel(binding.ModelUUID); ok && boundModel.Org == model.Org {
+			used++
+		}
+	}
+	if used >= quota {
+		return fmt.Errorf("organization %q has reached its quota of %d pods", model.Org, quota)
+	}
+	return nil
+}
+
+func createOrgHandler(c *gin.Context) {
+	var body struct {
+		Name    string `json:"name" binding:"required"`
+		MaxPods int    `json:"max_pods"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	org, err := CreateOrg(body.Name, body.MaxPods)
+	if err != nil {
+		var invalidRequestError *InvalidRequestError
+		if errors.As(err, &invalidRequestError) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, org)
+}
+
+func listOrgsHandler(c *gin.Context) {
+	orgs, err := GetAllOrgs()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, orgs)
+}
+
+func updateOrgQuotaHandler(c *gin.Context) {
+	var body struct {
+		MaxPods int `json:"max_pods"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	org, err := UpdateOrgQuota(c.Param("org"), body.MaxPods)
+	if errors.Is(err, ErrOrgNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, org)
+}
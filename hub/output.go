@@ -0,0 +1,275 @@
+package hub
+
+import (
+	"bufio"
+	"cotelligence-model-hub/db"
+	"cotelligence-model-hub/log"
+	"cotelligence-model-hub/openapi"
+	"encoding/base64"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// MediaFile is a file output of a model, images also have their dimensions
+type MediaFile struct {
+	URL      string `json:"url"`
+	MimeType string `json:"mime_type,omitempty"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+}
+
+// NormalizedOutput is the output of a model in the shape of its type, whatever its cog output looks like
+type NormalizedOutput struct {
+	Type       ModelType   `json:"type"`
+	Text       *string     `json:"text,omitempty"`
+	Images     []MediaFile `json:"images,omitempty"`
+	Videos     []MediaFile `json:"videos,omitempty"`
+	Audio      []MediaFile `json:"audio,omitempty"`
+	Embeddings [][]float64 `json:"embeddings,omitempty"`
+	Weights    string      `json:"weights,omitempty"`
+}
+
+// mediaClient downloads the first bytes of image outputs to read their type and dimensions, output urls come from the
+// model so only public addresses are fetched
+var mediaClient = newPublicHTTPClient(30 * time.Second)
+
+// outputText joins the strings of a text output, token streams are concatenated
+func outputText(output interface{}) (string, bool) {
+	switch v := output.(type) {
+	case string:
+		return v, true
+	case []interface{}:
+		var text strings.Builder
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return "", false
+			}
+			text.WriteString(s)
+		}
+		return text.String(), true
+	case map[string]interface{}:
+		for _, name := range []string{"text", "transcription"} {
+			if value, ok := v[name]; ok {
+				return outputText(value)
+			}
+		}
+	}
+	return "", false
+}
+
+// outputURLs lists the file urls of a file output
+func outputURLs(output interface{}) ([]string, bool) {
+	switch v := output.(type) {
+	case string:
+		return []string{v}, true
+	case []interface{}:
+		urls := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, false
+			}
+			urls = append(urls, s)
+		}
+		return urls, true
+	}
+	return nil, false
+}
+
+func toVector(value interface{}) ([]float64, bool) {
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	vector := make([]float64, 0, len(items))
+	for _, item := range items {
+		number, ok := item.(float64)
+		if !ok {
+			return nil, false
+		}
+		vector = append(vector, number)
+	}
+	return vector, true
+}
+
+// outputEmbeddings reads a vector or a list of vectors
+func outputEmbeddings(output interface{}) ([][]float64, bool) {
+	if object, ok := output.(map[string]interface{}); ok {
+		for _, name := range []string{"embedding", "embeddings"} {
+			if value, ok := object[name]; ok {
+				return outputEmbeddings(value)
+			}
+		}
+		return nil, false
+	}
+	if vector, ok := toVector(output); ok {
+		return [][]float64{vector}, true
+	}
+	items, ok := output.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	embeddings := make([][]float64, 0, len(items))
+	for _, item := range items {
+		vector, ok := toVector(item)
+		if !ok {
+			return nil, false
+		}
+		embeddings = append(embeddings, vector)
+	}
+	return embeddings, true
+}
+
+// guessMimeType is the mime type of a data uri or of the extension of a url
+func guessMimeType(fileURL string) string {
+	if strings.HasPrefix(fileURL, "data:") {
+		mimeType, _, _ := strings.Cut(strings.TrimPrefix(fileURL, "data:"), ";")
+		return mimeType
+	}
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return ""
+	}
+	mimeType, _, _ := strings.Cut(mime.TypeByExtension(path.Ext(u.Path)), ";")
+	return mimeType
+}
+
+// openMedia opens the content of a data uri or a url
+func openMedia(fileURL string) (io.ReadCloser, string, error) {
+	if strings.HasPrefix(fileURL, "data:") {
+		i := strings.Index(fileURL, ";base64,")
+		if i < 0 {
+			return nil, "", fmt.Errorf("unsupported data uri")
+		}
+		content := base64.NewDecoder(base64.StdEncoding, strings.NewReader(fileURL[i+len(";base64,"):]))
+		return io.NopCloser(content), guessMimeType(fileURL), nil
+	}
+	resp, err := mediaClient.Get(fileURL)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, "", fmt.Errorf("failed to download file: status %d", resp.StatusCode)
+	}
+	mimeType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	return resp.Body, mimeType, nil
+}
+
+// describeImage reads the mime type and dimensions of an image output from its first bytes
+func describeImage(fileURL string) (MediaFile, error) {
+	file := MediaFile{URL: fileURL, MimeType: guessMimeType(fileURL)}
+	content, mimeType, err := openMedia(fileURL)
+	if err != nil {
+		return file, err
+	}
+	defer content.Close()
+
+	reader := bufio.NewReader(content)
+	head, _ := reader.Peek(512)
+	if mimeType == "" || mimeType == "application/octet-stream" || mimeType == "binary/octet-stream" {
+		mimeType = http.DetectContentType(head)
+	}
+	file.MimeType = mimeType
+	config, _, err := image.DecodeConfig(reader)
+	if err != nil {
+		return file, err
+	}
+	file.Width, file.Height = config.Width, config.Height
+	return file, nil
+}
+
+// NormalizeOutput shapes the cog output after the contract of the model type
+func NormalizeOutput(modelType ModelType, output interface{}) (NormalizedOutput, error) {
+	normalized := NormalizedOutput{Type: modelType}
+	contract, ok := modelType.Contract()
+	if !ok {
+		return normalized, fmt.Errorf("model has no type to normalize its output")
+	}
+	switch contract.Output {
+	case openapi.KindText:
+		text, ok := outputText(output)
+		if !ok {
+			return normalized, fmt.Errorf("output is not text")
+		}
+		normalized.Text = &text
+	case openapi.KindFile:
+		urls, ok := outputURLs(output)
+		if !ok {
+			return normalized, fmt.Errorf("output is not a list of files")
+		}
+		for _, fileURL := range urls {
+			switch modelType {
+			case Text2Vid:
+				normalized.Videos = append(normalized.Videos, MediaFile{URL: fileURL, MimeType: guessMimeType(fileURL)})
+			case Text2Speech:
+				normalized.Audio = append(normalized.Audio, MediaFile{URL: fileURL, MimeType: guessMimeType(fileURL)})
+			default:
+				// images that can not be read, like webp ones, are listed without their dimensions
+				file, err := describeImage(fileURL)
+				if err != nil {
+					log.ZapLogger.Warn("Failed to read output image", zap.String("url", fileURL), zap.Error(err))
+				}
+				normalized.Images = append(normalized.Images, file)
+			}
+		}
+	case openapi.KindEmbedding:
+		embeddings, ok := outputEmbeddings(output)
+		if !ok {
+			return normalized, fmt.Errorf("output is not an embedding")
+		}
+		normalized.Embeddings = embeddings
+	case openapi.KindWeights:
+		object, _ := output.(map[string]interface{})
+		weights, ok := object["weights"].(string)
+		if !ok {
+			return normalized, fmt.Errorf("output has no weights")
+		}
+		normalized.Weights = weights
+	}
+	return normalized, nil
+}
+
+// normalizedOutputModel returns the model of a succeeded task that asked for its output to be normalized
+func normalizedOutputModel(taskID string, response map[string]interface{}) (Model, bool) {
+	if TaskStatus(fmt.Sprint(response["status"])) != Succeeded {
+		return Model{}, false
+	}
+	client := db.GetRedisClient()
+	fields, err := client.HMGet(ctx, taskPrefix+taskID, "NormalizeOutput", "ModelId").Result()
+	if err != nil || fields[0] != "1" {
+		return Model{}, false
+	}
+	modelId, _ := fields[1].(string)
+	return GetModel(modelId)
+}
+
+// addNormalizedOutput puts the normalized output next to the raw output of a succeeded task that asked for it,
+// image outputs are downloaded to read their dimensions
+func addNormalizedOutput(taskID string, response map[string]interface{}) {
+	model, ok := normalizedOutputModel(taskID, response)
+	if !ok {
+		return
+	}
+
+	normalized, err := NormalizeOutput(model.Type, response["output"])
+	if err != nil {
+		log.ZapLogger.Warn("Failed to normalize task output", zap.String("taskId", taskID), zap.Error(err))
+		response["normalized_error"] = err.Error()
+		return
+	}
+	response["normalized"] = normalized
+}
@@ -16,7 +16,7 @@ func (e *InsufficientGPUsError) Error() string {
 
 type PodProviderAPI interface {
 	ListPods() ([]Pod, error)
-	CreatePod(imageURL string) (Pod, error)
+	CreatePod(imageURL string, hardware HardwareProfile) (Pod, error)
 	EditPod(podID, imageURL string) error
 	RemovePod(podID string) error
 	StopPod(podID string) error
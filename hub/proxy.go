@@ -3,7 +3,9 @@ package hub
 import (
 	"bytes"
 	"cotelligence-model-hub/log"
+	"crypto/subtle"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"time"
@@ -13,6 +15,9 @@ import (
 
 const ProxyMaxAliveSeconds = 600
 
+// hubWebhookBaseURL is where the pods reach the hub webhooks
+const hubWebhookBaseURL = "https://api-dev.cotelligence.io/cotelligence-model"
+
 // Define a global HTTP client with a connection pool
 var proxyClient = &http.Client{
 	Transport: &http.Transport{
@@ -24,14 +29,25 @@ var proxyClient = &http.Client{
 	},
 }
 
-func ProxyRequestToPod(modelUUID, taskId string, body map[string]interface{}) (map[string]interface{}, error) {
+func ProxyRequestToPod(modelUUID string, version int, taskId, webhookToken string, body map[string]interface{}) (map[string]interface{}, error) {
 
 	runPodAPI := GetRunPodAPIClient()
 	// Pass the userParams to StartPrediction
-	_, predictionAPIEndpoint, err := GetPredictionEndPoint(modelUUID, runPodAPI)
+	podID, predictionAPIEndpoint, err := GetPredictionEndPoint(modelUUID, version, taskId, runPodAPI)
 	if err != nil {
 		return nil, err
 	}
+	// Remember the pod serving the task so it can be canceled there
+	if err := SetTaskPod(taskId, podID); err != nil {
+		return nil, err
+	}
+	// a task canceled while its pod was starting is not sent to it
+	if taskCompleted(taskId) {
+		_ = untrackPodTask(podID, taskId)
+		return nil, ErrTaskCompleted
+	}
+	// a version whose discovery failed gets its spec from the first pod that runs it
+	go discoverSpecOnPod(modelUUID, version, podID)
 
 	proxyHeaders := http.Header{}
 	proxyHeaders.Set("Content-Type", "application/json")
@@ -41,10 +57,14 @@ func ProxyRequestToPod(modelUUID, taskId string, body map[string]interface{}) (m
 	if ok && stream {
 		// Set the proxy header to Prefer:respond-async
 		proxyHeaders.Set("Prefer", "respond-async")
-		// Add a webhook addr to the json
-		body["webhook"] = "https://api-dev.cotelligence.io/cotelligence-model/webhook/" + taskId
+		// Add a webhook addr to the json and subscribe to all cog events
+		body["webhook"] = hubWebhookBaseURL + "/webhook/" + taskId + "?token=" + webhookToken
+		body["webhook_events_filter"] = AllWebhookEvents
 	}
 
+	// Use the task id as the cog prediction id
+	body["id"] = taskId
+
 	// Marshal the predictionParams back into JSON to send as the body of the request
 	jsonData, err := json.Marshal(body)
 	if err != nil {
@@ -60,9 +80,6 @@ func ProxyRequestToPod(modelUUID, taskId string, body map[string]interface{}) (m
 
 	// Perform the request
 	client := proxyClient
-	if err != nil {
-		return nil, err
-	}
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
@@ -89,3 +106,22 @@ func ProxyRequestToPod(modelUUID, taskId string, body map[string]interface{}) (m
 	respBodyMap["id"] = taskId
 	return respBodyMap, nil
 }
+
+// validWebhookToken reports whether the token of a cog webhook request is the one of its task or training
+func validWebhookToken(expected, token string) bool {
+	return expected != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
+
+// CancelPrediction cancels a running prediction on the pod
+func CancelPrediction(podID, taskId string) error {
+	cancelEndpoint := fmt.Sprintf("https://%s-5000.proxy.runpod.net/predictions/%s/cancel", podID, taskId)
+	resp, err := proxyClient.Post(cancelEndpoint, "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to cancel prediction %s on pod %s: status %d", taskId, podID, resp.StatusCode)
+	}
+	return nil
+}
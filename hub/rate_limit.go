@@ -0,0 +1,221 @@
+package hub
+
+import (
+	"cotelligence-model-hub/db"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+// RateLimitError is returned when a prediction exceeds a rate or concurrency limit
+type RateLimitError struct {
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return e.Message
+}
+
+const rateLimitPrefix = "hub:rateLimit:"
+const activeTasksPrefix = "hub:activeTasks:"
+
+// activeTaskTTL drops tasks that never reported completion from the concurrency count, same as the task expiry
+const activeTaskTTL = 3 * time.Hour
+
+// tokenBucketsScript refills the buckets for the elapsed time and takes one token from each when they all have one,
+// buckets with a rate of 0 are unlimited. It returns {0, 0} when allowed or the position of the first empty bucket
+// and the milliseconds until it has a token
+var tokenBucketsScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local taken = {}
+for i, key in ipairs(KEYS) do
+	local rate = tonumber(ARGV[i * 2])
+	local burst = tonumber(ARGV[i * 2 + 1])
+	if rate > 0 then
+		local data = redis.call('HMGET', key, 'tokens', 'ts')
+		local tokens = tonumber(data[1]) or burst
+		local ts = tonumber(data[2]) or now
+		tokens = math.min(burst, tokens + (now - ts) / 1000 * rate)
+		if tokens < 1 then
+			return {i, math.ceil((1 - tokens) / rate * 1000)}
+		end
+		taken[#taken + 1] = {key, tokens - 1, math.ceil(burst / rate * 1000) + 1000}
+	end
+end
+for _, bucket in ipairs(taken) do
+	redis.call('HSET', bucket[1], 'tokens', bucket[2], 'ts', now)
+	redis.call('PEXPIRE', bucket[1], bucket[3])
+end
+return {0, 0}
+`)
+
+// returnTokensScript gives back the token taken from each bucket, up to its burst
+var returnTokensScript = redis.NewScript(`
+for i, key in ipairs(KEYS) do
+	local tokens = tonumber(redis.call('HGET', key, 'tokens'))
+	if tokens then
+		redis.call('HSET', key, 'tokens', math.min(tonumber(ARGV[i]), tokens + 1))
+	end
+end
+return 0
+`)
+
+// acquireTaskSlotScript counts the active tasks of the key and the model and records the task when both are under limit,
+// it returns 0 when acquired, 1 when the key is at its limit and 2 when the model is
+var acquireTaskSlotScript = redis.NewScript(`
+local staleBefore = ARGV[1]
+local now = ARGV[2]
+local taskId = ARGV[3]
+local limits = {tonumber(ARGV[4]), tonumber(ARGV[5])}
+for i, key in ipairs(KEYS) do
+	redis.call('ZREMRANGEBYSCORE', key, '-inf', staleBefore)
+	if limits[i] > 0 and redis.call('ZCARD', key) >= limits[i] then
+		return i
+	end
+end
+for _, key in ipairs(KEYS) do
+	redis.call('ZADD', key, now, taskId)
+end
+return 0
+`)
+
+// rateLimitBucket is a token bucket refilled at ratePerMinute, burst is the bucket size
+type rateLimitBucket struct {
+	name          string
+	ratePerMinute float64
+	burst         int
+}
+
+// size is the burst of the bucket, a minute of tokens when it has none
+func (b rateLimitBucket) size() int {
+	if b.burst > 0 {
+		return b.burst
+	}
+	return int(math.Max(1, math.Ceil(b.ratePerMinute)))
+}
+
+// rateLimitBuckets are the buckets of the api key and of the model, in that order
+func rateLimitBuckets(apiKey APIKey, model Model) []rateLimitBucket {
+	return []rateLimitBucket{
+		{name: "key:" + apiKey.ID, ratePerMinute: apiKey.RateLimit, burst: apiKey.RateBurst},
+		{name: "model:" + model.UUID, ratePerMinute: model.RateLimit},
+	}
+}
+
+// CheckRateLimits takes a token from the buckets of the api key and of the model, none is taken when one is empty
+func CheckRateLimits(apiKey APIKey, model Model) error {
+	buckets := rateLimitBuckets(apiKey, model)
+	keys := make([]string, 0, len(buckets))
+	args := []interface{}{time.Now().UnixMilli()}
+	for _, bucket := range buckets {
+		keys = append(keys, rateLimitPrefix+bucket.name)
+		args = append(args, math.Max(0, bucket.ratePerMinute)/60, bucket.size())
+	}
+	client := db.GetRedisClient()
+	result, err := tokenBucketsScript.Run(ctx, client, keys, args...).Int64Slice()
+	if err != nil {
+		return err
+	}
+	wait := time.Duration(result[1]) * time.Millisecond
+	switch result[0] {
+	case 1:
+		return &RateLimitError{Message: "api key rate limit exceeded", RetryAfter: wait}
+	case 2:
+		return &RateLimitError{Message: fmt.Sprintf("model %s rate limit exceeded", model.Name), RetryAfter: wait}
+	}
+	return nil
+}
+
+// returnRateLimitTokens gives back the tokens CheckRateLimits took for a request refused by a later check
+func returnRateLimitTokens(apiKey APIKey, model Model) error {
+	var keys []string
+	var args []interface{}
+	for _, bucket := range rateLimitBuckets(apiKey, model) {
+		if bucket.ratePerMinute > 0 {
+			keys = append(keys, rateLimitPrefix+bucket.name)
+			args = append(args, bucket.size())
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	client := db.GetRedisClient()
+	return returnTokensScript.Run(ctx, client, keys, args...).Err()
+}
+
+// activeTasksKeys are the concurrency sets of the api key and the model, tasks without an api key only count for the model
+func activeTasksKeys(apiKeyId, modelUUID string) []string {
+	if apiKeyId == "" {
+		return []string{activeTasksPrefix + "model:" + modelUUID}
+	}
+	return []string{activeTasksPrefix + "key:" + apiKeyId, activeTasksPrefix + "model:" + modelUUID}
+}
+
+// AcquireTaskSlot counts the task against the concurrency limits of the api key and the model
+func AcquireTaskSlot(apiKey APIKey, model Model, taskID string) error {
+	now := time.Now()
+	client := db.GetRedisClient()
+	result, err := acquireTaskSlotScript.Run(ctx, client, activeTasksKeys(apiKey.ID, model.UUID),
+		now.Add(-activeTaskTTL).Unix(), now.Unix(), taskID, apiKey.MaxConcurrentTasks, model.MaxConcurrentTasks).Int()
+	if err != nil {
+		return err
+	}
+	switch result {
+	case 1:
+		return &RateLimitError{Message: fmt.Sprintf("api key has reached its limit of %d concurrent tasks", apiKey.MaxConcurrentTasks), RetryAfter: 5 * time.Second}
+	case 2:
+		return &RateLimitError{Message: fmt.Sprintf("model %s has reached its limit of %d concurrent tasks", model.Name, model.MaxConcurrentTasks), RetryAfter: 5 * time.Second}
+	}
+	return nil
+}
+
+// acquireModelSlot counts a task without an api key, like a shadow task, against the concurrency limit of the model
+func acquireModelSlot(model Model, taskID string) error {
+	now := time.Now()
+	client := db.GetRedisClient()
+	result, err := acquireTaskSlotScript.Run(ctx, client, activeTasksKeys("", model.UUID),
+		now.Add(-activeTaskTTL).Unix(), now.Unix(), taskID, model.MaxConcurrentTasks, 0).Int()
+	if err != nil {
+		return err
+	}
+	if result != 0 {
+		return &RateLimitError{Message: fmt.Sprintf("model %s has reached its limit of %d concurrent tasks", model.Name, model.MaxConcurrentTasks), RetryAfter: 5 * time.Second}
+	}
+	return nil
+}
+
+// ReleaseTaskSlot frees the concurrency slot of a finished task
+func ReleaseTaskSlot(apiKeyId, modelUUID, taskID string) error {
+	client := db.GetRedisClient()
+	pipeline := client.Pipeline()
+	for _, key := range activeTasksKeys(apiKeyId, modelUUID) {
+		pipeline.ZRem(ctx, key, taskID)
+	}
+	_, err := pipeline.Exec(ctx)
+	return err
+}
+
+// refreshTaskSlot keeps the slot of a long running training from being dropped as stale
+func refreshTaskSlot(apiKeyId, modelUUID, taskID string) error {
+	client := db.GetRedisClient()
+	pipeline := client.Pipeline()
+	for _, key := range activeTasksKeys(apiKeyId, modelUUID) {
+		pipeline.ZAddXX(ctx, key, &redis.Z{Score: float64(time.Now().Unix()), Member: taskID})
+	}
+	_, err := pipeline.Exec(ctx)
+	return err
+}
+
+// setRetryAfter tells the caller when to retry a rate limited request
+func setRetryAfter(c *gin.Context, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(seconds))
+}
@@ -0,0 +1,154 @@
+package hub
+
+import (
+	"cotelligence-model-hub/db"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+func asRateLimitError(t *testing.T, err error) *RateLimitError {
+	t.Helper()
+	var rateLimitError *RateLimitError
+	if !errors.As(err, &rateLimitError) {
+		t.Fatalf("got error %v, want a RateLimitError", err)
+	}
+	return rateLimitError
+}
+
+func TestCheckRateLimitsAPIKeyBurst(t *testing.T) {
+	apiKey := APIKey{ID: uuid.NewString(), RateLimit: 60, RateBurst: 2}
+	model := Model{UUID: uuid.NewString(), Name: "test"}
+
+	for i := 0; i < apiKey.RateBurst; i++ {
+		if err := CheckRateLimits(apiKey, model); err != nil {
+			t.Fatalf("CheckRateLimits() request %d = %v, want it allowed", i+1, err)
+		}
+	}
+	rateLimitError := asRateLimitError(t, CheckRateLimits(apiKey, model))
+	// one token a second
+	if rateLimitError.RetryAfter <= 0 || rateLimitError.RetryAfter > time.Second {
+		t.Errorf("RetryAfter = %v, want up to a second", rateLimitError.RetryAfter)
+	}
+}
+
+func TestCheckRateLimitsModel(t *testing.T) {
+	model := Model{UUID: uuid.NewString(), Name: "test", RateLimit: 1}
+
+	if err := CheckRateLimits(APIKey{ID: uuid.NewString()}, model); err != nil {
+		t.Fatalf("CheckRateLimits() = %v, want it allowed", err)
+	}
+	// the model bucket is shared by every key
+	rateLimitError := asRateLimitError(t, CheckRateLimits(APIKey{ID: uuid.NewString()}, model))
+	if rateLimitError.RetryAfter <= 55*time.Second || rateLimitError.RetryAfter > time.Minute {
+		t.Errorf("RetryAfter = %v, want about a minute", rateLimitError.RetryAfter)
+	}
+}
+
+func TestCheckRateLimitsModelRefusalKeepsKeyToken(t *testing.T) {
+	apiKey := APIKey{ID: uuid.NewString(), RateLimit: 1, RateBurst: 1}
+	model := Model{UUID: uuid.NewString(), Name: "test", RateLimit: 1}
+	if err := CheckRateLimits(APIKey{ID: uuid.NewString()}, model); err != nil {
+		t.Fatalf("CheckRateLimits() = %v, want it allowed", err)
+	}
+
+	rateLimitError := asRateLimitError(t, CheckRateLimits(apiKey, model))
+	if rateLimitError.Message != "model test rate limit exceeded" {
+		t.Errorf("Message = %q, want the model limit", rateLimitError.Message)
+	}
+	// the refused request took nothing from the bucket of the key
+	if err := CheckRateLimits(apiKey, Model{UUID: uuid.NewString(), Name: "other"}); err != nil {
+		t.Errorf("CheckRateLimits() on another model = %v, want the key token kept", err)
+	}
+}
+
+func TestSubmitPredictionRefusedReturnsRateLimitTokens(t *testing.T) {
+	apiKey := APIKey{ID: uuid.NewString(), RateLimit: 1, RateBurst: 1, MaxConcurrentTasks: 1}
+	model := Model{UUID: uuid.NewString(), Name: "test", RateLimit: 1}
+	if err := AcquireTaskSlot(apiKey, model, uuid.NewString()); err != nil {
+		t.Fatalf("AcquireTaskSlot() = %v", err)
+	}
+
+	_, err := submitPredictionTo(apiKey, predictionTarget{model: model}, map[string]interface{}{"input": map[string]interface{}{}})
+	rateLimitError := asRateLimitError(t, err)
+	if rateLimitError.Message != "api key has reached its limit of 1 concurrent tasks" {
+		t.Errorf("Message = %q, want the concurrency limit of the key", rateLimitError.Message)
+	}
+	// the prediction never ran, its tokens are back in the buckets of the key and the model
+	if err := CheckRateLimits(apiKey, model); err != nil {
+		t.Errorf("CheckRateLimits() after the refused prediction = %v, want the tokens returned", err)
+	}
+}
+
+func TestCheckRateLimitsUnlimited(t *testing.T) {
+	apiKey := APIKey{ID: uuid.NewString()}
+	model := Model{UUID: uuid.NewString(), Name: "test"}
+	for i := 0; i < 100; i++ {
+		if err := CheckRateLimits(apiKey, model); err != nil {
+			t.Fatalf("CheckRateLimits() request %d = %v, want no limit", i+1, err)
+		}
+	}
+}
+
+func TestAcquireTaskSlotAPIKeyLimit(t *testing.T) {
+	apiKey := APIKey{ID: uuid.NewString(), MaxConcurrentTasks: 1}
+	model := Model{UUID: uuid.NewString(), Name: "test"}
+
+	if err := AcquireTaskSlot(apiKey, model, "task-1"); err != nil {
+		t.Fatalf("AcquireTaskSlot() = %v, want a slot", err)
+	}
+	asRateLimitError(t, AcquireTaskSlot(apiKey, model, "task-2"))
+	// another key is not held back by this one
+	if err := AcquireTaskSlot(APIKey{ID: uuid.NewString(), MaxConcurrentTasks: 1}, model, "task-3"); err != nil {
+		t.Fatalf("AcquireTaskSlot() of another key = %v, want a slot", err)
+	}
+
+	if err := ReleaseTaskSlot(apiKey.ID, model.UUID, "task-1"); err != nil {
+		t.Fatalf("ReleaseTaskSlot() = %v", err)
+	}
+	if err := AcquireTaskSlot(apiKey, model, "task-2"); err != nil {
+		t.Errorf("AcquireTaskSlot() after release = %v, want a slot", err)
+	}
+}
+
+func TestAcquireTaskSlotModelLimit(t *testing.T) {
+	model := Model{UUID: uuid.NewString(), Name: "test", MaxConcurrentTasks: 1}
+
+	if err := AcquireTaskSlot(APIKey{ID: uuid.NewString()}, model, "task-1"); err != nil {
+		t.Fatalf("AcquireTaskSlot() = %v, want a slot", err)
+	}
+	asRateLimitError(t, AcquireTaskSlot(APIKey{ID: uuid.NewString()}, model, "task-2"))
+	// tasks without an api key, like shadow tasks, count against the model too
+	asRateLimitError(t, acquireModelSlot(model, "shadow-1"))
+}
+
+func TestAcquireTaskSlotKeyLimitLeavesModelUntouched(t *testing.T) {
+	apiKey := APIKey{ID: uuid.NewString(), MaxConcurrentTasks: 1}
+	model := Model{UUID: uuid.NewString(), Name: "test", MaxConcurrentTasks: 2}
+
+	if err := AcquireTaskSlot(apiKey, model, "task-1"); err != nil {
+		t.Fatalf("AcquireTaskSlot() = %v, want a slot", err)
+	}
+	asRateLimitError(t, AcquireTaskSlot(apiKey, model, "task-2"))
+	// the refused task must not hold a model slot
+	if err := AcquireTaskSlot(APIKey{ID: uuid.NewString()}, model, "task-3"); err != nil {
+		t.Errorf("AcquireTaskSlot() of another key = %v, want the second model slot", err)
+	}
+}
+
+func TestAcquireTaskSlotDropsStaleTasks(t *testing.T) {
+	apiKey := APIKey{ID: uuid.NewString(), MaxConcurrentTasks: 1}
+	model := Model{UUID: uuid.NewString(), Name: "test"}
+
+	// a task that never reported completion
+	stale := float64(time.Now().Add(-activeTaskTTL - time.Minute).Unix())
+	if err := db.GetRedisClient().ZAdd(ctx, activeTasksPrefix+"key:"+apiKey.ID, &redis.Z{Score: stale, Member: "lost"}).Err(); err != nil {
+		t.Fatalf("failed to add the stale task: %v", err)
+	}
+	if err := AcquireTaskSlot(apiKey, model, "task-1"); err != nil {
+		t.Errorf("AcquireTaskSlot() = %v, want the stale slot dropped", err)
+	}
+}
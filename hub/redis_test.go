@@ -0,0 +1,31 @@
+package hub
+
+import (
+	"net"
+	"os"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// testRedis is the in-memory redis the hub talks to in tests. It is started while the package variables are
+// initialized, before the init functions of the package connect to redis with the config read from the environment
+var testRedis = startTestRedis()
+
+func startTestRedis() *miniredis.Miniredis {
+	server, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	host, port, _ := net.SplitHostPort(server.Addr())
+	env := map[string]string{
+		"REDIS_HOST":     host,
+		"REDIS_PORT":     port,
+		"REDIS_PASSWORD": "",
+		"RUNPOD_API_KEY": "test",
+		"DB_DSN":         "test",
+	}
+	for name, value := range env {
+		os.Setenv(name, value)
+	}
+	return server
+}
@@ -0,0 +1,139 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// registryClient asks image registries for the digest of a tag, registries are named by the caller so only public
+// addresses are reached
+var registryClient = newPublicHTTPClient(15 * time.Second)
+
+const dockerHubRegistry = "registry-1.docker.io"
+
+// errRegistryDenied is returned when the registry does not let an anonymous client read the image, like the images
+// of private repositories
+var errRegistryDenied = errors.New("registry denied anonymous access")
+
+// manifestMediaTypes are the manifests a tag may point at, multi platform images point at an index
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// parseImageRef splits "[registry/]repository[:tag]" into the registry host, the repository and the tag,
+// images without a registry are on Docker Hub
+func parseImageRef(imageURL string) (string, string, string) {
+	registry, repository := dockerHubRegistry, imageURL
+	if host, rest, ok := strings.Cut(imageURL, "/"); ok && (strings.ContainsAny(host, ".:") || host == "localhost") {
+		registry, repository = host, rest
+	}
+	tag := "latest"
+	if i := strings.LastIndex(repository, ":"); i >= 0 {
+		repository, tag = repository[:i], repository[i+1:]
+	}
+	if registry == dockerHubRegistry && !strings.Contains(repository, "/") {
+		repository = "library/" + repository
+	}
+	return registry, repository, tag
+}
+
+// registryToken gets an anonymous pull token from the auth server named in the WWW-Authenticate challenge
+func registryToken(challenge string) (string, error) {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", fmt.Errorf("unsupported registry authentication %s", scheme)
+	}
+	values := url.Values{}
+	var realm string
+	for _, param := range strings.Split(params, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		value = strings.Trim(value, `"`)
+		if name == "realm" {
+			realm = value
+		} else {
+			values.Set(name, value)
+		}
+	}
+	if realm == "" {
+		return "", fmt.Errorf("registry authentication has no realm")
+	}
+	resp, err := registryClient.Get(realm + "?" + values.Encode())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return "", fmt.Errorf("%w: authentication answered %d", errRegistryDenied, resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry authentication answered %d", resp.StatusCode)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	return body.AccessToken, nil
+}
+
+// headManifest asks the registry for the manifest of the tag, with the token when there is one
+func headManifest(manifestURL, token string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodHead, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := registryClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// resolveImageDigest asks the registry which digest the tag of the image points at now, with an anonymous token.
+// Registries that require credentials for the image answer errRegistryDenied
+func resolveImageDigest(imageURL string) (string, error) {
+	registry, repository, tag := parseImageRef(imageURL)
+	manifestURL := fmt.Sprintf("https://%s/v2/%s/manifests/%s", registry, repository, tag)
+	resp, err := headManifest(manifestURL, "")
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		token, err := registryToken(resp.Header.Get("WWW-Authenticate"))
+		if err != nil {
+			return "", err
+		}
+		if resp, err = headManifest(manifestURL, token); err != nil {
+			return "", err
+		}
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return "", fmt.Errorf("%w: answered %d for %s", errRegistryDenied, resp.StatusCode, imageURL)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry answered %d for %s", resp.StatusCode, imageURL)
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if !digestPattern.MatchString(digest) {
+		return "", fmt.Errorf("registry did not return the digest of %s", imageURL)
+	}
+	return digest, nil
+}
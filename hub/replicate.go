@@ -0,0 +1,238 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Replicate compatible API, ref: https://replicate.com/docs/reference/http#predictions.create
+
+type ReplicatePredictionRequest struct {
+	Version             string                 `json:"version" binding:"required"`
+	Input               map[string]interface{} `json:"input"`
+	Webhook             string                 `json:"webhook,omitempty"`
+	WebhookEventsFilter []WebhookEvent         `json:"webhook_events_filter,omitempty"`
+	Stream              bool                   `json:"stream"`
+}
+
+type ReplicatePrediction struct {
+	ID          string                 `json:"id"`
+	Model       string                 `json:"model"`
+	Version     string                 `json:"version"`
+	Input       map[string]interface{} `json:"input"`
+	Output      interface{}            `json:"output"`
+	Logs        string                 `json:"logs"`
+	Error       *string                `json:"error"`
+	Status      TaskStatus             `json:"status"`
+	CreatedAt   string                 `json:"created_at"`
+	StartedAt   *string                `json:"started_at"`
+	CompletedAt *string                `json:"completed_at"`
+	Metrics     map[string]interface{} `json:"metrics,omitempty"`
+	Urls        map[string]string      `json:"urls"`
+}
+
+// requestBaseURL returns the scheme and host the caller used to reach the hub
+func requestBaseURL(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+func optionalString(v interface{}) *string {
+	if s, ok := v.(string); ok && s != "" {
+		return &s
+	}
+	return nil
+}
+
+// toReplicatePrediction converts a hub task into a replicate prediction
+func toReplicatePrediction(c *gin.Context, task Task) ReplicatePrediction {
+	prediction := ReplicatePrediction{
+		ID:          task.ID,
+		Model:       task.ModelId,
+		Version:     task.ModelId,
+		Logs:        task.Logs,
+		Status:      task.Status,
+		CreatedAt:   task.CreatedAt.UTC().Format(time.RFC3339Nano),
+		StartedAt:   optionalString(task.Response["started_at"]),
+		CompletedAt: optionalString(task.Response["completed_at"]),
+		Metrics:     task.Metrics,
+	}
+	if model, ok := GetModel(task.ModelId); ok {
+		prediction.Model = model.Name
+	}
+	if task.Version > 0 {
+		prediction.Version = task.ModelId + ":" + strconv.Itoa(task.Version)
+	}
+	if input, ok := task.Body["input"].(map[string]interface{}); ok {
+		prediction.Input = input
+	}
+	if prediction.Status == "" {
+		prediction.Status = Starting
+	}
+	if task.Error != "" {
+		prediction.Error = &task.Error
+	}
+	if task.Response != nil {
+		prediction.Output = task.Response["output"]
+	}
+
+	baseURL := requestBaseURL(c) + "/v1/predictions/" + task.ID
+	prediction.Urls = map[string]string{
+		"get":    baseURL,
+		"cancel": baseURL + "/cancel",
+	}
+	if stream, _ := task.Body["stream"].(bool); stream {
+		prediction.Urls["stream"] = requestBaseURL(c) + "/sse/" + task.ID
+	}
+	return prediction
+}
+
+// maxPreferWait caps how long Prefer: wait holds the request, as on Replicate
+const maxPreferWait = 60 * time.Second
+
+// preferredWait parses the Prefer header, "wait" waits the most and "wait=n" waits n seconds up to that cap
+func preferredWait(prefer string) (time.Duration, bool) {
+	if !strings.HasPrefix(prefer, "wait") {
+		return 0, false
+	}
+	_, value, found := strings.Cut(prefer, "=")
+	if !found {
+		return maxPreferWait, true
+	}
+	seconds, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || seconds <= 0 {
+		return maxPreferWait, true
+	}
+	if wait := time.Duration(seconds) * time.Second; wait < maxPreferWait {
+		return wait, true
+	}
+	return maxPreferWait, true
+}
+
+func replicateError(c *gin.Context, status int, detail string) {
+	c.JSON(status, gin.H{"title": http.StatusText(status), "status": status, "detail": detail})
+}
+
+// replicatePredictionError answers a failed submission, an invalid input lists its invalid fields
+func replicatePredictionError(c *gin.Context, err error) {
+	var inputValidationError *InputValidationError
+	if !errors.As(err, &inputValidationError) {
+		replicateError(c, predictionErrorStatus(c, err), err.Error())
+		return
+	}
+	invalidFields := make([]gin.H, 0, len(inputValidationError.Violations))
+	for _, violation := range inputValidationError.Violations {
+		invalidFields = append(invalidFields, gin.H{"type": "invalid", "field": violation.Field, "description": violation.Message})
+	}
+	c.JSON(http.StatusUnprocessableEntity, gin.H{
+		"title":          "Input validation failed",
+		"status":         http.StatusUnprocessableEntity,
+		"detail":         err.Error(),
+		"invalid_fields": invalidFields,
+	})
+}
+
+func createReplicatePredictionHandler(c *gin.Context) {
+	var body ReplicatePredictionRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		replicateError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	// the version is either the model uuid or its name, optionally followed by ":<version number>"
+	model, ok := FindModel(body.Version)
+	var versionNumber string
+	if !ok {
+		if name, number, found := strings.Cut(body.Version, ":"); found {
+			model, ok = FindModel(name)
+			versionNumber = number
+		}
+	}
+	if !ok {
+		replicateError(c, http.StatusNotFound, "version not found: "+body.Version)
+		return
+	}
+
+	predictionParams := map[string]interface{}{"input": body.Input}
+	if versionNumber != "" {
+		predictionParams["version"] = versionNumber
+	}
+	if body.Stream {
+		predictionParams["stream"] = true
+	}
+	if body.Webhook != "" {
+		predictionParams["webhook"] = body.Webhook
+		if body.WebhookEventsFilter != nil {
+			filter := make([]interface{}, 0, len(body.WebhookEventsFilter))
+			for _, event := range body.WebhookEventsFilter {
+				filter = append(filter, string(event))
+			}
+			predictionParams["webhook_events_filter"] = filter
+		}
+	}
+	taskId, err := SubmitPrediction(currentAPIKey(c), model.UUID, predictionParams)
+	if err != nil {
+		replicatePredictionError(c, err)
+		return
+	}
+
+	// Prefer: wait blocks until the prediction is done or the wait is over, the prediction is returned either way
+	if wait, ok := preferredWait(c.GetHeader("Prefer")); ok {
+		waitCtx, cancel := context.WithTimeout(c.Request.Context(), wait)
+		_, err := waitForTaskCompletionContext(waitCtx, taskId)
+		cancel()
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
+			replicateError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	task, err := GetTask(taskId)
+	if err != nil {
+		replicateError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusCreated, toReplicatePrediction(c, task))
+}
+
+func getReplicatePredictionHandler(c *gin.Context) {
+	task, err := getOwnTask(c, c.Param("predictionId"))
+	if err != nil {
+		replicateError(c, http.StatusNotFound, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, toReplicatePrediction(c, task))
+}
+
+func cancelReplicatePredictionHandler(c *gin.Context) {
+	predictionId := c.Param("predictionId")
+	if _, err := getOwnTask(c, predictionId); err != nil {
+		replicateError(c, http.StatusNotFound, err.Error())
+		return
+	}
+	err := CancelTask(predictionId)
+	if errors.Is(err, ErrTaskNotFound) {
+		replicateError(c, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil && !errors.Is(err, ErrTaskCompleted) {
+		replicateError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	task, err := GetTask(predictionId)
+	if err != nil {
+		replicateError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, toReplicatePrediction(c, task))
+}
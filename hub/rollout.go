@@ -0,0 +1,412 @@
+package hub
+
+import (
+	"cotelligence-model-hub/db"
+	"cotelligence-model-hub/log"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+type RolloutState string
+
+const (
+	RolloutPending   RolloutState = "pending"
+	RolloutDraining  RolloutState = "draining"
+	RolloutUpdating  RolloutState = "updating"
+	RolloutRunning   RolloutState = "running"
+	RolloutCompleted RolloutState = "completed"
+	RolloutFailed    RolloutState = "failed"
+)
+
+// RolloutPod is the progress of a bound pod moved to the rollout version
+type RolloutPod struct {
+	PodID       string       `json:"pod_id"`
+	FromVersion int          `json:"from_version"`
+	State       RolloutState `json:"state"`
+	Error       string       `json:"error,omitempty"`
+}
+
+// Rollout moves the pods bound to older versions of a model to its new version, MaxUnavailable pods at a time
+type Rollout struct {
+	ModelUUID      string       `json:"model_uuid"`
+	Version        int          `json:"version"`
+	MaxUnavailable int          `json:"max_unavailable"`
+	State          RolloutState `json:"state"`
+	Pods           []RolloutPod `json:"pods"`
+	StartedAt      time.Time    `json:"started_at"`
+	FinishedAt     *time.Time   `json:"finished_at,omitempty"`
+}
+
+const rolloutPrefix = "hub:rollout:"
+const rolloutLockPrefix = "hub:rolloutLock:"
+const podTasksPrefix = "hub:podTasks:"
+
+// DefaultMaxUnavailable is the number of pods a rollout takes out of service at once
+const DefaultMaxUnavailable = 1
+
+// drainTimeout bounds the wait for the running tasks of a pod, the pod is left on its version past it
+const drainTimeout = 15 * time.Minute
+
+// rolloutTimeout bounds a rollout, editing and booting a pod can take as long as a cold start
+const rolloutTimeout = 2 * time.Hour
+
+var ErrRolloutInProgress = errors.New("a rollout is already in progress for this model")
+
+// trackPodTask remembers the task running on the pod until it finishes, rollouts drain pods by waiting for them
+func trackPodTask(podID, taskID string) error {
+	client := db.GetRedisClient()
+	return client.SAdd(ctx, podTasksPrefix+podID, taskID).Err()
+}
+
+func untrackPodTask(podID, taskID string) error {
+	if podID == "" {
+		return nil
+	}
+	client := db.GetRedisClient()
+	return client.SRem(ctx, podTasksPrefix+podID, taskID).Err()
+}
+
+// podTaskCount counts the tasks still running on the pod, forgetting the ones that finished or expired
+func podTaskCount(podID string) (int, error) {
+	client := db.GetRedisClient()
+	taskIDs, err := client.SMembers(ctx, podTasksPrefix+podID).Result()
+	if err != nil {
+		return 0, err
+	}
+	running := 0
+	for _, taskID := range taskIDs {
+		if strings.HasPrefix(taskID, trainingIDPrefix) {
+			if trainingRunning(taskID, podID) {
+				running++
+			} else {
+				_ = untrackPodTask(podID, taskID)
+			}
+			continue
+		}
+		task, err := GetTask(taskID)
+		if err != nil || task.ModelId == "" || task.Status.IsTerminal() || task.PodId != podID {
+			_ = untrackPodTask(podID, taskID)
+			continue
+		}
+		running++
+	}
+	return running, nil
+}
+
+// drainPod waits for the running tasks of a draining pod to finish, the pod is kept occupied meanwhile
+func drainPod(podID string) error {
+	deadline := time.Now().Add(drainTimeout)
+	for {
+		if err := touchPod(podID, ""); err != nil {
+			return err
+		}
+		running, err := podTaskCount(podID)
+		if err != nil {
+			return err
+		}
+		if running == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("pod %s still runs %d tasks after %s", podID, running, drainTimeout)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// touchPod keeps the pod occupied so it is neither picked by another model nor unbound while it is updated
+func touchPod(podID, image string) error {
+	client := db.GetRedisClient()
+	fields := []interface{}{"LastUsed", time.Now().Format(time.RFC3339)}
+	if image != "" {
+		fields = append(fields, "Image", image)
+	}
+	return client.HSet(ctx, PodRedisPrefix+":"+podID, fields...).Err()
+}
+
+func saveRollout(rollout Rollout) error {
+	client := db.GetRedisClient()
+	serialized, err := json.Marshal(rollout)
+	if err != nil {
+		return err
+	}
+	return client.Set(ctx, rolloutPrefix+rollout.ModelUUID, serialized, 0).Err()
+}
+
+// GetRollout returns the latest rollout of the model
+func GetRollout(modelUUID string) (Rollout, bool, error) {
+	client := db.GetRedisClient()
+	val, err := client.Get(ctx, rolloutPrefix+modelUUID).Result()
+	if errors.Is(err, redis.Nil) {
+		return Rollout{}, false, nil
+	}
+	if err != nil {
+		return Rollout{}, false, err
+	}
+	var rollout Rollout
+	err = json.Unmarshal([]byte(val), &rollout)
+	return rollout, err == nil, err
+}
+
+// rolloutPods returns the pods bound to other versions of the model, versions the traffic policy still routes to
+// keep their pods
+func rolloutPods(model Model, version ModelVersion) ([]RolloutPod, error) {
+	routed := map[int]bool{version.Number: true}
+	policy, ok, err := GetTrafficPolicy(model.UUID)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		for _, route := range policy.Routes {
+			if route.Weight > 0 {
+				routed[route.Version] = true
+			}
+		}
+		if policy.ShadowVersion != 0 {
+			routed[policy.ShadowVersion] = true
+		}
+	}
+
+	bindings, err := GetAllBindings()
+	if err != nil {
+		return nil, err
+	}
+	pods := make([]RolloutPod, 0)
+	for _, binding := range bindings {
+		// draining pods are already taken out by a training or another rollout
+		if binding.ModelUUID == model.UUID && !routed[binding.Version] && !binding.Draining {
+			pods = append(pods, RolloutPod{PodID: binding.PodID, FromVersion: binding.Version, State: RolloutPending})
+		}
+	}
+	return pods, nil
+}
+
+// StartRollout moves the pods bound to older versions of the model to the version in the background
+func StartRollout(model Model, version ModelVersion, maxUnavailable int) (Rollout, error) {
+	if maxUnavailable <= 0 {
+		maxUnavailable = DefaultMaxUnavailable
+	}
+	client := db.GetRedisClient()
+	lockKey := rolloutLockPrefix + model.UUID
+	locked, err := client.SetNX(ctx, lockKey, version.Number, rolloutTimeout).Result()
+	if err != nil {
+		return Rollout{}, err
+	}
+	if !locked {
+		return Rollout{}, ErrRolloutInProgress
+	}
+
+	pods, err := rolloutPods(model, version)
+	if err != nil {
+		client.Del(ctx, lockKey)
+		return Rollout{}, err
+	}
+	rollout := Rollout{
+		ModelUUID:      model.UUID,
+		Version:        version.Number,
+		MaxUnavailable: maxUnavailable,
+		State:          RolloutRunning,
+		Pods:           pods,
+		StartedAt:      time.Now(),
+	}
+	if len(pods) == 0 {
+		rollout.State = RolloutCompleted
+		finishedAt := rollout.StartedAt
+		rollout.FinishedAt = &finishedAt
+	}
+	if err := saveRollout(rollout); err != nil || len(pods) == 0 {
+		client.Del(ctx, lockKey)
+		return rollout, err
+	}
+
+	go func() {
+		defer client.Del(ctx, lockKey)
+		runRollout(rollout, version, GetRunPodAPIClient())
+	}()
+	return rollout, nil
+}
+
+// runRollout updates the pods of the rollout, at most MaxUnavailable of them are out of service at once
+func runRollout(rollout Rollout, version ModelVersion, runPodAPI PodProviderAPI) {
+	log.ZapLogger.Info("Start rollout", zap.String("modelUUID", rollout.ModelUUID), zap.Int("version", rollout.Version), zap.Int("pods", len(rollout.Pods)))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	budget := make(chan struct{}, rollout.MaxUnavailable)
+	setState := func(i int, state RolloutState, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		rollout.Pods[i].State = state
+		if err != nil {
+			rollout.Pods[i].Error = err.Error()
+		}
+		if err := saveRollout(rollout); err != nil {
+			log.ZapLogger.Error("Failed to save rollout", zap.String("modelUUID", rollout.ModelUUID), zap.Error(err))
+		}
+	}
+
+	for i := range rollout.Pods {
+		budget <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-budget }()
+			err := rolloutPod(rollout.Pods[i], version, runPodAPI, func(state RolloutState) { setState(i, state, nil) })
+			if err != nil {
+				log.ZapLogger.Error("Failed to roll pod", zap.String("podID", rollout.Pods[i].PodID), zap.Error(err))
+				setState(i, RolloutFailed, err)
+				return
+			}
+			setState(i, RolloutCompleted, nil)
+		}(i)
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	rollout.State = RolloutCompleted
+	for _, pod := range rollout.Pods {
+		if pod.State == RolloutFailed {
+			rollout.State = RolloutFailed
+		}
+	}
+	finishedAt := time.Now()
+	rollout.FinishedAt = &finishedAt
+	if err := saveRollout(rollout); err != nil {
+		log.ZapLogger.Error("Failed to save rollout", zap.String("modelUUID", rollout.ModelUUID), zap.Error(err))
+	}
+	log.ZapLogger.Info("Rollout finished", zap.String("modelUUID", rollout.ModelUUID), zap.String("state", string(rollout.State)))
+}
+
+// rolloutPod drains the pod, edits it to the version image, waits for its API and rebinds it to the version, pods
+// already running the image are rebound right away
+func rolloutPod(pod RolloutPod, version ModelVersion, runPodAPI PodProviderAPI, progress func(RolloutState)) error {
+	binding, exists := GetModelPodBinding(pod.PodID)
+	if !exists || binding.ModelUUID != version.ModelUUID || binding.Version != pod.FromVersion {
+		// the pod went cold or was taken meanwhile
+		return nil
+	}
+
+	// a version sharing the image of the pod, like a trained one, only needs the pod rebound, its tasks carry their
+	// weights in their input
+	if from, err := GetModelVersion(version.ModelUUID, pod.FromVersion); err == nil && from.Image() == version.Image() {
+		binding.Version = version.Number
+		_, err := bindModelToPodUnlessDraining(binding)
+		return err
+	}
+
+	// new tasks stop going to the pod, running ones finish on the old image
+	progress(RolloutDraining)
+	binding.Draining = true
+	if err := BindModelToPod(binding); err != nil {
+		return err
+	}
+	if err := drainPod(pod.PodID); err != nil {
+		binding.Draining = false
+		_ = BindModelToPod(binding)
+		return err
+	}
+
+	progress(RolloutUpdating)
+	image := version.Image()
+	if err := runPodAPI.EditPod(pod.PodID, image); err != nil {
+		// the pod may be half edited, it must not serve the old version anymore
+		_ = UnbindModelFromPod(pod.PodID)
+		return err
+	}
+	if err := touchPod(pod.PodID, image); err != nil {
+		return err
+	}
+	if err := runPodAPI.WaitForAPIReady(pod.PodID); err != nil {
+		_ = UnbindModelFromPod(pod.PodID)
+		return err
+	}
+	if err := touchPod(pod.PodID, image); err != nil {
+		return err
+	}
+	if model, ok := GetModel(version.ModelUUID); !ok || model.IsDeleted() {
+		// the model was deleted during the update
+		_ = UnbindModelFromPod(pod.PodID)
+		return releasePod(pod.PodID)
+	}
+	return BindModelToPod(ModelPodBinding{ModelUUID: version.ModelUUID, PodID: pod.PodID, Version: version.Number})
+}
+
+// rollOutVersion moves the pods of older versions to the latest version once it is known to boot
+func rollOutVersion(model Model, version ModelVersion) {
+	if version.Number == 0 {
+		return
+	}
+	rollout, err := StartRollout(model, version, DefaultMaxUnavailable)
+	if err != nil {
+		log.ZapLogger.Error("Failed to start rollout", zap.String("modelUUID", model.UUID), zap.Int("version", version.Number), zap.Error(err))
+		return
+	}
+	if len(rollout.Pods) > 0 {
+		log.ZapLogger.Info("Rollout started", zap.String("modelUUID", model.UUID), zap.Int("version", version.Number))
+	}
+}
+
+func startRolloutHandler(c *gin.Context) {
+	model, ok := getManagedModel(c)
+	if !ok {
+		return
+	}
+	var body struct {
+		MaxUnavailable int `json:"max_unavailable"`
+	}
+	// the body is optional
+	if err := c.ShouldBindJSON(&body); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if model.LatestVersion == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the model has no versions"})
+		return
+	}
+	version, err := GetModelVersion(model.UUID, model.LatestVersion)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	rollout, err := StartRollout(model, version, body.MaxUnavailable)
+	if errors.Is(err, ErrRolloutInProgress) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, rollout)
+}
+
+func getRolloutHandler(c *gin.Context) {
+	model, ok := getManagedModel(c)
+	if !ok {
+		return
+	}
+
+	rollout, ok, err := GetRollout(model.UUID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no rollout for this model"})
+		return
+	}
+
+	c.JSON(http.StatusOK, rollout)
+}
@@ -13,6 +13,13 @@ import (
 	"github.com/machinebox/graphql"
 )
 
+// Default hardware of the pods created by the hub, versions may pick another one. DefaultDeployCost is the hourly price in USD
+const (
+	DefaultGpuTypeId  = "NVIDIA RTX A4500"
+	DefaultGpuCount   = 1
+	DefaultDeployCost = 0.36
+)
+
 type RunPodClient struct {
 	graphqlClient *graphql.Client
 }
@@ -71,6 +78,11 @@ func (rpc *RunPodClient) ListPods() ([]Pod, error) {
 					id
 					desiredStatus
 					imageName
+					gpuCount
+					costPerHr
+					machine {
+						gpuTypeId
+					}
 				}
 			}
 		}
@@ -80,9 +92,14 @@ func (rpc *RunPodClient) ListPods() ([]Pod, error) {
 		Myself struct {
 			Id   string `json:"id"`
 			Pods []struct {
-				ID            string `json:"id"`
-				DesiredStatus string `json:"desiredStatus"`
-				Image         string `json:"imageName"`
+				ID            string  `json:"id"`
+				DesiredStatus string  `json:"desiredStatus"`
+				Image         string  `json:"imageName"`
+				GpuCount      int     `json:"gpuCount"`
+				CostPerHr     float64 `json:"costPerHr"`
+				Machine       struct {
+					GpuTypeId string `json:"gpuTypeId"`
+				} `json:"machine"`
 			} `json:"pods"`
 		} `json:"myself"`
 	}
@@ -94,21 +111,25 @@ func (rpc *RunPodClient) ListPods() ([]Pod, error) {
 	pods := make([]Pod, 0)
 	for _, podData := range respData.Myself.Pods {
 		pods = append(pods, Pod{
-			ID:      podData.ID,
-			IsPodUp: podData.DesiredStatus == "RUNNING",
-			Image:   podData.Image,
+			ID:        podData.ID,
+			IsPodUp:   podData.DesiredStatus == "RUNNING",
+			Image:     podData.Image,
+			Hardware:  HardwareProfile{GpuTypeId: podData.Machine.GpuTypeId, GpuCount: podData.GpuCount},
+			CostPerHr: podData.CostPerHr,
 		})
 	}
 
 	return pods, nil
 }
 
-func (rpc *RunPodClient) CreatePod(image string) (Pod, error) {
+func (rpc *RunPodClient) CreatePod(image string, hardware HardwareProfile) (Pod, error) {
+	hardware = hardware.withDefaults()
 	req := graphql.NewRequest(`
         mutation Mutation($input: PodFindAndDeployOnDemandInput) {
             podFindAndDeployOnDemand(input: $input) {
                 id
                 imageName
+                costPerHr
             }
         }
     `)
@@ -118,9 +139,9 @@ func (rpc *RunPodClient) CreatePod(image string) (Pod, error) {
 		"containerDiskInGb": 20,
 		"volumeInGb":        0,
 		"dataCenterId":      "EU-RO-1",
-		"deployCost":        0.36,
-		"gpuCount":          1,
-		"gpuTypeId":         "NVIDIA RTX A4500",
+		"deployCost":        DefaultDeployCost,
+		"gpuCount":          hardware.GpuCount,
+		"gpuTypeId":         hardware.GpuTypeId,
 		"minMemoryInGb":     50,
 		"minVcpuCount":      9,
 		// TODO make this to config
@@ -135,8 +156,9 @@ func (rpc *RunPodClient) CreatePod(image string) (Pod, error) {
 
 	var respData struct {
 		PodFindAndDeployOnDemand struct {
-			ID        string `json:"id"`
-			ImageName string `json:"imageName"`
+			ID        string  `json:"id"`
+			ImageName string  `json:"imageName"`
+			CostPerHr float64 `json:"costPerHr"`
 		} `json:"podFindAndDeployOnDemand"`
 	}
 
@@ -144,9 +166,12 @@ func (rpc *RunPodClient) CreatePod(image string) (Pod, error) {
 		return Pod{}, err
 	}
 
+	// the pod is recorded with its hardware so that its usage is metered at its price
 	return Pod{
-		ID:    respData.PodFindAndDeployOnDemand.ID,
-		Image: respData.PodFindAndDeployOnDemand.ImageName,
+		ID:        respData.PodFindAndDeployOnDemand.ID,
+		Image:     respData.PodFindAndDeployOnDemand.ImageName,
+		Hardware:  hardware,
+		CostPerHr: respData.PodFindAndDeployOnDemand.CostPerHr,
 	}, nil
 }
 
@@ -0,0 +1,344 @@
+package hub
+
+import (
+	"cotelligence-model-hub/db"
+	"cotelligence-model-hub/log"
+	"cotelligence-model-hub/openapi"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+type SpecStatus string
+
+const (
+	SpecPending SpecStatus = "pending"
+	SpecReady   SpecStatus = "ready"
+	SpecFailed  SpecStatus = "failed"
+)
+
+const specDiscoveryLockPrefix = "hub:specDiscovery:"
+
+// specDiscoveryTimeout bounds a discovery, booting a cold pod can take several minutes
+const specDiscoveryTimeout = 20 * time.Minute
+
+// setModelSpecStatus records the discovery status of the model spec, specError is the reason of a failure
+func setModelSpecStatus(modelUUID string, status SpecStatus, specError string) error {
+	client := db.GetRedisClient()
+	return client.HSet(ctx, ModelPrefix+":"+modelUUID,
+		"spec_status", string(status),
+		"spec_error", specError).Err()
+}
+
+// isLatestVersion reports whether the version is still the latest one of the model
+func isLatestVersion(modelUUID string, version ModelVersion) bool {
+	model, ok := GetModel(modelUUID)
+	return ok && model.LatestVersion == version.Number
+}
+
+// setVersionSpecStatus records the discovery status of the version spec, the model shows the status of its latest version
+func setVersionSpecStatus(version ModelVersion, status SpecStatus, specError string) error {
+	if version.Number > 0 {
+		client := db.GetRedisClient()
+		err := client.HSet(ctx, versionKey(version.ModelUUID, version.Number),
+			"spec_status", string(status),
+			"spec_error", specError).Err()
+		if err != nil {
+			return err
+		}
+	}
+	if !isLatestVersion(version.ModelUUID, version) {
+		return nil
+	}
+	return setModelSpecStatus(version.ModelUUID, status, specError)
+}
+
+// useVersionSpec makes the stored spec of the version the current spec of the model when it is the latest version,
+// the pods of older versions are then rolled to it
+func useVersionSpec(model Model, version ModelVersion) error {
+	// a spec breaking the contract of the model type is kept but never used
+	if err := checkModelContract(model.Type, model.UUID, version.Image()); err != nil {
+		log.ZapLogger.Error("Model spec does not match its type", zap.String("modelUUID", model.UUID), zap.Int("version", version.Number), zap.Error(err))
+		_ = setVersionSpecStatus(version, SpecFailed, err.Error())
+		restorePreviousVersion(model, version)
+		return err
+	}
+	latest := isLatestVersion(model.UUID, version)
+	if latest {
+		if _, err := openapi.UseSpec(model.UUID, version.Image()); err != nil {
+			return err
+		}
+	}
+	if err := setVersionSpecStatus(version, SpecReady, ""); err != nil {
+		return err
+	}
+	if latest {
+		rollOutVersion(model, version)
+	}
+	return nil
+}
+
+// restorePreviousVersion makes the newest older version with a ready spec the latest one again when the version
+// breaking the contract of the model type is the latest, so the model keeps serving the image it served before
+func restorePreviousVersion(model Model, broken ModelVersion) {
+	if !isLatestVersion(model.UUID, broken) {
+		return
+	}
+	versions, err := GetModelVersions(model.UUID)
+	if err != nil {
+		log.ZapLogger.Error("Failed to list model versions", zap.String("modelUUID", model.UUID), zap.Error(err))
+		return
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		previous := versions[i]
+		if previous.Number >= broken.Number || previous.SpecStatus != SpecReady {
+			continue
+		}
+		log.ZapLogger.Info("Restore the previous model version", zap.String("modelUUID", model.UUID),
+			zap.Int("brokenVersion", broken.Number), zap.Int("version", previous.Number))
+		if err := makeLatestVersion(model, previous, false); err != nil {
+			log.ZapLogger.Error("Failed to restore the previous model version", zap.String("modelUUID", model.UUID), zap.Error(err))
+		}
+		return
+	}
+}
+
+// fetchPodSpec downloads the OpenAPI spec cog serves on the pod
+func fetchPodSpec(podID string) ([]byte, error) {
+	resp, err := proxyClient.Get(podAPIBaseURL(podID) + "/openapi.json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("pod %s answered %d to /openapi.json", podID, resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// ErrSpecDiscoveryRunning is returned when the spec of the version is already being discovered
+var ErrSpecDiscoveryRunning = errors.New("the spec of the version is already being discovered")
+
+// releaseSpecDiscoveryScript deletes the lock only when it still holds the token of the discovery releasing it, a
+// discovery that outlived its lock must not release the lock of the next one
+var releaseSpecDiscoveryScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// lockSpecDiscovery makes sure only one discovery of the version runs at a time, the returned func releases it
+func lockSpecDiscovery(modelUUID string, version ModelVersion) (func(), error) {
+	client := db.GetRedisClient()
+	lockKey := fmt.Sprintf("%s%s:%d", specDiscoveryLockPrefix, modelUUID, version.Number)
+	token := uuid.New().String()
+	locked, err := client.SetNX(ctx, lockKey, token, specDiscoveryTimeout).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, ErrSpecDiscoveryRunning
+	}
+	return func() {
+		if err := releaseSpecDiscoveryScript.Run(ctx, client, []string{lockKey}, token).Err(); err != nil {
+			log.ZapLogger.Error("Failed to release the spec discovery lock", zap.String("modelUUID", modelUUID), zap.Int("version", version.Number), zap.Error(err))
+		}
+	}, nil
+}
+
+// warmImagePod returns a pod in use that runs the image, its spec can be fetched without deploying anything
+func warmImagePod(image string) (string, bool) {
+	pods, err := GetAllPods()
+	if err != nil {
+		return "", false
+	}
+	for _, pod := range pods {
+		if pod.Image == image && pod.IsOccupied() {
+			return pod.ID, true
+		}
+	}
+	return "", false
+}
+
+// fetchVersionSpec stores the spec cog serves on a pod running the version and makes it the spec of the version
+func fetchVersionSpec(model Model, version ModelVersion, podID string) error {
+	data, err := fetchPodSpec(podID)
+	if err == nil {
+		err = openapi.SaveSpec(model.UUID, version.Image(), data)
+	}
+	if err != nil {
+		log.ZapLogger.Error("Failed to discover model spec", zap.String("modelUUID", model.UUID), zap.Int("version", version.Number), zap.Error(err))
+		_ = setVersionSpecStatus(version, SpecFailed, err.Error())
+		return err
+	}
+	log.ZapLogger.Info("Model spec discovered", zap.String("modelUUID", model.UUID), zap.Int("version", version.Number), zap.String("podID", podID))
+	return useVersionSpec(model, version)
+}
+
+// discoverVersionSpec fetches the spec of the version from a warm pod running its image, or else from a pod deployed
+// for it. The discovery lock must be held
+func discoverVersionSpec(model Model, version ModelVersion) error {
+	if err := setVersionSpecStatus(version, SpecPending, ""); err != nil {
+		return err
+	}
+	log.ZapLogger.Info("Discover model spec", zap.String("modelUUID", model.UUID), zap.Int("version", version.Number), zap.String("image", version.Image()))
+	podID, warm := warmImagePod(version.Image())
+	if !warm {
+		pod, err := DeployModelToPod(model.UUID, version.Number, "", GetRunPodAPIClient())
+		if err != nil {
+			log.ZapLogger.Error("Failed to deploy model to discover its spec", zap.String("modelUUID", model.UUID), zap.Int("version", version.Number), zap.Error(err))
+			_ = setVersionSpecStatus(version, SpecFailed, err.Error())
+			return err
+		}
+		podID = pod.ID
+	}
+	return fetchVersionSpec(model, version, podID)
+}
+
+// DiscoverModelSpec stores the cog OpenAPI spec of the model version image, booting a pod or reusing a warm one to
+// fetch it. A spec already stored for the image is reused unless force is set
+func DiscoverModelSpec(model Model, version ModelVersion, force bool) error {
+	if !force {
+		stored, err := openapi.HasSpec(model.UUID, version.Image())
+		if err != nil {
+			return err
+		}
+		if stored {
+			return useVersionSpec(model, version)
+		}
+	}
+
+	unlock, err := lockSpecDiscovery(model.UUID, version)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return discoverVersionSpec(model, version)
+}
+
+// discoverSpecOnPod fetches the spec of a version that is still unknown, like one whose discovery failed, from the
+// pod its task was sent to
+func discoverSpecOnPod(modelUUID string, versionNumber int, podID string) {
+	model, ok := GetModel(modelUUID)
+	if !ok {
+		return
+	}
+	version, err := modelVersion(model, versionNumber)
+	if err != nil || version.SpecStatus == SpecReady {
+		return
+	}
+	// a spec breaking the contract of the model type is known already
+	if stored, err := openapi.HasSpec(modelUUID, version.Image()); err != nil || stored {
+		return
+	}
+	unlock, err := lockSpecDiscovery(modelUUID, version)
+	if err != nil {
+		return
+	}
+	defer unlock()
+	_ = fetchVersionSpec(model, version, podID)
+}
+
+// discoverModelSpecAsync runs the discovery in the background, the outcome is recorded on the version and the model
+func discoverModelSpecAsync(model Model, version ModelVersion, force bool) {
+	go func() {
+		_ = DiscoverModelSpec(model, version, force)
+	}()
+}
+
+// refreshModelSpecHandler discovers the spec of the latest version again, or of the version given as ?version=
+func refreshModelSpecHandler(c *gin.Context) {
+	model, ok := getManagedModel(c)
+	if !ok {
+		return
+	}
+	version, err := ResolveModelVersion(model, c.Query("version"))
+	var invalidRequestError *InvalidRequestError
+	if errors.As(err, &invalidRequestError) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, ErrModelVersionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// the discovery runs in the background, a discovery already running is reported instead of being ignored
+	unlock, err := lockSpecDiscovery(model.UUID, version)
+	if errors.Is(err, ErrSpecDiscoveryRunning) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	go func() {
+		defer unlock()
+		_ = discoverVersionSpec(model, version)
+	}()
+	c.JSON(http.StatusAccepted, gin.H{"status": SpecPending, "version": version.Number})
+}
+
+func documentedModel(model Model) openapi.DocumentedModel {
+	return openapi.DocumentedModel{UUID: model.UUID, Name: model.FullName(), ImageVersion: model.Image()}
+}
+
+func modelOpenAPIHandler(c *gin.Context) {
+	model, ok := getVisibleModel(c)
+	if !ok {
+		return
+	}
+
+	doc, err := openapi.ModelDocument(documentedModel(model), requestBaseURL(c))
+	if errors.Is(err, openapi.ErrSpecNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error(), "spec_status": model.SpecStatus, "spec_error": model.SpecError})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, doc)
+}
+
+// hubOpenAPIHandler describes every hub route and the models the caller can see
+func hubOpenAPIHandler(c *gin.Context) {
+	models, err := GetAllModels()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	sort.Slice(models, func(i, j int) bool {
+		return models[i].FullName() < models[j].FullName()
+	})
+	apiKey := currentAPIKey(c)
+	documented := make([]openapi.DocumentedModel, 0, len(models))
+	for _, model := range models {
+		if apiKey.CanSeeModel(model) && !model.IsDeleted() {
+			documented = append(documented, documentedModel(model))
+		}
+	}
+
+	doc, err := openapi.HubDocument(documented, requestBaseURL(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, doc)
+}
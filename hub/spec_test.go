@@ -0,0 +1,45 @@
+package hub
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestLockSpecDiscovery(t *testing.T) {
+	version := ModelVersion{ModelUUID: uuid.NewString(), Number: 1}
+	unlock, err := lockSpecDiscovery(version.ModelUUID, version)
+	if err != nil {
+		t.Fatalf("lockSpecDiscovery() = %v", err)
+	}
+	if _, err := lockSpecDiscovery(version.ModelUUID, version); !errors.Is(err, ErrSpecDiscoveryRunning) {
+		t.Fatalf("lockSpecDiscovery() while locked = %v, want ErrSpecDiscoveryRunning", err)
+	}
+	unlock()
+	unlock, err = lockSpecDiscovery(version.ModelUUID, version)
+	if err != nil {
+		t.Fatalf("lockSpecDiscovery() after unlock = %v", err)
+	}
+	unlock()
+}
+
+func TestLockSpecDiscoveryOutlivedLock(t *testing.T) {
+	version := ModelVersion{ModelUUID: uuid.NewString(), Number: 1}
+	unlockExpired, err := lockSpecDiscovery(version.ModelUUID, version)
+	if err != nil {
+		t.Fatalf("lockSpecDiscovery() = %v", err)
+	}
+	testRedis.FastForward(specDiscoveryTimeout)
+	unlockNext, err := lockSpecDiscovery(version.ModelUUID, version)
+	if err != nil {
+		t.Fatalf("lockSpecDiscovery() after the timeout = %v", err)
+	}
+	defer unlockNext()
+
+	// the discovery that outlived its lock leaves the lock of the next one alone
+	unlockExpired()
+	if _, err := lockSpecDiscovery(version.ModelUUID, version); !errors.Is(err, ErrSpecDiscoveryRunning) {
+		t.Errorf("lockSpecDiscovery() = %v, want the next discovery to still hold the lock", err)
+	}
+}
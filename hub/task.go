@@ -1,12 +1,20 @@
 package hub
 
 import (
+	"context"
 	"cotelligence-model-hub/db"
+	"cotelligence-model-hub/log"
+	"cotelligence-model-hub/openapi"
 	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/getkin/kin-openapi/openapi3"
 	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
+	"go.uber.org/zap"
 )
 
 type Task struct {
@@ -14,6 +22,35 @@ type Task struct {
 	ModelId  string                 `json:"model_id"`
 	Response map[string]interface{} `json:"response"`
 	Body     map[string]interface{} `json:"body"`
+	// Input is the effective input sent to the model, with defaults and in the x-order of its schema
+	Input     json.RawMessage        `json:"input,omitempty"`
+	Status    TaskStatus             `json:"status,omitempty"`
+	Logs      string                 `json:"logs,omitempty"`
+	Metrics   map[string]interface{} `json:"metrics,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+	PodId     string                 `json:"pod_id,omitempty"`
+	APIKeyId  string                 `json:"api_key_id,omitempty"`
+	CreatedAt time.Time              `json:"created_at"`
+	// DequeuedAt is when a worker picked the task, PodReadyAt when its pod was ready to predict
+	DequeuedAt *time.Time `json:"dequeued_at,omitempty"`
+	PodReadyAt *time.Time `json:"pod_ready_at,omitempty"`
+	Usage      *TaskUsage `json:"usage,omitempty"`
+	// the model prices at submission, CreditsReserved is held until the task is settled for CreditsCharged
+	PricePerSecond  int64 `json:"price_per_second,omitempty"`
+	PricePerOutput  int64 `json:"price_per_output,omitempty"`
+	CreditsReserved int64 `json:"credits_reserved,omitempty"`
+	CreditsCharged  int64 `json:"credits_charged,omitempty"`
+	// Webhook is the caller url notified on WebhookEventsFilter events
+	Webhook             string         `json:"webhook,omitempty"`
+	WebhookEventsFilter []WebhookEvent `json:"webhook_events_filter,omitempty"`
+	// Version is the model version the task was pinned to at submission, 0 for models without versions
+	Version int `json:"version,omitempty"`
+	// ShadowOf is the task a shadow task copies, shadow tasks only feed the stats of their version
+	ShadowOf string `json:"shadow_of,omitempty"`
+	// NormalizeOutput adds the output in the shape of the model type to the response, next to the raw output
+	NormalizeOutput bool `json:"normalize_output,omitempty"`
+	// webhookToken authenticates the cog webhooks of the task
+	webhookToken string
 }
 
 func GenerateTaskID() string {
@@ -23,6 +60,166 @@ func GenerateTaskID() string {
 const taskQueuePrefix = "hub:taskQueue:"
 const taskPrefix = "hub:task:"
 
+var ErrTaskNotFound = errors.New("task not found")
+var ErrTaskCompleted = errors.New("task already completed")
+var ErrModelNotAllowed = errors.New("api key is not allowed to use this model")
+var ErrModelNotFound = errors.New("model not found")
+
+// InvalidRequestError is returned when the caller request can not be accepted
+type InvalidRequestError struct {
+	Message string
+}
+
+func (e *InvalidRequestError) Error() string {
+	return e.Message
+}
+
+// InputValidationError is returned when the prediction input does not match the model Input schema
+type InputValidationError struct {
+	Violations []openapi.InputViolation
+}
+
+func (e *InputValidationError) Error() string {
+	messages := make([]string, 0, len(e.Violations))
+	for _, violation := range e.Violations {
+		messages = append(messages, violation.Field+": "+violation.Message)
+	}
+	return "invalid input: " + strings.Join(messages, "; ")
+}
+
+// predictionTarget is the model version a prediction runs on with its Input schema, nil for models without a spec
+type predictionTarget struct {
+	model   Model
+	version ModelVersion
+	schema  *openapi3.Schema
+}
+
+// resolvePrediction checks the api key may run the model and pins the requested version, the spec of the version
+// is loaded once for everything the request builds and validates
+func resolvePrediction(apiKey APIKey, modelUUID string, requestedVersion interface{}) (predictionTarget, error) {
+	if !apiKey.CanUseModel(modelUUID) {
+		return predictionTarget{}, ErrModelNotAllowed
+	}
+	model, ok := GetModel(modelUUID)
+	if !ok || !apiKey.CanSeeModel(model) {
+		return predictionTarget{}, ErrModelNotFound
+	}
+	if model.IsDeleted() {
+		return predictionTarget{}, ErrModelDeleted
+	}
+	// Pin the task to a version so a new image published meanwhile does not change its behavior
+	version, err := ResolveModelVersion(model, requestedVersion)
+	if err != nil {
+		return predictionTarget{}, err
+	}
+	if err := checkServableVersion(model, version); err != nil {
+		return predictionTarget{}, err
+	}
+	schema, err := openapi.LookupInputSchema(modelUUID, version.specImage())
+	if err != nil {
+		return predictionTarget{}, err
+	}
+	return predictionTarget{model: model, version: version, schema: schema}, nil
+}
+
+// SubmitPrediction records a prediction task for the model on behalf of the api key and returns its id
+func SubmitPrediction(apiKey APIKey, modelUUID string, predictionParams map[string]interface{}) (string, error) {
+	target, err := resolvePrediction(apiKey, modelUUID, predictionParams["version"])
+	if err != nil {
+		return "", err
+	}
+	delete(predictionParams, "version")
+	return submitPredictionTo(apiKey, target, predictionParams)
+}
+
+// submitPredictionTo records a prediction task on the resolved target and returns its id
+func submitPredictionTo(apiKey APIKey, target predictionTarget, predictionParams map[string]interface{}) (string, error) {
+	model, version, modelUUID := target.model, target.version, target.model.UUID
+	taskId := GenerateTaskID()
+	// Take the caller webhook out of the body, it must not be forwarded to the model
+	webhook, webhookEventsFilter, err := parseWebhookParams(predictionParams)
+	if err != nil {
+		return "", &InvalidRequestError{Message: err.Error()}
+	}
+	// Fill in the defaults so the task can be reproduced, then reject invalid inputs before they cost a cold start
+	dropUnknown, _ := predictionParams["drop_unknown_inputs"].(bool)
+	delete(predictionParams, "drop_unknown_inputs")
+	normalizeOutput, _ := predictionParams["normalize_output"].(bool)
+	delete(predictionParams, "normalize_output")
+	if normalizeOutput {
+		if _, ok := model.Type.Contract(); !ok {
+			return "", &InvalidRequestError{Message: "normalize_output needs a model with a type"}
+		}
+	}
+	input, _ := predictionParams["input"].(map[string]interface{})
+	effectiveInput := openapi.NormalizeInput(target.schema, version.withWeights(input), dropUnknown)
+	predictionParams["input"] = effectiveInput.Map()
+	if violations := openapi.ValidateInput(target.schema, effectiveInput.Map()); len(violations) > 0 {
+		return "", &InputValidationError{Violations: violations}
+	}
+	serializedInput, err := json.Marshal(effectiveInput)
+	if err != nil {
+		return "", err
+	}
+	if err := CheckRateLimits(apiKey, model); err != nil {
+		return "", err
+	}
+	// a prediction refused by the concurrency or credit checks is not counted against the rate limits
+	if err := AcquireTaskSlot(apiKey, model, taskId); err != nil {
+		_ = returnRateLimitTokens(apiKey, model)
+		return "", err
+	}
+	reserved, err := ReserveTaskCredits(apiKey, model, taskId, predictionParams)
+	if err != nil {
+		_ = ReleaseTaskSlot(apiKey.ID, modelUUID, taskId)
+		_ = returnRateLimitTokens(apiKey, model)
+		return "", err
+	}
+	// the backlog of the model is read before its task joins the queue, only an idle model is shadowed
+	shadow, shadowed := shadowVersion(model, version)
+	var backlog int64
+	if shadowed {
+		if backlog, err = GetTaskCntByModel(modelUUID); err != nil {
+			shadowed = false
+		}
+	}
+	stream, _ := predictionParams["stream"].(bool)
+	if stream {
+		// Register the stream before the task is queued so no early chunk is missed
+		storeTaskData(taskId, EventData{ID: taskId, Status: Starting})
+	}
+	err = RecordTask(Task{
+		ID:                  taskId,
+		ModelId:             modelUUID,
+		APIKeyId:            apiKey.ID,
+		Body:                predictionParams,
+		Input:               serializedInput,
+		Webhook:             webhook,
+		WebhookEventsFilter: webhookEventsFilter,
+		PricePerSecond:      model.PricePerSecond,
+		PricePerOutput:      model.PricePerOutput,
+		CreditsReserved:     reserved,
+		Version:             version.Number,
+		NormalizeOutput:     normalizeOutput,
+	})
+	if err != nil {
+		taskDataBuffer.Delete(taskId)
+		_ = ReleaseTaskSlot(apiKey.ID, modelUUID, taskId)
+		_ = refundCredits(apiKey.ID, modelUUID, taskId, reserved, "task could not be queued")
+		return "", err
+	}
+	// a deletion between the check above and the task being queued has failed the queue without this task
+	if current, ok := GetModel(modelUUID); !ok || current.IsDeleted() {
+		db.GetRedisClient().LRem(ctx, taskQueuePrefix+modelUUID, 1, taskId)
+		failTask(taskId, ErrModelDeleted)
+		return "", ErrModelDeleted
+	}
+	if shadowed {
+		submitShadowTask(model, shadow, backlog, taskId, input, predictionParams)
+	}
+	return taskId, nil
+}
+
 func RecordTask(task Task) error {
 	client := db.GetRedisClient()
 
@@ -32,9 +229,35 @@ func RecordTask(task Task) error {
 		return err
 	}
 
+	// Serialize the webhook events filter
+	webhookEventsFilter, err := json.Marshal(task.WebhookEventsFilter)
+	if err != nil {
+		return err
+	}
+
 	// Record the task with its details
 	taskKey := taskPrefix + task.ID
-	_, err = client.HSet(ctx, taskKey, "ModelId", task.ModelId, "Body", body).Result()
+	if task.CreatedAt.IsZero() {
+		task.CreatedAt = time.Now()
+	}
+	if task.webhookToken == "" {
+		task.webhookToken = uuid.New().String()
+	}
+	_, err = client.HSet(ctx, taskKey,
+		"ModelId", task.ModelId,
+		"Body", body,
+		"Input", string(task.Input),
+		"CreatedAt", task.CreatedAt.Format(time.RFC3339Nano),
+		"APIKeyId", task.APIKeyId,
+		"Webhook", task.Webhook,
+		"WebhookEventsFilter", webhookEventsFilter,
+		"PricePerSecond", task.PricePerSecond,
+		"PricePerOutput", task.PricePerOutput,
+		"CreditsReserved", task.CreditsReserved,
+		"Version", task.Version,
+		"ShadowOf", task.ShadowOf,
+		"NormalizeOutput", task.NormalizeOutput,
+		"WebhookToken", task.webhookToken).Result()
 	if err != nil {
 		return err
 	}
@@ -63,6 +286,13 @@ func processTask(taskID string) {
 		// the task may already have been processed/expired
 		return
 	}
+	if TaskStatus(taskDetails["Status"]) == Canceled {
+		return
+	}
+	_, err = client.HSet(ctx, taskKey, "DequeuedAt", time.Now().Format(time.RFC3339Nano)).Result()
+	if err != nil {
+		log.ZapLogger.Error("Failed to record task dequeue time", zap.String("taskId", taskID), zap.Error(err))
+	}
 
 	// Deserialize the Body
 	var body map[string]interface{}
@@ -72,14 +302,25 @@ func processTask(taskID string) {
 		return
 	}
 
+	// the task may have been canceled between its dequeue and now
+	if taskCompleted(taskID) {
+		return
+	}
+	NotifyTask(taskID, WebhookEventStart)
+
 	// Proxy the request to the pod
 	modelId := taskDetails["ModelId"]
-	response, err := ProxyRequestToPod(modelId, taskID, body)
+	response, err := ProxyRequestToPod(modelId, atoi(taskDetails["Version"]), taskID, taskDetails["WebhookToken"], body)
+	if errors.Is(err, ErrTaskCompleted) {
+		return
+	}
 	if err != nil {
-		// Log the error and continue
+		log.ZapLogger.Error("Failed to proxy task to pod", zap.String("taskId", taskID), zap.Error(err))
+		failTask(taskID, err)
 		return
 	}
 
+	addNormalizedOutput(taskID, response)
 	// Serialize the response
 	serializedResponse, err := json.Marshal(response)
 	if err != nil {
@@ -87,46 +328,297 @@ func processTask(taskID string) {
 		return
 	}
 
-	// Update the task with the serialized response
-	_, err = client.HSet(ctx, taskKey, "Response", string(serializedResponse)).Result()
+	// Record status, logs and metrics of a completed response, async ones are recorded by the webhook
+	var eventData EventData
+	if err := json.Unmarshal(serializedResponse, &eventData); err == nil && eventData.Status.IsTerminal() {
+		err = recordTaskState(taskID, eventData)
+		if errors.Is(err, ErrTaskCompleted) {
+			// the task was canceled while it ran, its result is dropped
+			return
+		}
+		if err != nil {
+			log.ZapLogger.Error("Failed to record task state", zap.String("taskId", taskID), zap.Error(err))
+		}
+	}
+
+	// Update the task with the serialized response, unless a webhook already completed it
+	_, err = client.HSetNX(ctx, taskKey, "Response", string(serializedResponse)).Result()
 	if err != nil {
 		// Log the error and continue
 		return
 	}
+	if eventData.Status.IsTerminal() {
+		NotifyTask(taskID, WebhookEventCompleted)
+	}
 }
 
-func ProcessTasks() {
+// setTaskStateScript sets the status, logs, metrics and error of a task unless it already reached a terminal status.
+// It returns 1 when they were set and 0 when the task was already completed
+var setTaskStateScript = redis.NewScript(`
+local status = redis.call('HGET', KEYS[1], 'Status')
+if status == 'succeeded' or status == 'failed' or status == 'canceled' then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'Status', ARGV[1], 'Logs', ARGV[2], 'Metrics', ARGV[3], 'Error', ARGV[4])
+return 1
+`)
+
+// recordTaskState persists the status, logs, metrics and error of a cog prediction onto the task, events arriving
+// after the task completed, like the result of a prediction canceled before it reached its pod, are refused with
+// ErrTaskCompleted
+func recordTaskState(taskID string, eventData EventData) error {
 	client := db.GetRedisClient()
+	metrics, err := json.Marshal(eventData.Metrics)
+	if err != nil {
+		return err
+	}
+	taskKey := taskPrefix + taskID
+	recorded, err := setTaskStateScript.Run(ctx, client, []string{taskKey},
+		string(eventData.Status), eventData.Logs, string(metrics), eventData.ErrorMessage()).Int()
+	if err != nil {
+		return err
+	}
+	if recorded == 0 {
+		return ErrTaskCompleted
+	}
+	if !eventData.Status.IsTerminal() {
+		return nil
+	}
 
-	// Fetch all models
-	models, err := GetAllModels()
+	// Free the concurrency slot of the finished task
+	owner, err := client.HMGet(ctx, taskKey, "APIKeyId", "ModelId", "PodId").Result()
+	if err != nil {
+		return err
+	}
+	apiKeyId, _ := owner[0].(string)
+	modelId, _ := owner[1].(string)
+	podId, _ := owner[2].(string)
+	if err := ReleaseTaskSlot(apiKeyId, modelId, taskID); err != nil {
+		return err
+	}
+	if err := untrackPodTask(podId, taskID); err != nil {
+		return err
+	}
+	if err := RecordTaskUsage(taskID); err != nil {
+		return err
+	}
+	if err := RecordVersionStats(taskID); err != nil {
+		return err
+	}
+	return SettleTaskCredits(taskID, eventData.Output)
+}
+
+// RecordTaskEvent persists a cog webhook event onto the task, the payload becomes the response once the task is done.
+// It returns ErrTaskCompleted for the events of a completed task, they are ignored
+func RecordTaskEvent(taskID string, eventData EventData, payload map[string]interface{}) error {
+	if err := recordTaskState(taskID, eventData); err != nil {
+		return err
+	}
+	if !eventData.Status.IsTerminal() {
+		if eventData.Output != nil {
+			NotifyTask(taskID, WebhookEventOutput)
+		} else if eventData.Logs != "" {
+			NotifyTask(taskID, WebhookEventLogs)
+		}
+		return nil
+	}
+	payload["id"] = taskID
+	if _, ok := normalizedOutputModel(taskID, payload); ok {
+		// normalizing downloads the image outputs, the response is written once the cog webhook is answered
+		go func() {
+			if err := writeTaskResponse(taskID, payload); err != nil {
+				log.ZapLogger.Error("Failed to write task response", zap.String("taskId", taskID), zap.Error(err))
+			}
+		}()
+		return nil
+	}
+	return writeTaskResponse(taskID, payload)
+}
+
+// writeTaskResponse records the response of a completed task with its normalized output and notifies its webhook
+func writeTaskResponse(taskID string, payload map[string]interface{}) error {
+	client := db.GetRedisClient()
+	addNormalizedOutput(taskID, payload)
+	serializedResponse, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	err = client.HSet(ctx, taskPrefix+taskID, "Response", string(serializedResponse)).Err()
+	if err != nil {
+		return err
+	}
+	NotifyTask(taskID, WebhookEventCompleted)
+	return nil
+}
+
+// SetTaskPod records the pod the task is sent to
+func SetTaskPod(taskID, podID string) error {
+	client := db.GetRedisClient()
+	err := client.HSet(ctx, taskPrefix+taskID,
+		"PodId", podID,
+		"PodReadyAt", time.Now().Format(time.RFC3339Nano)).Err()
+	if err != nil {
+		return err
+	}
+	return trackPodTask(podID, taskID)
+}
+
+// CancelTask removes a queued task from its queue or asks the pod running it to cancel the prediction
+func CancelTask(taskID string) error {
+	task, err := GetTask(taskID)
+	if err != nil || task.ModelId == "" {
+		return ErrTaskNotFound
+	}
+	if task.Status.IsTerminal() {
+		return ErrTaskCompleted
+	}
+
+	client := db.GetRedisClient()
+	removed, err := client.LRem(ctx, taskQueuePrefix+task.ModelId, 1, taskID).Result()
 	if err != nil {
-		// Log the error and return
+		return err
+	}
+	if removed == 0 && task.PodId != "" {
+		// cog reports the cancellation through the webhook or the sync response
+		return CancelPrediction(task.PodId, taskID)
+	}
+
+	// the task has not reached a pod yet, processTask checks for the cancellation before sending it to one
+	eventData := EventData{ID: taskID, Status: Canceled}
+	if err := RecordTaskEvent(taskID, eventData, map[string]interface{}{"status": Canceled}); err != nil {
+		return err
+	}
+	storeTaskData(taskID, eventData)
+	return nil
+}
+
+// taskCompleted reports whether the task already reached a terminal status
+func taskCompleted(taskID string) bool {
+	client := db.GetRedisClient()
+	status, _ := client.HGet(ctx, taskPrefix+taskID, "Status").Result()
+	return TaskStatus(status).IsTerminal()
+}
+
+// failTask marks the task as failed so that waiting callers and streams are released
+func failTask(taskID string, cause error) {
+	eventData := EventData{ID: taskID, Status: Failed, Error: cause.Error()}
+	err := RecordTaskEvent(taskID, eventData, map[string]interface{}{
+		"status": Failed,
+		"error":  cause.Error(),
+	})
+	if errors.Is(err, ErrTaskCompleted) {
 		return
 	}
+	if err != nil {
+		log.ZapLogger.Error("Failed to mark task as failed", zap.String("taskId", taskID), zap.Error(err))
+	}
+	storeTaskData(taskID, eventData)
+}
 
-	// Spawn a goroutine for each model
-	for _, model := range models {
-		go func(modelId string) {
-			for {
-				// Fetch a task from the task queue for the model
-				result, err := client.BRPop(ctx, 0, taskQueuePrefix+modelId).Result()
-				if err != nil {
-					// Log the error and continue
-					continue
-				}
+// modelWorkers are the queue workers of this instance, by model uuid
+var modelWorkers = struct {
+	sync.Mutex
+	cancels map[string]context.CancelFunc
+}{cancels: make(map[string]context.CancelFunc)}
 
-				// The task ID is the second element in the result
-				taskID := result[1]
+// workerPollTimeout is how long a worker blocks on its queue before checking whether it was stopped
+const workerPollTimeout = 5 * time.Second
 
-				// Process the task
-				go processTask(taskID)
+// startModelWorker processes the task queue of the model until the worker is stopped
+func startModelWorker(modelUUID string) {
+	modelWorkers.Lock()
+	defer modelWorkers.Unlock()
+	if _, running := modelWorkers.cancels[modelUUID]; running {
+		return
+	}
+	workerCtx, cancel := context.WithCancel(ctx)
+	modelWorkers.cancels[modelUUID] = cancel
+
+	client := db.GetRedisClient()
+	go func() {
+		for {
+			// Fetch a task from the task queue for the model
+			result, err := client.BRPop(workerCtx, workerPollTimeout, taskQueuePrefix+modelUUID).Result()
+			if workerCtx.Err() != nil {
+				return
 			}
-		}(model.UUID)
+			if err != nil {
+				if !errors.Is(err, redis.Nil) {
+					log.ZapLogger.Error("Failed to pop task", zap.String("modelUUID", modelUUID), zap.Error(err))
+					time.Sleep(time.Second)
+				}
+				continue
+			}
+
+			// The task ID is the second element in the result
+			taskID := result[1]
+
+			// Process the task
+			go processTask(taskID)
+		}
+	}()
+}
+
+// stopModelWorker stops the queue worker of the model, the tasks it already popped still run
+func stopModelWorker(modelUUID string) {
+	modelWorkers.Lock()
+	defer modelWorkers.Unlock()
+	if cancel, running := modelWorkers.cancels[modelUUID]; running {
+		cancel()
+		delete(modelWorkers.cancels, modelUUID)
+	}
+}
+
+// SyncModelWorkers runs a worker for every model that is not deleted, models registered or deleted through another
+// instance are picked up here
+func SyncModelWorkers() error {
+	models, err := GetAllModels()
+	if err != nil {
+		return err
 	}
+	active := make(map[string]bool, len(models))
+	for _, model := range models {
+		if !model.IsDeleted() {
+			active[model.UUID] = true
+			startModelWorker(model.UUID)
+		}
+	}
+
+	modelWorkers.Lock()
+	var stale []string
+	for modelUUID := range modelWorkers.cancels {
+		if !active[modelUUID] {
+			stale = append(stale, modelUUID)
+		}
+	}
+	modelWorkers.Unlock()
+	for _, modelUUID := range stale {
+		stopModelWorker(modelUUID)
+	}
+	return nil
+}
+
+func ProcessTasks() {
+	if err := SyncModelWorkers(); err != nil {
+		log.ZapLogger.Error("Failed to start model workers", zap.Error(err))
+	}
+	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := SyncModelWorkers(); err != nil {
+				log.ZapLogger.Error("Failed to sync model workers", zap.Error(err))
+			}
+		}
+	}()
 }
 
 func waitForTaskCompletion(taskID string) (map[string]interface{}, error) {
+	return waitForTaskCompletionContext(context.Background(), taskID)
+}
+
+// waitForTaskCompletionContext waits for the task response until the context is done, returning its error then
+func waitForTaskCompletionContext(waitCtx context.Context, taskID string) (map[string]interface{}, error) {
 	client := db.GetRedisClient()
 
 	// Wait for the task to be processed
@@ -149,7 +641,11 @@ func waitForTaskCompletion(taskID string) (map[string]interface{}, error) {
 		}
 
 		// If the task does not have a response, wait for a short period before checking again
-		time.Sleep(200 * time.Millisecond)
+		select {
+		case <-waitCtx.Done():
+			return nil, waitCtx.Err()
+		case <-time.After(200 * time.Millisecond):
+		}
 	}
 }
 
@@ -170,6 +666,12 @@ func GetTask(taskID string) (Task, error) {
 		return Task{}, err
 	}
 
+	// The effective input is kept as recorded to preserve its order
+	var input json.RawMessage
+	if taskDetails["Input"] != "" {
+		input = json.RawMessage(taskDetails["Input"])
+	}
+
 	// Deserialize the Response
 	var response map[string]interface{}
 	if taskDetails["Response"] != "" {
@@ -179,12 +681,67 @@ func GetTask(taskID string) (Task, error) {
 		}
 	}
 
+	// Deserialize the Metrics
+	var metrics map[string]interface{}
+	if taskDetails["Metrics"] != "" {
+		err = json.Unmarshal([]byte(taskDetails["Metrics"]), &metrics)
+		if err != nil {
+			return Task{}, err
+		}
+	}
+
+	// Deserialize the WebhookEventsFilter
+	var webhookEventsFilter []WebhookEvent
+	if taskDetails["WebhookEventsFilter"] != "" {
+		err = json.Unmarshal([]byte(taskDetails["WebhookEventsFilter"]), &webhookEventsFilter)
+		if err != nil {
+			return Task{}, err
+		}
+	}
+
+	// Parse the CreatedAt time, tasks recorded before it was introduced have none
+	createdAt, _ := time.Parse(time.RFC3339Nano, taskDetails["CreatedAt"])
+
+	// Deserialize the Usage of finished tasks
+	var usage *TaskUsage
+	if taskDetails["Usage"] != "" {
+		usage = &TaskUsage{}
+		err = json.Unmarshal([]byte(taskDetails["Usage"]), usage)
+		if err != nil {
+			return Task{}, err
+		}
+	}
+
 	// Construct the Task object
 	task := Task{
-		ID:       taskID,
-		ModelId:  taskDetails["ModelId"],
-		Body:     body,
-		Response: response,
+		ID:        taskID,
+		ModelId:   taskDetails["ModelId"],
+		Body:      body,
+		Input:     input,
+		Response:  response,
+		Status:    TaskStatus(taskDetails["Status"]),
+		Logs:      taskDetails["Logs"],
+		Metrics:   metrics,
+		Error:     taskDetails["Error"],
+		PodId:     taskDetails["PodId"],
+		APIKeyId:  taskDetails["APIKeyId"],
+		CreatedAt: createdAt,
+
+		DequeuedAt: parseOptionalTime(time.RFC3339Nano, taskDetails["DequeuedAt"]),
+		PodReadyAt: parseOptionalTime(time.RFC3339Nano, taskDetails["PodReadyAt"]),
+		Usage:      usage,
+
+		PricePerSecond:  int64(atoi(taskDetails["PricePerSecond"])),
+		PricePerOutput:  int64(atoi(taskDetails["PricePerOutput"])),
+		CreditsReserved: int64(atoi(taskDetails["CreditsReserved"])),
+		CreditsCharged:  int64(atoi(taskDetails["CreditsCharged"])),
+
+		Webhook:             taskDetails["Webhook"],
+		WebhookEventsFilter: webhookEventsFilter,
+		Version:             atoi(taskDetails["Version"]),
+		ShadowOf:            taskDetails["ShadowOf"],
+		NormalizeOutput:     taskDetails["NormalizeOutput"] == "1",
+		webhookToken:        taskDetails["WebhookToken"],
 	}
 
 	return task, nil
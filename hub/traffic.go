@@ -0,0 +1,418 @@
+package hub
+
+import (
+	"cotelligence-model-hub/db"
+	"cotelligence-model-hub/log"
+	"cotelligence-model-hub/openapi"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+// TrafficRoute sends Weight percent of the predictions that do not ask for a version to Version
+type TrafficRoute struct {
+	Version int `json:"version"`
+	Weight  int `json:"weight"`
+}
+
+// TrafficPolicy splits the traffic of a model between its versions, models without one send everything to latest
+type TrafficPolicy struct {
+	// Routes weights are percentages summing to 100
+	Routes []TrafficRoute `json:"routes"`
+	// ShadowVersion also runs ShadowPercent of the predictions, its outputs are only kept for its stats
+	ShadowVersion int       `json:"shadow_version,omitempty"`
+	ShadowPercent float64   `json:"shadow_percent,omitempty"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// VersionStats are the outcomes of the tasks a model version ran, shadow tasks included
+type VersionStats struct {
+	Version     int   `json:"version"`
+	Tasks       int64 `json:"tasks"`
+	Succeeded   int64 `json:"succeeded"`
+	Failed      int64 `json:"failed"`
+	Canceled    int64 `json:"canceled"`
+	ShadowTasks int64 `json:"shadow_tasks"`
+	// ErrorRate is the share of failed tasks among the succeeded and failed ones
+	ErrorRate float64 `json:"error_rate"`
+	// latencies go from submission to completion of the succeeded tasks, percentiles over the latest ones
+	AvgLatencySeconds float64 `json:"avg_latency_seconds"`
+	P50LatencySeconds float64 `json:"p50_latency_seconds"`
+	P95LatencySeconds float64 `json:"p95_latency_seconds"`
+	AvgComputeSeconds float64 `json:"avg_compute_seconds"`
+}
+
+const TrafficPrefix = "cotelligence-model:traffic"
+const versionStatsPrefix = "hub:versionStats:"
+const versionLatencyPrefix = "hub:versionLatency:"
+
+// maxLatencySamples bounds the latencies kept per version for the percentiles
+const maxLatencySamples = 1000
+
+func trafficKey(modelUUID string) string {
+	return TrafficPrefix + ":" + modelUUID
+}
+
+// GetTrafficPolicy returns the traffic policy of the model, it reports whether the model has one
+func GetTrafficPolicy(modelUUID string) (TrafficPolicy, bool, error) {
+	client := db.GetRedisClient()
+	val, err := client.Get(ctx, trafficKey(modelUUID)).Result()
+	if errors.Is(err, redis.Nil) {
+		return TrafficPolicy{}, false, nil
+	}
+	if err != nil {
+		return TrafficPolicy{}, false, err
+	}
+	var policy TrafficPolicy
+	err = json.Unmarshal([]byte(val), &policy)
+	return policy, err == nil, err
+}
+
+// SetTrafficPolicy checks the routes and shadow of the policy against the versions of the model and stores it
+func SetTrafficPolicy(model Model, policy TrafficPolicy) (TrafficPolicy, error) {
+	if len(policy.Routes) == 0 {
+		return TrafficPolicy{}, &InvalidRequestError{Message: "routes are required"}
+	}
+	total := 0
+	seen := make(map[int]bool, len(policy.Routes))
+	for _, route := range policy.Routes {
+		if route.Weight < 0 {
+			return TrafficPolicy{}, &InvalidRequestError{Message: "route weights must not be negative"}
+		}
+		if seen[route.Version] {
+			return TrafficPolicy{}, &InvalidRequestError{Message: fmt.Sprintf("version %d is routed twice", route.Version)}
+		}
+		seen[route.Version] = true
+		if _, err := GetModelVersion(model.UUID, route.Version); err != nil {
+			return TrafficPolicy{}, versionPolicyError(route.Version, err)
+		}
+		total += route.Weight
+	}
+	if total != 100 {
+		return TrafficPolicy{}, &InvalidRequestError{Message: fmt.Sprintf("route weights must sum to 100, got %d", total)}
+	}
+	if policy.ShadowPercent < 0 || policy.ShadowPercent > 100 {
+		return TrafficPolicy{}, &InvalidRequestError{Message: "shadow_percent must be between 0 and 100"}
+	}
+	if policy.ShadowVersion != 0 {
+		if _, err := GetModelVersion(model.UUID, policy.ShadowVersion); err != nil {
+			return TrafficPolicy{}, versionPolicyError(policy.ShadowVersion, err)
+		}
+	} else {
+		policy.ShadowPercent = 0
+	}
+
+	policy.UpdatedAt = time.Now()
+	serialized, err := json.Marshal(policy)
+	if err != nil {
+		return TrafficPolicy{}, err
+	}
+	client := db.GetRedisClient()
+	return policy, client.Set(ctx, trafficKey(model.UUID), serialized, 0).Err()
+}
+
+func versionPolicyError(number int, err error) error {
+	if errors.Is(err, ErrModelVersionNotFound) {
+		return &InvalidRequestError{Message: fmt.Sprintf("version %d does not exist", number)}
+	}
+	return err
+}
+
+// ClearTrafficPolicy sends all the traffic of the model to its latest version again
+func ClearTrafficPolicy(modelUUID string) error {
+	client := db.GetRedisClient()
+	return client.Del(ctx, trafficKey(modelUUID)).Err()
+}
+
+// pickRoute draws a route by weight
+func pickRoute(routes []TrafficRoute) int {
+	n := rand.Intn(100)
+	for _, route := range routes {
+		if n < route.Weight {
+			return route.Version
+		}
+		n -= route.Weight
+	}
+	return routes[len(routes)-1].Version
+}
+
+// routeModelVersion picks the version of a prediction that does not ask for one
+func routeModelVersion(model Model) (ModelVersion, error) {
+	policy, ok, err := GetTrafficPolicy(model.UUID)
+	if err != nil {
+		return ModelVersion{}, err
+	}
+	if !ok {
+		return modelVersion(model, 0)
+	}
+	return modelVersion(model, pickRoute(policy.Routes))
+}
+
+// shadowVersion draws whether the prediction pinned to the version is shadowed, and to which version
+func shadowVersion(model Model, version ModelVersion) (ModelVersion, bool) {
+	policy, ok, err := GetTrafficPolicy(model.UUID)
+	if err != nil || !ok || policy.ShadowVersion == 0 || policy.ShadowVersion == version.Number {
+		return ModelVersion{}, false
+	}
+	if rand.Float64()*100 >= policy.ShadowPercent {
+		return ModelVersion{}, false
+	}
+	shadow, err := GetModelVersion(model.UUID, policy.ShadowVersion)
+	return shadow, err == nil
+}
+
+// submitShadowTask queues a copy of the prediction on the shadow version, its caller never sees it and it is not
+// charged. Inputs the shadow version rejects are not shadowed, nor are predictions of a saturated model: the shadow
+// copy takes a slot of the model concurrency limit and is dropped when the model is at it or had tasks queued before
+// the prediction, its backlog
+func submitShadowTask(model Model, shadow ModelVersion, backlog int64, taskId string, input map[string]interface{}, predictionParams map[string]interface{}) {
+	if backlog > 0 {
+		log.ZapLogger.Info("Prediction not shadowed, the model is saturated", zap.String("taskId", taskId), zap.Int64("queued", backlog))
+		return
+	}
+	schema, err := openapi.LookupInputSchema(model.UUID, shadow.specImage())
+	var effectiveInput openapi.OrderedInput
+	if err == nil {
+		effectiveInput = openapi.NormalizeInput(schema, shadow.withWeights(input), false)
+		if violations := openapi.ValidateInput(schema, effectiveInput.Map()); len(violations) > 0 {
+			err = &InputValidationError{Violations: violations}
+		}
+	}
+	var serializedInput []byte
+	if err == nil {
+		serializedInput, err = json.Marshal(effectiveInput)
+	}
+	if err != nil {
+		log.ZapLogger.Info("Prediction not shadowed", zap.String("taskId", taskId), zap.Int("version", shadow.Number), zap.Error(err))
+		return
+	}
+
+	// shadow tasks have no api key, only the limit of the model applies to them
+	shadowTaskId := GenerateTaskID()
+	if err := acquireModelSlot(model, shadowTaskId); err != nil {
+		log.ZapLogger.Info("Prediction not shadowed", zap.String("taskId", taskId), zap.Int("version", shadow.Number), zap.Error(err))
+		return
+	}
+
+	body := make(map[string]interface{}, len(predictionParams))
+	for key, value := range predictionParams {
+		body[key] = value
+	}
+	body["input"] = effectiveInput.Map()
+	delete(body, "stream")
+	err = RecordTask(Task{
+		ID:       shadowTaskId,
+		ModelId:  model.UUID,
+		Body:     body,
+		Input:    serializedInput,
+		Version:  shadow.Number,
+		ShadowOf: taskId,
+	})
+	if err != nil {
+		_ = ReleaseTaskSlot("", model.UUID, shadowTaskId)
+		log.ZapLogger.Error("Failed to queue shadow task", zap.String("taskId", taskId), zap.Error(err))
+	}
+}
+
+// RecordVersionStats adds a finished task to the stats of its model version once
+func RecordVersionStats(taskID string) error {
+	client := db.GetRedisClient()
+	taskKey := taskPrefix + taskID
+	first, err := client.HSetNX(ctx, taskKey, "StatsRecorded", "1").Result()
+	if err != nil || !first {
+		return err
+	}
+
+	task, err := GetTask(taskID)
+	if err != nil {
+		return err
+	}
+	suffix := task.ModelId + ":" + strconv.Itoa(task.Version)
+	key := versionStatsPrefix + suffix
+	pipeline := client.TxPipeline()
+	pipeline.HIncrBy(ctx, key, "tasks", 1)
+	if task.ShadowOf != "" {
+		pipeline.HIncrBy(ctx, key, "shadow_tasks", 1)
+	}
+	switch task.Status {
+	case Succeeded:
+		latency := time.Since(task.CreatedAt).Seconds()
+		pipeline.HIncrBy(ctx, key, "succeeded", 1)
+		pipeline.HIncrByFloat(ctx, key, "latency_seconds", latency)
+		if task.Usage != nil {
+			pipeline.HIncrByFloat(ctx, key, "compute_seconds", task.Usage.ComputeSeconds)
+		}
+		latencyKey := versionLatencyPrefix + suffix
+		pipeline.LPush(ctx, latencyKey, latency)
+		pipeline.LTrim(ctx, latencyKey, 0, maxLatencySamples-1)
+	case Failed:
+		pipeline.HIncrBy(ctx, key, "failed", 1)
+	case Canceled:
+		pipeline.HIncrBy(ctx, key, "canceled", 1)
+	}
+	_, err = pipeline.Exec(ctx)
+	return err
+}
+
+// percentile returns the p-th percentile of the sorted values
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+func GetVersionStats(modelUUID string, number int) (VersionStats, error) {
+	client := db.GetRedisClient()
+	suffix := modelUUID + ":" + strconv.Itoa(number)
+	result, err := client.HGetAll(ctx, versionStatsPrefix+suffix).Result()
+	if err != nil {
+		return VersionStats{}, err
+	}
+	samples, err := client.LRange(ctx, versionLatencyPrefix+suffix, 0, -1).Result()
+	if err != nil {
+		return VersionStats{}, err
+	}
+
+	stats := VersionStats{
+		Version:     number,
+		Tasks:       int64(atoi(result["tasks"])),
+		Succeeded:   int64(atoi(result["succeeded"])),
+		Failed:      int64(atoi(result["failed"])),
+		Canceled:    int64(atoi(result["canceled"])),
+		ShadowTasks: int64(atoi(result["shadow_tasks"])),
+	}
+	if finished := stats.Succeeded + stats.Failed; finished > 0 {
+		stats.ErrorRate = float64(stats.Failed) / float64(finished)
+	}
+	if stats.Succeeded > 0 {
+		latency, _ := strconv.ParseFloat(result["latency_seconds"], 64)
+		compute, _ := strconv.ParseFloat(result["compute_seconds"], 64)
+		stats.AvgLatencySeconds = latency / float64(stats.Succeeded)
+		stats.AvgComputeSeconds = compute / float64(stats.Succeeded)
+	}
+	latencies := make([]float64, 0, len(samples))
+	for _, sample := range samples {
+		if latency, err := strconv.ParseFloat(sample, 64); err == nil {
+			latencies = append(latencies, latency)
+		}
+	}
+	sort.Float64s(latencies)
+	stats.P50LatencySeconds = percentile(latencies, 0.5)
+	stats.P95LatencySeconds = percentile(latencies, 0.95)
+	return stats, nil
+}
+
+// PromoteModelVersion makes the version the latest one and sends all the traffic to it, promoting an older version
+// rolls the model back
+func PromoteModelVersion(model Model, version ModelVersion) error {
+	if err := ClearTrafficPolicy(model.UUID); err != nil {
+		return err
+	}
+	return makeLatestVersion(model, version, false)
+}
+
+func getTrafficHandler(c *gin.Context) {
+	model, ok := getManagedModel(c)
+	if !ok {
+		return
+	}
+
+	policy, ok, err := GetTrafficPolicy(model.UUID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !ok {
+		policy = TrafficPolicy{Routes: []TrafficRoute{{Version: model.LatestVersion, Weight: 100}}}
+	}
+	versions, err := GetModelVersions(model.UUID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(versions) == 0 {
+		versions = append(versions, legacyVersion(model))
+	}
+	stats := make([]VersionStats, 0, len(versions))
+	for _, version := range versions {
+		versionStats, err := GetVersionStats(model.UUID, version.Number)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		stats = append(stats, versionStats)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"latest_version": model.LatestVersion, "policy": policy, "stats": stats})
+}
+
+func setTrafficHandler(c *gin.Context) {
+	model, ok := getManagedModel(c)
+	if !ok {
+		return
+	}
+	var body TrafficPolicy
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	policy, err := SetTrafficPolicy(model, body)
+	var invalidRequestError *InvalidRequestError
+	if errors.As(err, &invalidRequestError) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, policy)
+}
+
+func clearTrafficHandler(c *gin.Context) {
+	model, ok := getManagedModel(c)
+	if !ok {
+		return
+	}
+
+	if err := ClearTrafficPolicy(model.UUID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "cleared"})
+}
+
+func promoteModelVersionHandler(c *gin.Context) {
+	model, ok := getManagedModel(c)
+	if !ok {
+		return
+	}
+	version, ok := parseVersionParam(c, model)
+	if !ok {
+		return
+	}
+	if version.Number == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the model has no versions"})
+		return
+	}
+
+	if err := PromoteModelVersion(model, version); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, version)
+}
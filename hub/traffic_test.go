@@ -0,0 +1,91 @@
+package hub
+
+import (
+	"cotelligence-model-hub/db"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// shadowedModel records a model without a worker, so its queue is left alone, that shadows all its predictions of
+// version 1 to version 2
+func shadowedModel(t *testing.T) (Model, ModelVersion) {
+	t.Helper()
+	model := Model{UUID: uuid.NewString(), Name: "test-" + uuid.NewString(), Visibility: Public}
+	var versions []ModelVersion
+	for _, digest := range []string{testDigest("a"), testDigest("b")} {
+		version, err := addModelVersion(ModelVersion{ModelUUID: model.UUID, ImageURL: "r8.im/test/model", Digest: digest})
+		if err != nil {
+			t.Fatalf("addModelVersion() = %v", err)
+		}
+		versions = append(versions, version)
+	}
+	setLatestVersion(&model, versions[0])
+	if err := AddModel(model); err != nil {
+		t.Fatalf("AddModel() = %v", err)
+	}
+	policy := TrafficPolicy{Routes: []TrafficRoute{{Version: versions[0].Number, Weight: 100}}, ShadowVersion: versions[1].Number, ShadowPercent: 100}
+	if _, err := SetTrafficPolicy(model, policy); err != nil {
+		t.Fatalf("SetTrafficPolicy() = %v", err)
+	}
+	return model, versions[0]
+}
+
+// queuedTasks returns the tasks queued for the model, oldest first
+func queuedTasks(t *testing.T, modelUUID string) []Task {
+	t.Helper()
+	ids, err := db.GetRedisClient().LRange(ctx, taskQueuePrefix+modelUUID, 0, -1).Result()
+	if err != nil {
+		t.Fatalf("LRange() = %v", err)
+	}
+	tasks := make([]Task, 0, len(ids))
+	for i := len(ids) - 1; i >= 0; i-- {
+		task, err := GetTask(ids[i])
+		if err != nil {
+			t.Fatalf("GetTask() = %v", err)
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks
+}
+
+func TestSubmitPredictionShadowsIdleModel(t *testing.T) {
+	model, version := shadowedModel(t)
+
+	taskId, err := submitPredictionTo(APIKey{ID: uuid.NewString()}, predictionTarget{model: model, version: version},
+		map[string]interface{}{"input": map[string]interface{}{"prompt": "a cat"}})
+	if err != nil {
+		t.Fatalf("submitPredictionTo() = %v", err)
+	}
+
+	tasks := queuedTasks(t, model.UUID)
+	if len(tasks) != 2 {
+		t.Fatalf("queued %d tasks, want the prediction and its shadow", len(tasks))
+	}
+	if tasks[0].ID != taskId || tasks[0].ShadowOf != "" {
+		t.Errorf("first task = %s shadowing %q, want the prediction %s", tasks[0].ID, tasks[0].ShadowOf, taskId)
+	}
+	if tasks[1].ShadowOf != taskId || tasks[1].Version != 2 {
+		t.Errorf("second task shadows %q on version %d, want %s on version 2", tasks[1].ShadowOf, tasks[1].Version, taskId)
+	}
+}
+
+func TestSubmitPredictionSkipsShadowWithBacklog(t *testing.T) {
+	model, version := shadowedModel(t)
+	params := func() map[string]interface{} {
+		return map[string]interface{}{"input": map[string]interface{}{"prompt": "a cat"}}
+	}
+
+	apiKey := APIKey{ID: uuid.NewString()}
+	if _, err := submitPredictionTo(apiKey, predictionTarget{model: model, version: version}, params()); err != nil {
+		t.Fatalf("submitPredictionTo() = %v", err)
+	}
+	// the prediction and its shadow are still queued, the next prediction finds a backlog
+	if _, err := submitPredictionTo(apiKey, predictionTarget{model: model, version: version}, params()); err != nil {
+		t.Fatalf("submitPredictionTo() again = %v", err)
+	}
+
+	if tasks := queuedTasks(t, model.UUID); len(tasks) != 3 {
+		t.Errorf("queued %d tasks, want 3 with the second prediction not shadowed", len(tasks))
+	}
+}
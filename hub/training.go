@@ -0,0 +1,671 @@
+package hub
+
+import (
+	"bytes"
+	"cotelligence-model-hub/config"
+	"cotelligence-model-hub/db"
+	"cotelligence-model-hub/log"
+	"cotelligence-model-hub/openapi"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// TrainingJob fine-tunes a version of a model on a pod through the cog /trainings api, the trained weights become a
+// new version of the model
+type TrainingJob struct {
+	ID        string `json:"id"`
+	ModelUUID string `json:"model_uuid"`
+	// Version is the version trained, ResultVersion the version registered with the trained weights
+	Version       int                    `json:"version"`
+	ResultVersion int                    `json:"result_version,omitempty"`
+	Input         map[string]interface{} `json:"input"`
+	// WeightsInput is the prediction input the trained version loads its weights from
+	WeightsInput string `json:"weights_input"`
+	// Publish makes the trained version the latest one
+	Publish   bool       `json:"publish"`
+	Status    TaskStatus `json:"status"`
+	PodID     string     `json:"pod_id,omitempty"`
+	Logs      string     `json:"logs,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Weights   string     `json:"weights,omitempty"`
+	APIKeyId  string     `json:"api_key_id,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	// StartedAt is when cog started the training on its pod
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	Usage       *TaskUsage `json:"usage,omitempty"`
+	// the model price per second at submission, CreditsReserved is held until the training is settled for CreditsCharged
+	PricePerSecond  int64 `json:"price_per_second,omitempty"`
+	CreditsReserved int64 `json:"credits_reserved,omitempty"`
+	CreditsCharged  int64 `json:"credits_charged,omitempty"`
+	// token authenticates the cog webhooks of the training
+	token string
+}
+
+const trainingPrefix = "hub:training:"
+const trainingIndexPrefix = "hub:trainings:"
+
+// trainingIDPrefix tells trainings from prediction tasks in the pod task sets
+const trainingIDPrefix = "train-"
+
+// trainingTimeout bounds a training, it is canceled past it
+const trainingTimeout = 24 * time.Hour
+
+// trainingReservationSeconds is the compute time reserved for a training, the rest is charged when it is settled
+const trainingReservationSeconds = 3600
+
+var ErrTrainingNotFound = errors.New("training not found")
+
+// weightsInputs are the cog input names tried, in order, to load trained weights
+var weightsInputs = []string{"replicate_weights", "weights", "lora_weights"}
+
+func saveTraining(training TrainingJob) error {
+	input, err := json.Marshal(training.Input)
+	if err != nil {
+		return err
+	}
+	client := db.GetRedisClient()
+	pipeline := client.TxPipeline()
+	pipeline.HSet(ctx, trainingPrefix+training.ID, map[string]interface{}{
+		"id":               training.ID,
+		"model_uuid":       training.ModelUUID,
+		"version":          training.Version,
+		"input":            string(input),
+		"weights_input":    training.WeightsInput,
+		"publish":          training.Publish,
+		"status":           string(training.Status),
+		"api_key_id":       training.APIKeyId,
+		"created_at":       training.CreatedAt.Format(time.RFC3339Nano),
+		"price_per_second": training.PricePerSecond,
+		"credits_reserved": training.CreditsReserved,
+		"token":            training.token,
+	})
+	pipeline.ZAdd(ctx, trainingIndexPrefix+training.ModelUUID, &redis.Z{
+		Score:  float64(training.CreatedAt.Unix()),
+		Member: training.ID,
+	})
+	_, err = pipeline.Exec(ctx)
+	return err
+}
+
+func setTrainingFields(trainingID string, fields ...interface{}) error {
+	client := db.GetRedisClient()
+	return client.HSet(ctx, trainingPrefix+trainingID, fields...).Err()
+}
+
+func trainingFromHash(result map[string]string) TrainingJob {
+	var input map[string]interface{}
+	_ = json.Unmarshal([]byte(result["input"]), &input)
+	createdAt, _ := time.Parse(time.RFC3339Nano, result["created_at"])
+	var usage *TaskUsage
+	if result["usage"] != "" {
+		usage = &TaskUsage{}
+		_ = json.Unmarshal([]byte(result["usage"]), usage)
+	}
+	return TrainingJob{
+		ID:            result["id"],
+		ModelUUID:     result["model_uuid"],
+		Version:       atoi(result["version"]),
+		ResultVersion: atoi(result["result_version"]),
+		Input:         input,
+		WeightsInput:  result["weights_input"],
+		Publish:       result["publish"] == "1",
+		Status:        TaskStatus(result["status"]),
+		PodID:         result["pod_id"],
+		Logs:          result["logs"],
+		Error:         result["error"],
+		Weights:       result["weights"],
+		APIKeyId:      result["api_key_id"],
+		CreatedAt:     createdAt,
+		StartedAt:     parseOptionalTime(time.RFC3339Nano, result["started_at"]),
+		CompletedAt:   parseOptionalTime(time.RFC3339Nano, result["completed_at"]),
+		Usage:         usage,
+
+		PricePerSecond:  int64(atoi(result["price_per_second"])),
+		CreditsReserved: int64(atoi(result["credits_reserved"])),
+		CreditsCharged:  int64(atoi(result["credits_charged"])),
+		token:           result["token"],
+	}
+}
+
+// GetTraining returns the training by its id
+func GetTraining(trainingID string) (TrainingJob, error) {
+	client := db.GetRedisClient()
+	result, err := client.HGetAll(ctx, trainingPrefix+trainingID).Result()
+	if err != nil {
+		return TrainingJob{}, err
+	}
+	if len(result) == 0 {
+		return TrainingJob{}, ErrTrainingNotFound
+	}
+	return trainingFromHash(result), nil
+}
+
+// GetModelTrainings returns the trainings of the model, the latest first
+func GetModelTrainings(modelUUID string) ([]TrainingJob, error) {
+	client := db.GetRedisClient()
+	trainingIDs, err := client.ZRevRange(ctx, trainingIndexPrefix+modelUUID, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	trainings := make([]TrainingJob, 0, len(trainingIDs))
+	for _, trainingID := range trainingIDs {
+		training, err := GetTraining(trainingID)
+		if errors.Is(err, ErrTrainingNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		trainings = append(trainings, training)
+	}
+	return trainings, nil
+}
+
+// trainingRunning reports whether the training still runs on the pod, for the drains of rollouts and deletions
+func trainingRunning(trainingID, podID string) bool {
+	training, err := GetTraining(trainingID)
+	return err == nil && !training.Status.IsTerminal() && training.PodID == podID
+}
+
+// trainingWeightsInput picks the prediction input of the version that loads trained weights
+func trainingWeightsInput(modelUUID string, version ModelVersion, requested string) (string, error) {
+	inputSchema, err := openapi.GetInputSchema(modelUUID, version.Image())
+	if err != nil {
+		return "", err
+	}
+	candidates := weightsInputs
+	if requested != "" {
+		candidates = []string{requested}
+	}
+	for _, name := range candidates {
+		if property, ok := inputSchema.Properties[name]; ok && property.Value != nil && property.Value.Type == "string" {
+			return name, nil
+		}
+	}
+	if requested != "" {
+		return "", &InvalidRequestError{Message: fmt.Sprintf("the model has no string input %s to load weights from", requested)}
+	}
+	return "", &InvalidRequestError{Message: "the model has no input to load weights from, set weights_input"}
+}
+
+// StartTraining checks the training input against the TrainingInput schema of the version and trains it on a pod
+// in the background
+func StartTraining(apiKey APIKey, model Model, version ModelVersion, input map[string]interface{}, weightsInput string, publish bool) (TrainingJob, error) {
+	if model.IsDeleted() {
+		return TrainingJob{}, ErrModelDeleted
+	}
+	if config.GetConfig().WeightsUploadURL == "" {
+		return TrainingJob{}, &InvalidRequestError{Message: "trainings are not configured"}
+	}
+	if err := checkModelContract(Training, model.UUID, version.Image()); err != nil {
+		return TrainingJob{}, &InvalidRequestError{Message: "the model version can not be trained: " + err.Error()}
+	}
+	violations, err := openapi.ValidateTrainingInput(model.UUID, version.Image(), input)
+	if err != nil {
+		return TrainingJob{}, err
+	}
+	if len(violations) > 0 {
+		return TrainingJob{}, &InputValidationError{Violations: violations}
+	}
+	weightsInput, err = trainingWeightsInput(model.UUID, version, weightsInput)
+	if err != nil {
+		return TrainingJob{}, err
+	}
+
+	// trainings are limited and charged per gpu second like the predictions of the model
+	trainingID := trainingIDPrefix + uuid.New().String()
+	if err := CheckRateLimits(apiKey, model); err != nil {
+		return TrainingJob{}, err
+	}
+	if err := AcquireTaskSlot(apiKey, model, trainingID); err != nil {
+		_ = returnRateLimitTokens(apiKey, model)
+		return TrainingJob{}, err
+	}
+	reserved, err := reserveCredits(apiKey.ID, model.UUID, trainingID, model.PricePerSecond*trainingReservationSeconds)
+	if err != nil {
+		_ = ReleaseTaskSlot(apiKey.ID, model.UUID, trainingID)
+		_ = returnRateLimitTokens(apiKey, model)
+		return TrainingJob{}, err
+	}
+
+	training := TrainingJob{
+		ID:           trainingID,
+		ModelUUID:    model.UUID,
+		Version:      version.Number,
+		Input:        input,
+		WeightsInput: weightsInput,
+		Publish:      publish,
+		Status:       Starting,
+		APIKeyId:     apiKey.ID,
+		CreatedAt:    time.Now(),
+
+		PricePerSecond:  model.PricePerSecond,
+		CreditsReserved: reserved,
+		token:           uuid.New().String(),
+	}
+	if err := saveTraining(training); err != nil {
+		_ = ReleaseTaskSlot(apiKey.ID, model.UUID, trainingID)
+		_ = refundCredits(apiKey.ID, model.UUID, trainingID, reserved, "training could not be started")
+		return TrainingJob{}, err
+	}
+	log.ZapLogger.Info("Training started", zap.String("trainingId", training.ID), zap.String("modelUUID", model.UUID), zap.Int("version", version.Number))
+	go runTraining(training)
+	return training, nil
+}
+
+// runTraining provisions a pod for the training, starts it there and keeps the pod out of the predictions until
+// the training is done, its progress comes through the training webhook
+func runTraining(training TrainingJob) {
+	runPodAPI := GetRunPodAPIClient()
+	pod, err := DeployModelToPod(training.ModelUUID, training.Version, "", runPodAPI)
+	if err != nil {
+		log.ZapLogger.Error("Failed to deploy training pod", zap.String("trainingId", training.ID), zap.Error(err))
+		_ = completeTraining(training.ID, EventData{Status: Failed, Error: err.Error()})
+		return
+	}
+	// predictions are not sent to a draining pod
+	binding := ModelPodBinding{ModelUUID: training.ModelUUID, PodID: pod.ID, Version: training.Version, Draining: true}
+	if err := BindModelToPod(binding); err != nil {
+		_ = completeTraining(training.ID, EventData{Status: Failed, Error: err.Error()})
+		return
+	}
+	defer releaseTrainingPod(training, binding)
+	// the pod may have been serving predictions, cog runs one job at a time
+	if err := drainPod(pod.ID); err != nil {
+		_ = completeTraining(training.ID, EventData{Status: Failed, Error: err.Error()})
+		return
+	}
+	// a training canceled while its pod was prepared is not started
+	if trainingCanceled(training.ID) {
+		return
+	}
+	if err := setTrainingFields(training.ID, "pod_id", pod.ID); err != nil {
+		_ = completeTraining(training.ID, EventData{Status: Failed, Error: err.Error()})
+		return
+	}
+	if err := trackPodTask(pod.ID, training.ID); err != nil {
+		_ = completeTraining(training.ID, EventData{Status: Failed, Error: err.Error()})
+		return
+	}
+
+	if trainingCanceled(training.ID) {
+		return
+	}
+	if err := startPodTraining(pod.ID, training); err != nil {
+		log.ZapLogger.Error("Failed to start training on pod", zap.String("trainingId", training.ID), zap.String("podID", pod.ID), zap.Error(err))
+		_ = completeTraining(training.ID, EventData{Status: Failed, Error: err.Error()})
+		return
+	}
+	if err := setTrainingFields(training.ID, "started_at", time.Now().Format(time.RFC3339Nano)); err != nil {
+		log.ZapLogger.Error("Failed to record training start", zap.String("trainingId", training.ID), zap.Error(err))
+	}
+	// CancelTraining may have found the pod before cog knew the training, cancel it there now that it runs
+	if trainingCanceled(training.ID) {
+		if err := cancelPodTraining(pod.ID, training.ID); err != nil {
+			log.ZapLogger.Error("Failed to cancel training on pod", zap.String("trainingId", training.ID), zap.Error(err))
+		}
+		return
+	}
+
+	deadline := time.Now().Add(trainingTimeout)
+	for time.Now().Before(deadline) {
+		// keep the pod occupied and the concurrency slot held while it trains
+		_ = touchPod(pod.ID, "")
+		_ = refreshTaskSlot(training.APIKeyId, training.ModelUUID, training.ID)
+		time.Sleep(30 * time.Second)
+		current, err := GetTraining(training.ID)
+		if err == nil && current.Status.IsTerminal() {
+			return
+		}
+	}
+	log.ZapLogger.Error("Training timed out", zap.String("trainingId", training.ID), zap.String("podID", pod.ID))
+	_ = cancelPodTraining(pod.ID, training.ID)
+	_ = completeTraining(training.ID, EventData{Status: Failed, Error: "training timed out"})
+}
+
+// trainingCanceled reports whether the training was canceled, or otherwise completed, while runTraining prepared it
+func trainingCanceled(trainingID string) bool {
+	training, err := GetTraining(trainingID)
+	return err != nil || training.Status.IsTerminal()
+}
+
+// releaseTrainingPod gives the pod back to the predictions of the model, or releases it when the model was deleted
+func releaseTrainingPod(training TrainingJob, binding ModelPodBinding) {
+	if err := untrackPodTask(binding.PodID, training.ID); err != nil {
+		log.ZapLogger.Error("Failed to untrack training", zap.String("trainingId", training.ID), zap.Error(err))
+	}
+	if model, ok := GetModel(training.ModelUUID); !ok || model.IsDeleted() {
+		_ = UnbindModelFromPod(binding.PodID)
+		_ = releasePod(binding.PodID)
+		return
+	}
+	binding.Draining = false
+	if err := BindModelToPod(binding); err != nil {
+		log.ZapLogger.Error("Failed to rebind training pod", zap.String("podID", binding.PodID), zap.Error(err))
+	}
+}
+
+// trainingUploadPrefix is where cog uploads the files output by the training
+func trainingUploadPrefix(trainingID string) string {
+	return strings.TrimSuffix(config.GetConfig().WeightsUploadURL, "/") + "/" + trainingID + "/"
+}
+
+// startPodTraining sends the training to cog, which reports its progress to the training webhook
+func startPodTraining(podID string, training TrainingJob) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"id":                    training.ID,
+		"input":                 training.Input,
+		"webhook":               hubWebhookBaseURL + "/training-webhook/" + training.ID + "?token=" + training.token,
+		"webhook_events_filter": AllWebhookEvents,
+		// cog uploads the weights there instead of inlining them in the output as a data uri
+		"output_file_prefix": trainingUploadPrefix(training.ID),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, podAPIBaseURL(podID)+"/trainings/"+training.ID, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "respond-async")
+	resp, err := proxyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		message, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to start training: status %d: %s", resp.StatusCode, message)
+	}
+	return nil
+}
+
+func cancelPodTraining(podID, trainingID string) error {
+	resp, err := proxyClient.Post(podAPIBaseURL(podID)+"/trainings/"+trainingID+"/cancel", "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to cancel training %s on pod %s: status %d", trainingID, podID, resp.StatusCode)
+	}
+	return nil
+}
+
+// completeTraining records the end of the training once, a succeeded training registers its weights as a version
+func completeTraining(trainingID string, eventData EventData) error {
+	client := db.GetRedisClient()
+	completedAt := time.Now()
+	first, err := client.HSetNX(ctx, trainingPrefix+trainingID, "completed_at", completedAt.Format(time.RFC3339Nano)).Result()
+	if err != nil || !first {
+		return err
+	}
+
+	status, trainingError := eventData.Status, eventData.ErrorMessage()
+	var weights string
+	if status == Succeeded {
+		output, _ := eventData.Output.(map[string]interface{})
+		weights, _ = output["weights"].(string)
+		if weights == "" {
+			status, trainingError = Failed, "training output has no weights"
+		} else if u, err := url.Parse(weights); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			// only the url of the uploaded weights is kept, they are passed to every prediction of the version
+			status, trainingError, weights = Failed, "training weights were not uploaded", ""
+		}
+	}
+	if status == Canceled && trainingError == "" {
+		trainingError = "training canceled"
+	}
+	fields := []interface{}{"status", string(status), "error", trainingError, "weights", weights}
+	if eventData.Logs != "" {
+		fields = append(fields, "logs", eventData.Logs)
+	}
+	if err := setTrainingFields(trainingID, fields...); err != nil {
+		return err
+	}
+	training, err := GetTraining(trainingID)
+	if err != nil {
+		return err
+	}
+
+	if status == Succeeded {
+		version, err := registerTrainedVersion(training)
+		if err != nil {
+			log.ZapLogger.Error("Failed to register trained version", zap.String("trainingId", trainingID), zap.Error(err))
+			training.Status = Failed
+			err = setTrainingFields(trainingID, "status", string(Failed), "error", "failed to register the trained weights: "+err.Error())
+		} else {
+			log.ZapLogger.Info("Training succeeded", zap.String("trainingId", trainingID), zap.Int("version", version.Number))
+			err = setTrainingFields(trainingID, "result_version", version.Number)
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		log.ZapLogger.Info("Training ended", zap.String("trainingId", trainingID), zap.String("status", string(status)), zap.String("error", trainingError))
+	}
+	return meterTraining(training, completedAt)
+}
+
+// meterTraining frees the concurrency slot of the completed training, records its usage and settles its credits,
+// failed trainings are refunded like failed predictions
+func meterTraining(training TrainingJob, completedAt time.Time) error {
+	if err := ReleaseTaskSlot(training.APIKeyId, training.ModelUUID, training.ID); err != nil {
+		return err
+	}
+	usage := TaskUsage{
+		PodId:            training.PodID,
+		Status:           training.Status,
+		CompletedAt:      completedAt,
+		ColdStartSeconds: secondsBetween(training.CreatedAt, timeOrZero(training.StartedAt)),
+		ComputeSeconds:   secondsBetween(timeOrZero(training.StartedAt), completedAt),
+	}
+	meterGpu(&usage, taskHardware(training.ModelUUID, training.Version))
+	serializedUsage, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	client := db.GetRedisClient()
+	pipeline := client.TxPipeline()
+	pipeline.HSet(ctx, trainingPrefix+training.ID, "usage", string(serializedUsage))
+	addUsage(pipeline, training.APIKeyId, training.ModelUUID, usage)
+	if _, err := pipeline.Exec(ctx); err != nil {
+		return err
+	}
+
+	if training.PricePerSecond == 0 {
+		return nil
+	}
+	if training.Status == Failed {
+		return refundCredits(training.APIKeyId, training.ModelUUID, training.ID, training.CreditsReserved, "training failed")
+	}
+	charged := int64(math.Ceil(usage.GpuSeconds * float64(training.PricePerSecond)))
+	if err := settleCredits(training.APIKeyId, training.ModelUUID, training.ID, training.CreditsReserved, charged); err != nil {
+		return err
+	}
+	return setTrainingFields(training.ID, "credits_charged", charged)
+}
+
+// registerTrainedVersion adds a version running the image of the trained version with the trained weights
+func registerTrainedVersion(training TrainingJob) (ModelVersion, error) {
+	model, ok := GetModel(training.ModelUUID)
+	if !ok {
+		return ModelVersion{}, ErrModelNotFound
+	}
+	base, err := modelVersion(model, training.Version)
+	if err != nil {
+		return ModelVersion{}, err
+	}
+	version, err := addModelVersion(ModelVersion{
+		ModelUUID:    model.UUID,
+		ImageURL:     base.ImageURL,
+		Digest:       base.Digest,
+		Hardware:     base.Hardware,
+		Weights:      training.Weights,
+		WeightsInput: training.WeightsInput,
+		TrainingID:   training.ID,
+	})
+	if err != nil {
+		return ModelVersion{}, err
+	}
+	if training.Publish {
+		return version, makeLatestVersion(model, version, true)
+	}
+	// the image is the same, its spec is usually known already
+	discoverModelSpecAsync(model, version, false)
+	return version, nil
+}
+
+// CancelTraining stops a running training
+func CancelTraining(training TrainingJob) error {
+	if training.Status.IsTerminal() {
+		return ErrTaskCompleted
+	}
+	if training.PodID != "" {
+		if err := cancelPodTraining(training.PodID, training.ID); err != nil {
+			log.ZapLogger.Error("Failed to cancel training on pod", zap.String("trainingId", training.ID), zap.Error(err))
+		}
+	}
+	return completeTraining(training.ID, EventData{Status: Canceled})
+}
+
+// trainingWebhookHandler receives the cog webhooks of a training
+func trainingWebhookHandler(c *gin.Context) {
+	training, err := GetTraining(c.Param("trainingId"))
+	if err != nil || !validWebhookToken(training.token, c.Query("token")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrTrainingNotFound.Error()})
+		return
+	}
+	var eventData EventData
+	if err := c.ShouldBindJSON(&eventData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON body"})
+		return
+	}
+
+	switch eventData.Status {
+	case Starting, Processing:
+		err = setTrainingFields(training.ID, "status", string(Processing), "logs", eventData.Logs)
+	case Succeeded, Failed, Canceled:
+		// the weights are registered once the webhook is answered
+		go func() {
+			if err := completeTraining(training.ID, eventData); err != nil {
+				log.ZapLogger.Error("Failed to complete training", zap.String("trainingId", training.ID), zap.Error(err))
+			}
+		}()
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+func startTrainingHandler(c *gin.Context) {
+	model, ok := getManagedModel(c)
+	if !ok {
+		return
+	}
+	var body struct {
+		Input map[string]interface{} `json:"input" binding:"required"`
+		// Version is the version to train, latest by default
+		Version      interface{} `json:"version"`
+		WeightsInput string      `json:"weights_input"`
+		Publish      bool        `json:"publish"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if body.Version == nil {
+		body.Version = LatestVersion
+	}
+
+	version, err := ResolveModelVersion(model, body.Version)
+	if err == nil {
+		var training TrainingJob
+		training, err = StartTraining(currentAPIKey(c), model, version, body.Input, body.WeightsInput, body.Publish)
+		if err == nil {
+			c.JSON(http.StatusAccepted, training)
+			return
+		}
+	}
+	var inputValidationError *InputValidationError
+	if errors.As(err, &inputValidationError) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid training input", "violations": inputValidationError.Violations})
+		return
+	}
+	c.JSON(predictionErrorStatus(c, err), gin.H{"error": err.Error()})
+}
+
+// getModelTraining returns the :trainingId training of the model the caller manages
+func getModelTraining(c *gin.Context) (TrainingJob, bool) {
+	model, ok := getManagedModel(c)
+	if !ok {
+		return TrainingJob{}, false
+	}
+	training, err := GetTraining(c.Param("trainingId"))
+	if errors.Is(err, ErrTrainingNotFound) || (err == nil && training.ModelUUID != model.UUID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrTrainingNotFound.Error()})
+		return TrainingJob{}, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return TrainingJob{}, false
+	}
+	return training, true
+}
+
+func listTrainingsHandler(c *gin.Context) {
+	model, ok := getManagedModel(c)
+	if !ok {
+		return
+	}
+	trainings, err := GetModelTrainings(model.UUID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, trainings)
+}
+
+func getTrainingHandler(c *gin.Context) {
+	training, ok := getModelTraining(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, training)
+}
+
+func cancelTrainingHandler(c *gin.Context) {
+	training, ok := getModelTraining(c)
+	if !ok {
+		return
+	}
+	err := CancelTraining(training)
+	if errors.Is(err, ErrTaskCompleted) {
+		c.JSON(http.StatusConflict, gin.H{"error": "training already completed"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "canceled"})
+}
@@ -0,0 +1,278 @@
+package hub
+
+import (
+	"cotelligence-model-hub/db"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+// TaskUsage is the metered resource usage of a finished task
+type TaskUsage struct {
+	PodId            string  `json:"pod_id"`
+	GpuType          string  `json:"gpu_type"`
+	GpuCount         int     `json:"gpu_count"`
+	QueueWaitSeconds float64 `json:"queue_wait_seconds"`
+	ColdStartSeconds float64 `json:"cold_start_seconds"`
+	ComputeSeconds   float64 `json:"compute_seconds"`
+	// GpuSeconds is billed from the moment the task waits for its pod until it completes
+	GpuSeconds  float64    `json:"gpu_seconds"`
+	Cost        float64    `json:"cost"`
+	Status      TaskStatus `json:"status"`
+	CompletedAt time.Time  `json:"completed_at"`
+}
+
+// UsageSummary aggregates the usage of an api key on a model for a day
+type UsageSummary struct {
+	Day              string  `json:"day"`
+	APIKeyId         string  `json:"api_key_id"`
+	ModelId          string  `json:"model_id"`
+	Tasks            int64   `json:"tasks"`
+	FailedTasks      int64   `json:"failed_tasks"`
+	QueueWaitSeconds float64 `json:"queue_wait_seconds"`
+	ColdStartSeconds float64 `json:"cold_start_seconds"`
+	ComputeSeconds   float64 `json:"compute_seconds"`
+	GpuSeconds       float64 `json:"gpu_seconds"`
+	Cost             float64 `json:"cost"`
+}
+
+const usagePrefix = "hub:usage:"
+const usageIndexPrefix = "hub:usageIndex:"
+const usageDayLayout = "2006-01-02"
+
+// usageRetention keeps a bit more than a year of daily aggregates
+const usageRetention = 400 * 24 * time.Hour
+
+// maxUsageDays bounds the range of a usage query
+const maxUsageDays = 366
+
+func usageKey(day, apiKeyId, modelId string) string {
+	return usagePrefix + day + ":" + apiKeyId + ":" + modelId
+}
+
+func secondsBetween(from, to time.Time) float64 {
+	if from.IsZero() || to.IsZero() || to.Before(from) {
+		return 0
+	}
+	return to.Sub(from).Seconds()
+}
+
+// timeOrZero is the time of an optional field, the zero time when it is not set
+func timeOrZero(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
+
+// RecordTaskUsage meters a finished task once and adds it to the daily aggregates
+func RecordTaskUsage(taskID string) error {
+	client := db.GetRedisClient()
+	taskKey := taskPrefix + taskID
+	// only the first terminal event is metered
+	first, err := client.HSetNX(ctx, taskKey, "UsageRecorded", "1").Result()
+	if err != nil || !first {
+		return err
+	}
+
+	task, err := GetTask(taskID)
+	if err != nil {
+		return err
+	}
+	completedAt := time.Now()
+	usage := TaskUsage{
+		PodId:            task.PodId,
+		Status:           task.Status,
+		CompletedAt:      completedAt,
+		QueueWaitSeconds: secondsBetween(task.CreatedAt, timeOrZero(task.DequeuedAt)),
+		ColdStartSeconds: secondsBetween(timeOrZero(task.DequeuedAt), timeOrZero(task.PodReadyAt)),
+		ComputeSeconds:   secondsBetween(timeOrZero(task.PodReadyAt), completedAt),
+	}
+	// prefer the predict time measured by cog
+	if predictTime, ok := task.Metrics["predict_time"].(float64); ok {
+		usage.ComputeSeconds = predictTime
+	}
+	meterGpu(&usage, taskHardware(task.ModelId, task.Version))
+
+	serializedUsage, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	pipeline := client.TxPipeline()
+	pipeline.HSet(ctx, taskKey, "Usage", string(serializedUsage))
+	addUsage(pipeline, task.APIKeyId, task.ModelId, usage)
+	_, err = pipeline.Exec(ctx)
+	return err
+}
+
+// taskHardware is the hardware profile of the version the task or training ran on
+func taskHardware(modelId string, versionNumber int) HardwareProfile {
+	if versionNumber > 0 {
+		if version, err := GetModelVersion(modelId, versionNumber); err == nil {
+			return version.Hardware
+		}
+	}
+	model, _ := GetModel(modelId)
+	return model.Hardware
+}
+
+// meterGpu fills in the gpu the usage ran on and prices its gpu seconds at the hourly price of its pod, usage that
+// never reached a pod has none. Pods the provider did not describe, or that are gone, are metered at the hardware of
+// the version and the default price
+func meterGpu(usage *TaskUsage, versionHardware HardwareProfile) {
+	if usage.PodId == "" {
+		return
+	}
+	hardware, costPerHr := versionHardware.withDefaults(), 0.0
+	if pod, err := GetPod(usage.PodId); err == nil && pod.Hardware.GpuTypeId != "" {
+		hardware, costPerHr = pod.Hardware.withDefaults(), pod.CostPerHr
+	}
+	if costPerHr <= 0 {
+		costPerHr = DefaultDeployCost * float64(hardware.GpuCount)
+	}
+	usage.GpuType = hardware.GpuTypeId
+	usage.GpuCount = hardware.GpuCount
+	wallSeconds := usage.ColdStartSeconds + usage.ComputeSeconds
+	usage.GpuSeconds = wallSeconds * float64(usage.GpuCount)
+	usage.Cost = wallSeconds / 3600 * costPerHr
+}
+
+// addUsage adds the usage of a task or a training to the daily aggregates of the api key on the model
+func addUsage(pipeline redis.Pipeliner, apiKeyId, modelId string, usage TaskUsage) {
+	failed := int64(0)
+	if usage.Status != Succeeded {
+		failed = 1
+	}
+	day := usage.CompletedAt.UTC().Format(usageDayLayout)
+	key := usageKey(day, apiKeyId, modelId)
+	indexKey := usageIndexPrefix + day
+
+	pipeline.HIncrBy(ctx, key, "tasks", 1)
+	pipeline.HIncrBy(ctx, key, "failed_tasks", failed)
+	pipeline.HIncrByFloat(ctx, key, "queue_wait_seconds", usage.QueueWaitSeconds)
+	pipeline.HIncrByFloat(ctx, key, "cold_start_seconds", usage.ColdStartSeconds)
+	pipeline.HIncrByFloat(ctx, key, "compute_seconds", usage.ComputeSeconds)
+	pipeline.HIncrByFloat(ctx, key, "gpu_seconds", usage.GpuSeconds)
+	pipeline.HIncrByFloat(ctx, key, "cost", usage.Cost)
+	pipeline.Expire(ctx, key, usageRetention)
+	pipeline.SAdd(ctx, indexKey, apiKeyId+":"+modelId)
+	pipeline.Expire(ctx, indexKey, usageRetention)
+}
+
+// GetUsage returns the daily aggregates between the days, empty filters match everything
+func GetUsage(from, to time.Time, apiKeyId, modelId string) ([]UsageSummary, error) {
+	client := db.GetRedisClient()
+	summaries := make([]UsageSummary, 0)
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		dayStr := day.Format(usageDayLayout)
+		members, err := client.SMembers(ctx, usageIndexPrefix+dayStr).Result()
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(members)
+		for _, member := range members {
+			keyId, model, _ := strings.Cut(member, ":")
+			if (apiKeyId != "" && keyId != apiKeyId) || (modelId != "" && model != modelId) {
+				continue
+			}
+			result, err := client.HGetAll(ctx, usageKey(dayStr, keyId, model)).Result()
+			if err != nil {
+				return nil, err
+			}
+			summaries = append(summaries, usageSummaryFromHash(dayStr, keyId, model, result))
+		}
+	}
+	return summaries, nil
+}
+
+func usageSummaryFromHash(day, apiKeyId, modelId string, result map[string]string) UsageSummary {
+	parseFloat := func(s string) float64 {
+		f, _ := strconv.ParseFloat(s, 64)
+		return f
+	}
+	return UsageSummary{
+		Day:              day,
+		APIKeyId:         apiKeyId,
+		ModelId:          modelId,
+		Tasks:            int64(atoi(result["tasks"])),
+		FailedTasks:      int64(atoi(result["failed_tasks"])),
+		QueueWaitSeconds: parseFloat(result["queue_wait_seconds"]),
+		ColdStartSeconds: parseFloat(result["cold_start_seconds"]),
+		ComputeSeconds:   parseFloat(result["compute_seconds"]),
+		GpuSeconds:       parseFloat(result["gpu_seconds"]),
+		Cost:             parseFloat(result["cost"]),
+	}
+}
+
+// parseUsageRange reads the from and to days, defaulting to the last 30 days
+func parseUsageRange(c *gin.Context) (time.Time, time.Time, error) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	from, to := today.AddDate(0, 0, -29), today
+	var err error
+	if s := c.Query("from"); s != "" {
+		if from, err = time.Parse(usageDayLayout, s); err != nil {
+			return from, to, errors.New("from must be a YYYY-MM-DD day")
+		}
+	}
+	if s := c.Query("to"); s != "" {
+		if to, err = time.Parse(usageDayLayout, s); err != nil {
+			return from, to, errors.New("to must be a YYYY-MM-DD day")
+		}
+	}
+	if to.Before(from) || to.Sub(from) > maxUsageDays*24*time.Hour {
+		return from, to, errors.New("invalid day range")
+	}
+	return from, to, nil
+}
+
+func writeUsageCSV(c *gin.Context, summaries []UsageSummary) {
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", `attachment; filename="usage.csv"`)
+	c.Status(http.StatusOK)
+	writer := csv.NewWriter(c.Writer)
+	_ = writer.Write([]string{"day", "api_key_id", "model_id", "tasks", "failed_tasks",
+		"queue_wait_seconds", "cold_start_seconds", "compute_seconds", "gpu_seconds", "cost"})
+	formatFloat := func(f float64) string {
+		return strconv.FormatFloat(f, 'f', 3, 64)
+	}
+	for _, s := range summaries {
+		_ = writer.Write([]string{s.Day, s.APIKeyId, s.ModelId,
+			strconv.FormatInt(s.Tasks, 10), strconv.FormatInt(s.FailedTasks, 10),
+			formatFloat(s.QueueWaitSeconds), formatFloat(s.ColdStartSeconds), formatFloat(s.ComputeSeconds),
+			formatFloat(s.GpuSeconds), strconv.FormatFloat(s.Cost, 'f', 6, 64)})
+	}
+	writer.Flush()
+}
+
+// usageHandler returns the usage aggregates, non admin keys only see their own usage
+func usageHandler(c *gin.Context) {
+	from, to, err := parseUsageRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	apiKeyId := c.Query("api_key_id")
+	if apiKey := currentAPIKey(c); !apiKey.HasScope(ScopeAdmin) {
+		apiKeyId = apiKey.ID
+	}
+
+	summaries, err := GetUsage(from, to, apiKeyId, c.Query("model_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if c.Query("format") == "csv" {
+		writeUsageCSV(c, summaries)
+		return
+	}
+	c.JSON(http.StatusOK, summaries)
+}
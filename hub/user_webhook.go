@@ -0,0 +1,460 @@
+package hub
+
+import (
+	"bytes"
+	"cotelligence-model-hub/config"
+	"cotelligence-model-hub/db"
+	"cotelligence-model-hub/log"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliveryDelivered DeliveryStatus = "delivered"
+	DeliveryFailed    DeliveryStatus = "failed"
+	// DeliverySkipped deliveries of intermediate events were superseded by the completed event before they were sent
+	DeliverySkipped DeliveryStatus = "skipped"
+)
+
+// WebhookDelivery is one notification sent to a caller supplied webhook
+type WebhookDelivery struct {
+	ID            string         `json:"id"`
+	TaskID        string         `json:"task_id"`
+	URL           string         `json:"url"`
+	Event         WebhookEvent   `json:"event"`
+	Payload       string         `json:"payload"`
+	Status        DeliveryStatus `json:"status"`
+	Attempts      int            `json:"attempts"`
+	StatusCode    int            `json:"status_code,omitempty"`
+	LastError     string         `json:"last_error,omitempty"`
+	CreatedAt     time.Time      `json:"created_at"`
+	NextAttemptAt time.Time      `json:"next_attempt_at"`
+	DeliveredAt   *time.Time     `json:"delivered_at,omitempty"`
+}
+
+const webhookQueueKey = "hub:webhookQueue"
+const webhookDeliveryPrefix = "hub:webhookDelivery:"
+const taskWebhooksPrefix = "hub:taskWebhooks:"
+
+// throttledWebhookPrefix points at the delivery of an output or logs event of a task still waiting for its first attempt
+const throttledWebhookPrefix = "hub:throttledWebhook:"
+
+// webhookThrottleInterval is how long output and logs events are held, the events coming meanwhile are folded into
+// the same delivery so a token stream does not become a delivery per token
+const webhookThrottleInterval = 1 * time.Second
+
+const (
+	webhookMaxAttempts   = 8
+	webhookRetryBase     = 5 * time.Second
+	webhookRetryMax      = 30 * time.Minute
+	webhookDeliveryTTL   = 24 * time.Hour
+	webhookPollInterval  = 1 * time.Second
+	webhookClaimBatchCnt = 20
+	webhookClaimLease    = 1 * time.Minute
+)
+
+// claimWebhookScript pushes a due delivery forward by a lease so a crashed worker's claim is retried
+var claimWebhookScript = redis.NewScript(`
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if score and tonumber(score) <= tonumber(ARGV[2]) then
+	redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+	return 1
+end
+return 0
+`)
+
+// updateUnclaimedWebhookScript saves a delivery still waiting in the queue, and takes it out of it when asked. A
+// delivery claimed by a worker has its score pushed beyond the throttle interval, it is left to the worker
+var updateUnclaimedWebhookScript = redis.NewScript(`
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not score or tonumber(score) > tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('SET', KEYS[2], ARGV[3], 'PX', ARGV[4])
+if ARGV[5] == '1' then
+	redis.call('ZREM', KEYS[1], ARGV[1])
+end
+return 1
+`)
+
+// webhookClient only reaches public addresses, webhook urls are chosen by the caller
+var webhookClient = newPublicHTTPClient(10 * time.Second)
+
+// parseWebhookParams takes the caller webhook and event filter out of the prediction body
+func parseWebhookParams(body map[string]interface{}) (string, []WebhookEvent, error) {
+	rawWebhook, hasWebhook := body["webhook"]
+	rawFilter, hasFilter := body["webhook_events_filter"]
+	delete(body, "webhook")
+	delete(body, "webhook_events_filter")
+	if !hasWebhook {
+		if hasFilter {
+			return "", nil, errors.New("webhook_events_filter requires webhook")
+		}
+		return "", nil, nil
+	}
+
+	webhook, ok := rawWebhook.(string)
+	if !ok {
+		return "", nil, errors.New("webhook must be a string")
+	}
+	webhookURL, err := url.Parse(webhook)
+	if err != nil || (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") || webhookURL.Host == "" {
+		return "", nil, fmt.Errorf("invalid webhook url: %s", webhook)
+	}
+	if err := checkPublicHost(webhookURL.Hostname()); err != nil {
+		return "", nil, fmt.Errorf("webhook url must reach a public address: %s", webhook)
+	}
+	if config.GetConfig().WebhookSecret == "" {
+		return "", nil, errors.New("outbound webhooks are not configured")
+	}
+
+	if !hasFilter {
+		return webhook, AllWebhookEvents, nil
+	}
+	filterList, ok := rawFilter.([]interface{})
+	if !ok {
+		return "", nil, errors.New("webhook_events_filter must be an array")
+	}
+	filter := make([]WebhookEvent, 0, len(filterList))
+	for _, item := range filterList {
+		event, _ := item.(string)
+		if !isWebhookEvent(WebhookEvent(event)) {
+			return "", nil, fmt.Errorf("invalid webhook event: %v", item)
+		}
+		filter = append(filter, WebhookEvent(event))
+	}
+	return webhook, filter, nil
+}
+
+func isWebhookEvent(event WebhookEvent) bool {
+	for _, e := range AllWebhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func isThrottledWebhookEvent(event WebhookEvent) bool {
+	return event == WebhookEventOutput || event == WebhookEventLogs
+}
+
+func throttledWebhookKey(taskID string, event WebhookEvent) string {
+	return throttledWebhookPrefix + taskID + ":" + string(event)
+}
+
+// pendingThrottledDelivery returns the delivery of the output or logs event of the task that was not attempted yet
+func pendingThrottledDelivery(taskID string, event WebhookEvent) (WebhookDelivery, bool) {
+	id, err := db.GetRedisClient().Get(ctx, throttledWebhookKey(taskID, event)).Result()
+	if err != nil {
+		return WebhookDelivery{}, false
+	}
+	delivery, err := GetWebhookDelivery(id)
+	if err != nil || delivery.Status != DeliveryPending || delivery.Attempts > 0 {
+		return WebhookDelivery{}, false
+	}
+	return delivery, true
+}
+
+// updateUnclaimedDelivery saves the delivery unless a worker claimed it since it was read, dequeue also takes it out
+// of the queue. It reports whether the delivery was saved
+func updateUnclaimedDelivery(delivery WebhookDelivery, dequeue bool) (bool, error) {
+	serialized, err := json.Marshal(delivery)
+	if err != nil {
+		return false, err
+	}
+	dequeueArg := "0"
+	if dequeue {
+		dequeueArg = "1"
+	}
+	unclaimedBefore := time.Now().Add(webhookThrottleInterval).Unix()
+	updated, err := updateUnclaimedWebhookScript.Run(ctx, db.GetRedisClient(),
+		[]string{webhookQueueKey, webhookDeliveryPrefix + delivery.ID},
+		delivery.ID, unclaimedBefore, serialized, webhookDeliveryTTL.Milliseconds(), dequeueArg).Int()
+	return updated == 1, err
+}
+
+// skipThrottledDeliveries drops the output and logs deliveries not attempted yet, the completed event carries the
+// final output and logs and must not be followed by an older state. Those a worker already claimed are sent
+func skipThrottledDeliveries(taskID string) {
+	for _, event := range []WebhookEvent{WebhookEventOutput, WebhookEventLogs} {
+		delivery, ok := pendingThrottledDelivery(taskID, event)
+		if !ok {
+			continue
+		}
+		delivery.Status = DeliverySkipped
+		if _, err := updateUnclaimedDelivery(delivery, true); err != nil {
+			log.ZapLogger.Error("Failed to save webhook delivery", zap.String("deliveryId", delivery.ID), zap.Error(err))
+		}
+	}
+}
+
+// NotifyTask enqueues a delivery of the current task state if the caller subscribed to the event. Output and logs
+// events are throttled: those coming while a delivery of the same event waits unclaimed are folded into it
+func NotifyTask(taskID string, event WebhookEvent) {
+	task, err := GetTask(taskID)
+	if err != nil {
+		log.ZapLogger.Error("Failed to load task for webhook", zap.String("taskId", taskID), zap.Error(err))
+		return
+	}
+	if task.Webhook == "" {
+		return
+	}
+	subscribed := false
+	for _, e := range task.WebhookEventsFilter {
+		if e == event {
+			subscribed = true
+			break
+		}
+	}
+	if !subscribed {
+		return
+	}
+
+	payload, err := json.Marshal(task)
+	if err != nil {
+		log.ZapLogger.Error("Failed to marshal webhook payload", zap.String("taskId", taskID), zap.Error(err))
+		return
+	}
+	throttled := isThrottledWebhookEvent(event)
+	if throttled {
+		if delivery, ok := pendingThrottledDelivery(taskID, event); ok {
+			delivery.Payload = string(payload)
+			folded, err := updateUnclaimedDelivery(delivery, false)
+			if err != nil {
+				log.ZapLogger.Error("Failed to save webhook delivery", zap.String("deliveryId", delivery.ID), zap.Error(err))
+			}
+			// a delivery claimed meanwhile is being sent with the previous state, this one gets its own
+			if folded || err != nil {
+				return
+			}
+		}
+	} else if event == WebhookEventCompleted {
+		skipThrottledDeliveries(taskID)
+	}
+
+	now := time.Now()
+	delivery := WebhookDelivery{
+		ID:            uuid.New().String(),
+		TaskID:        taskID,
+		URL:           task.Webhook,
+		Event:         event,
+		Payload:       string(payload),
+		Status:        DeliveryPending,
+		CreatedAt:     now,
+		NextAttemptAt: now,
+	}
+	if throttled {
+		delivery.NextAttemptAt = now.Add(webhookThrottleInterval)
+	}
+	if err := enqueueWebhookDelivery(delivery); err != nil {
+		log.ZapLogger.Error("Failed to enqueue webhook delivery", zap.String("taskId", taskID), zap.Error(err))
+		return
+	}
+	if throttled {
+		err = db.GetRedisClient().Set(ctx, throttledWebhookKey(taskID, event), delivery.ID, webhookDeliveryTTL).Err()
+		if err != nil {
+			log.ZapLogger.Error("Failed to record throttled webhook delivery", zap.String("taskId", taskID), zap.Error(err))
+		}
+	}
+}
+
+func saveWebhookDelivery(delivery WebhookDelivery) error {
+	client := db.GetRedisClient()
+	serialized, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	return client.Set(ctx, webhookDeliveryPrefix+delivery.ID, serialized, webhookDeliveryTTL).Err()
+}
+
+func enqueueWebhookDelivery(delivery WebhookDelivery) error {
+	client := db.GetRedisClient()
+	if err := saveWebhookDelivery(delivery); err != nil {
+		return err
+	}
+	taskWebhooksKey := taskWebhooksPrefix + delivery.TaskID
+	pipeline := client.TxPipeline()
+	pipeline.RPush(ctx, taskWebhooksKey, delivery.ID)
+	pipeline.Expire(ctx, taskWebhooksKey, webhookDeliveryTTL)
+	pipeline.ZAdd(ctx, webhookQueueKey, &redis.Z{Score: float64(delivery.NextAttemptAt.Unix()), Member: delivery.ID})
+	_, err := pipeline.Exec(ctx)
+	return err
+}
+
+func GetWebhookDelivery(id string) (WebhookDelivery, error) {
+	client := db.GetRedisClient()
+	val, err := client.Get(ctx, webhookDeliveryPrefix+id).Result()
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	var delivery WebhookDelivery
+	err = json.Unmarshal([]byte(val), &delivery)
+	return delivery, err
+}
+
+// GetTaskWebhookDeliveries returns the delivery log of a task in the order the events happened
+func GetTaskWebhookDeliveries(taskID string) ([]WebhookDelivery, error) {
+	client := db.GetRedisClient()
+	ids, err := client.LRange(ctx, taskWebhooksPrefix+taskID, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	deliveries := make([]WebhookDelivery, 0, len(ids))
+	for _, id := range ids {
+		delivery, err := GetWebhookDelivery(id)
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+// signWebhook signs the payload following the standard webhooks spec, ref: https://www.standardwebhooks.com
+func signWebhook(secret, id string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(id + "." + strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(payload)
+	return "v1," + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func attemptWebhookDelivery(delivery WebhookDelivery) (int, error) {
+	payload := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Webhook-Id", delivery.ID)
+	req.Header.Set("Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("Webhook-Signature", signWebhook(config.GetConfig().WebhookSecret, delivery.ID, timestamp, payload))
+	req.Header.Set("Webhook-Event", string(delivery.Event))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookRetryBase << (attempts - 1)
+	if delay <= 0 || delay > webhookRetryMax {
+		return webhookRetryMax
+	}
+	return delay
+}
+
+func processWebhookDelivery(id string) {
+	delivery, err := GetWebhookDelivery(id)
+	if err != nil {
+		// the delivery may already have expired
+		log.ZapLogger.Error("Failed to load webhook delivery", zap.String("deliveryId", id), zap.Error(err))
+		if errors.Is(err, redis.Nil) {
+			db.GetRedisClient().ZRem(ctx, webhookQueueKey, id)
+		}
+		return
+	}
+
+	delivery.Attempts++
+	statusCode, err := attemptWebhookDelivery(delivery)
+	delivery.StatusCode = statusCode
+	if err == nil {
+		now := time.Now()
+		delivery.Status = DeliveryDelivered
+		delivery.DeliveredAt = &now
+		delivery.LastError = ""
+	} else {
+		delivery.LastError = err.Error()
+		if delivery.Attempts >= webhookMaxAttempts {
+			log.ZapLogger.Error("Giving up webhook delivery", zap.String("deliveryId", id), zap.String("taskId", delivery.TaskID), zap.Error(err))
+			delivery.Status = DeliveryFailed
+		} else {
+			delivery.NextAttemptAt = time.Now().Add(webhookRetryDelay(delivery.Attempts))
+		}
+	}
+
+	if err := saveWebhookDelivery(delivery); err != nil {
+		log.ZapLogger.Error("Failed to save webhook delivery", zap.String("deliveryId", id), zap.Error(err))
+	}
+	client := db.GetRedisClient()
+	if delivery.Status == DeliveryPending {
+		err = client.ZAdd(ctx, webhookQueueKey, &redis.Z{Score: float64(delivery.NextAttemptAt.Unix()), Member: id}).Err()
+	} else {
+		err = client.ZRem(ctx, webhookQueueKey, id).Err()
+	}
+	if err != nil {
+		log.ZapLogger.Error("Failed to update webhook queue", zap.String("deliveryId", id), zap.Error(err))
+	}
+}
+
+// deliverWebhooks polls the queue for due deliveries and claims each of them with a lease
+func deliverWebhooks() {
+	client := db.GetRedisClient()
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ids, err := client.ZRangeByScore(ctx, webhookQueueKey, &redis.ZRangeBy{
+			Min:   "-inf",
+			Max:   strconv.FormatInt(time.Now().Unix(), 10),
+			Count: webhookClaimBatchCnt,
+		}).Result()
+		if err != nil {
+			log.ZapLogger.Error("Failed to poll webhook queue", zap.Error(err))
+			continue
+		}
+		now := time.Now()
+		for _, id := range ids {
+			claimed, err := claimWebhookScript.Run(ctx, client, []string{webhookQueueKey},
+				id, now.Unix(), now.Add(webhookClaimLease).Unix()).Int()
+			if err != nil || claimed == 0 {
+				continue
+			}
+			go processWebhookDelivery(id)
+		}
+	}
+}
+
+func listTaskWebhooksHandler(c *gin.Context) {
+	if _, err := getOwnTask(c, c.Param("taskId")); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	deliveries, err := GetTaskWebhookDeliveries(c.Param("taskId"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, deliveries)
+}
+
+func init() {
+	go deliverWebhooks()
+}
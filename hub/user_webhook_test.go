@@ -0,0 +1,55 @@
+package hub
+
+import (
+	"cotelligence-model-hub/db"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestUpdateUnclaimedDeliveryLeavesClaimedDelivery(t *testing.T) {
+	now := time.Now()
+	delivery := WebhookDelivery{
+		ID:            uuid.NewString(),
+		TaskID:        uuid.NewString(),
+		URL:           "https://example.com/webhook",
+		Event:         WebhookEventOutput,
+		Payload:       `{"output":"a"}`,
+		Status:        DeliveryPending,
+		CreatedAt:     now,
+		NextAttemptAt: now.Add(webhookThrottleInterval),
+	}
+	if err := enqueueWebhookDelivery(delivery); err != nil {
+		t.Fatalf("enqueueWebhookDelivery() = %v", err)
+	}
+	// a worker claims the delivery the way deliverWebhooks does once it is due
+	client := db.GetRedisClient()
+	claimed, err := claimWebhookScript.Run(ctx, client, []string{webhookQueueKey},
+		delivery.ID, now.Add(webhookThrottleInterval).Unix(), now.Add(webhookClaimLease).Unix()).Int()
+	if err != nil || claimed != 1 {
+		t.Fatalf("claim = %d, %v, want the delivery claimed", claimed, err)
+	}
+
+	folded := delivery
+	folded.Payload = `{"output":"ab"}`
+	if updated, err := updateUnclaimedDelivery(folded, false); err != nil || updated {
+		t.Errorf("updateUnclaimedDelivery() = %v, %v, want the claimed delivery left alone", updated, err)
+	}
+	skipped := delivery
+	skipped.Status = DeliverySkipped
+	if updated, err := updateUnclaimedDelivery(skipped, true); err != nil || updated {
+		t.Errorf("updateUnclaimedDelivery() dequeuing = %v, %v, want the claimed delivery left alone", updated, err)
+	}
+
+	stored, err := GetWebhookDelivery(delivery.ID)
+	if err != nil {
+		t.Fatalf("GetWebhookDelivery() = %v", err)
+	}
+	if stored.Payload != delivery.Payload || stored.Status != DeliveryPending {
+		t.Errorf("stored delivery = %s, %s, want it as the worker claimed it", stored.Status, stored.Payload)
+	}
+	if _, err := client.ZScore(ctx, webhookQueueKey, delivery.ID).Result(); err != nil {
+		t.Errorf("ZScore() = %v, want the claimed delivery still queued", err)
+	}
+}
@@ -0,0 +1,429 @@
+package hub
+
+import (
+	"cotelligence-model-hub/db"
+	"cotelligence-model-hub/log"
+	"cotelligence-model-hub/openapi"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+// HardwareProfile is the GPU the pods of a version are created with, zero values fall back to DefaultGpuTypeId and
+// DefaultGpuCount
+type HardwareProfile struct {
+	GpuTypeId string `json:"gpu_type_id,omitempty"`
+	GpuCount  int    `json:"gpu_count,omitempty"`
+}
+
+func (h HardwareProfile) withDefaults() HardwareProfile {
+	if h.GpuTypeId == "" {
+		h.GpuTypeId = DefaultGpuTypeId
+	}
+	if h.GpuCount <= 0 {
+		h.GpuCount = DefaultGpuCount
+	}
+	return h
+}
+
+// ModelVersion is an immutable image of a model, predictions run on the version they were submitted to
+type ModelVersion struct {
+	Number    int    `json:"number"`
+	ModelUUID string `json:"model_uuid"`
+	ImageURL  string `json:"image_url"`
+	// Digest pins the image, pods run "<image_url>@<digest>"
+	Digest     string          `json:"digest,omitempty"`
+	Hardware   HardwareProfile `json:"hardware"`
+	CreatedAt  time.Time       `json:"created_at"`
+	SpecStatus SpecStatus      `json:"spec_status,omitempty"`
+	SpecError  string          `json:"spec_error,omitempty"`
+	// Weights are trained weights the image loads from its WeightsInput, TrainingID the training that made them
+	Weights      string `json:"weights,omitempty"`
+	WeightsInput string `json:"weights_input,omitempty"`
+	TrainingID   string `json:"training_id,omitempty"`
+}
+
+// LatestVersion pins a prediction to the latest version of the model when it is submitted
+const LatestVersion = "latest"
+
+const VersionPrefix = "cotelligence-model:version"
+const versionIndexPrefix = "cotelligence-model:versions"
+const versionSeqPrefix = "cotelligence-model:version-seq"
+
+var ErrModelVersionNotFound = errors.New("model version not found")
+
+var digestPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// imageRef is the image pods run, pinned to the digest when there is one
+func imageRef(imageURL, digest string) string {
+	if digest == "" {
+		return imageURL
+	}
+	return imageURL + "@" + digest
+}
+
+// Image is the image reference the pods of the version run
+func (v ModelVersion) Image() string {
+	return imageRef(v.ImageURL, v.Digest)
+}
+
+// specImage is the image version the spec of the version is stored under,
+// models registered before versions use their current spec
+func (v ModelVersion) specImage() string {
+	if v.Number == 0 {
+		return ""
+	}
+	return v.Image()
+}
+
+// withWeights returns the prediction input with the trained weights of the version, unless the caller chose some
+func (v ModelVersion) withWeights(input map[string]interface{}) map[string]interface{} {
+	if v.Weights == "" {
+		return input
+	}
+	weighted := make(map[string]interface{}, len(input)+1)
+	for name, value := range input {
+		weighted[name] = value
+	}
+	if _, set := weighted[v.WeightsInput]; !set {
+		weighted[v.WeightsInput] = v.Weights
+	}
+	return weighted
+}
+
+// splitImageDigest separates the digest of an "<image>@sha256:..." reference, a digest given on its own must match.
+// Tags are mutable, an image given without a digest is pinned to the digest its tag points at in the registry. The
+// images of registries the hub can not read anonymously keep their tag without a digest
+func splitImageDigest(imageURL, digest string) (string, string, error) {
+	if image, refDigest, ok := strings.Cut(imageURL, "@"); ok {
+		if digest != "" && digest != refDigest {
+			return "", "", &InvalidRequestError{Message: "digest does not match the digest of image_url"}
+		}
+		imageURL, digest = image, refDigest
+	}
+	if imageURL == "" {
+		return "", "", &InvalidRequestError{Message: "image_url is required"}
+	}
+	if digest != "" && !digestPattern.MatchString(digest) {
+		return "", "", &InvalidRequestError{Message: "digest must be sha256:<64 hex characters>"}
+	}
+	if digest == "" {
+		resolved, err := resolveImageDigest(imageURL)
+		if errors.Is(err, errRegistryDenied) {
+			log.ZapLogger.Info("Image not pinned to a digest", zap.String("image", imageURL), zap.Error(err))
+			return imageURL, "", nil
+		}
+		if err != nil {
+			return "", "", &InvalidRequestError{Message: fmt.Sprintf("digest is required, it could not be resolved from the registry: %s", err)}
+		}
+		digest = resolved
+	}
+	return imageURL, digest, nil
+}
+
+func versionKey(modelUUID string, number int) string {
+	return VersionPrefix + ":" + modelUUID + ":" + strconv.Itoa(number)
+}
+
+func saveModelVersion(version ModelVersion) error {
+	client := db.GetRedisClient()
+	pipeline := client.TxPipeline()
+	pipeline.HSet(ctx, versionKey(version.ModelUUID, version.Number), map[string]interface{}{
+		"number":        version.Number,
+		"model_uuid":    version.ModelUUID,
+		"image_url":     version.ImageURL,
+		"digest":        version.Digest,
+		"gpu_type_id":   version.Hardware.GpuTypeId,
+		"gpu_count":     version.Hardware.GpuCount,
+		"created_at":    version.CreatedAt.Format(time.RFC3339Nano),
+		"spec_status":   string(version.SpecStatus),
+		"spec_error":    version.SpecError,
+		"weights":       version.Weights,
+		"weights_input": version.WeightsInput,
+		"training_id":   version.TrainingID,
+	})
+	pipeline.ZAdd(ctx, versionIndexPrefix+":"+version.ModelUUID, &redis.Z{
+		Score:  float64(version.Number),
+		Member: version.Number,
+	})
+	_, err := pipeline.Exec(ctx)
+	return err
+}
+
+func versionFromHash(result map[string]string) ModelVersion {
+	createdAt, _ := time.Parse(time.RFC3339Nano, result["created_at"])
+	return ModelVersion{
+		Number:     atoi(result["number"]),
+		ModelUUID:  result["model_uuid"],
+		ImageURL:   result["image_url"],
+		Digest:     result["digest"],
+		Hardware:   HardwareProfile{GpuTypeId: result["gpu_type_id"], GpuCount: atoi(result["gpu_count"])},
+		CreatedAt:  createdAt,
+		SpecStatus: SpecStatus(result["spec_status"]),
+		SpecError:  result["spec_error"],
+
+		Weights:      result["weights"],
+		WeightsInput: result["weights_input"],
+		TrainingID:   result["training_id"],
+	}
+}
+
+func GetModelVersion(modelUUID string, number int) (ModelVersion, error) {
+	client := db.GetRedisClient()
+	result, err := client.HGetAll(ctx, versionKey(modelUUID, number)).Result()
+	if err != nil {
+		return ModelVersion{}, err
+	}
+	if len(result) == 0 {
+		return ModelVersion{}, ErrModelVersionNotFound
+	}
+	return versionFromHash(result), nil
+}
+
+// GetModelVersions returns the versions of the model, oldest first
+func GetModelVersions(modelUUID string) ([]ModelVersion, error) {
+	client := db.GetRedisClient()
+	numbers, err := client.ZRange(ctx, versionIndexPrefix+":"+modelUUID, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]ModelVersion, 0, len(numbers))
+	for _, number := range numbers {
+		version, err := GetModelVersion(modelUUID, atoi(number))
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
+
+// legacyVersion is the version 0 of models registered before versions, it follows the model image
+func legacyVersion(model Model) ModelVersion {
+	return ModelVersion{
+		ModelUUID:  model.UUID,
+		ImageURL:   model.ImageURL,
+		Digest:     model.Digest,
+		Hardware:   model.Hardware,
+		SpecStatus: model.SpecStatus,
+		SpecError:  model.SpecError,
+	}
+}
+
+// modelVersion returns the version of the model, 0 is its latest version
+func modelVersion(model Model, number int) (ModelVersion, error) {
+	if number == 0 {
+		number = model.LatestVersion
+	}
+	if number == 0 {
+		return legacyVersion(model), nil
+	}
+	return GetModelVersion(model.UUID, number)
+}
+
+// ResolveModelVersion turns the version requested for a prediction, a number or "latest", into the version it runs on.
+// Predictions that do not ask for a version follow the traffic policy of the model
+func ResolveModelVersion(model Model, requested interface{}) (ModelVersion, error) {
+	switch requested := requested.(type) {
+	case nil:
+		return routeModelVersion(model)
+	case float64:
+		if requested >= 1 && requested == float64(int(requested)) {
+			return modelVersion(model, int(requested))
+		}
+	case string:
+		if requested == "" || requested == LatestVersion {
+			return modelVersion(model, 0)
+		}
+		if number, err := strconv.Atoi(requested); err == nil && number >= 1 {
+			return modelVersion(model, number)
+		}
+	}
+	return ModelVersion{}, &InvalidRequestError{Message: fmt.Sprintf("version must be a version number or %q", LatestVersion)}
+}
+
+// CreateModelVersion records a new version of the model unless its latest version already runs the same image on the
+// same hardware, the image and hardware of a version never change. It reports whether a version was created
+func CreateModelVersion(model Model, imageURL, digest string, hardware HardwareProfile) (ModelVersion, bool, error) {
+	imageURL, digest, err := splitImageDigest(imageURL, digest)
+	if err != nil {
+		return ModelVersion{}, false, err
+	}
+	if err := checkImageContract(model, imageRef(imageURL, digest)); err != nil {
+		return ModelVersion{}, false, err
+	}
+	if model.LatestVersion > 0 {
+		latest, err := GetModelVersion(model.UUID, model.LatestVersion)
+		if err != nil && !errors.Is(err, ErrModelVersionNotFound) {
+			return ModelVersion{}, false, err
+		}
+		// a trained latest version is not the plain image
+		if err == nil && latest.ImageURL == imageURL && latest.Digest == digest && latest.Hardware == hardware && latest.Weights == "" {
+			return latest, false, nil
+		}
+	}
+
+	version, err := addModelVersion(ModelVersion{ModelUUID: model.UUID, ImageURL: imageURL, Digest: digest, Hardware: hardware})
+	return version, err == nil, err
+}
+
+// addModelVersion records the version under the next number of its model, its spec is still to be discovered
+func addModelVersion(version ModelVersion) (ModelVersion, error) {
+	client := db.GetRedisClient()
+	number, err := client.Incr(ctx, versionSeqPrefix+":"+version.ModelUUID).Result()
+	if err != nil {
+		return ModelVersion{}, err
+	}
+	version.Number = int(number)
+	version.CreatedAt = time.Now()
+	version.SpecStatus = SpecPending
+	return version, saveModelVersion(version)
+}
+
+// setLatestVersion makes the version the one "latest" predictions run on, the model mirrors its image and hardware
+func setLatestVersion(model *Model, version ModelVersion) {
+	model.LatestVersion = version.Number
+	model.ImageURL = version.ImageURL
+	model.Digest = version.Digest
+	model.Hardware = version.Hardware
+}
+
+// PublishModelVersion creates a version of the model from the image and makes it the latest one,
+// predictions already submitted keep the version they were pinned to
+func PublishModelVersion(model Model, imageURL, digest string, hardware HardwareProfile) (ModelVersion, error) {
+	version, created, err := CreateModelVersion(model, imageURL, digest, hardware)
+	if err != nil {
+		return ModelVersion{}, err
+	}
+	return version, makeLatestVersion(model, version, created)
+}
+
+// makeLatestVersion points the model at the version, discovering its spec unless it is already known
+func makeLatestVersion(model Model, version ModelVersion, created bool) error {
+	setLatestVersion(&model, version)
+	client := db.GetRedisClient()
+	err := client.HSet(ctx, ModelPrefix+":"+model.UUID,
+		"latest_version", model.LatestVersion,
+		"image_url", model.ImageURL,
+		"digest", model.Digest,
+		"gpu_type_id", model.Hardware.GpuTypeId,
+		"gpu_count", model.Hardware.GpuCount,
+		"spec_status", string(version.SpecStatus),
+		"spec_error", version.SpecError).Err()
+	if err != nil {
+		return err
+	}
+	if created || version.SpecStatus != SpecReady {
+		discoverModelSpecAsync(model, version, false)
+		return nil
+	}
+	// the spec of the version is already known, make it the current one again
+	return useVersionSpec(model, version)
+}
+
+// parseVersionParam reads the :version route parameter, a number or "latest"
+func parseVersionParam(c *gin.Context, model Model) (ModelVersion, bool) {
+	version, err := ResolveModelVersion(model, c.Param("version"))
+	var invalidRequestError *InvalidRequestError
+	if errors.As(err, &invalidRequestError) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return ModelVersion{}, false
+	}
+	if errors.Is(err, ErrModelVersionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return ModelVersion{}, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return ModelVersion{}, false
+	}
+	return version, true
+}
+
+// getVisibleModel returns the model of the :modelUUID route parameter, models the caller can not see are not found
+// and deleted models are gone
+func getVisibleModel(c *gin.Context) (Model, bool) {
+	model, ok := GetModel(c.Param("modelUUID"))
+	if !ok || !currentAPIKey(c).CanSeeModel(model) {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrModelNotFound.Error()})
+		return Model{}, false
+	}
+	if model.IsDeleted() {
+		c.JSON(http.StatusGone, gin.H{"error": ErrModelDeleted.Error(), "deleted_at": model.DeletedAt})
+		return Model{}, false
+	}
+	return model, true
+}
+
+func listModelVersionsHandler(c *gin.Context) {
+	model, ok := getVisibleModel(c)
+	if !ok {
+		return
+	}
+
+	versions, err := GetModelVersions(model.UUID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(versions) == 0 {
+		versions = append(versions, legacyVersion(model))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"latest_version": model.LatestVersion, "versions": versions})
+}
+
+func getModelVersionHandler(c *gin.Context) {
+	model, ok := getVisibleModel(c)
+	if !ok {
+		return
+	}
+	version, ok := parseVersionParam(c, model)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, version)
+}
+
+func createModelVersionHandler(c *gin.Context) {
+	model, ok := getManagedModel(c)
+	if !ok {
+		return
+	}
+	var body struct {
+		ImageURL string          `json:"image_url" binding:"required"`
+		Digest   string          `json:"digest"`
+		Hardware HardwareProfile `json:"hardware"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	version, err := PublishModelVersion(model, body.ImageURL, body.Digest, body.Hardware)
+	var invalidRequestError *InvalidRequestError
+	if errors.As(err, &invalidRequestError) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var contractError *openapi.ContractError
+	if errors.As(err, &contractError) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "violations": contractError.Violations})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, version)
+}
@@ -1,157 +1,280 @@
 package hub
 
 import (
+	"context"
+	"cotelligence-model-hub/db"
 	"cotelligence-model-hub/log"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
 )
 
 type TaskStatus string
 
 const (
+	Starting   TaskStatus = "starting"
 	Processing TaskStatus = "processing"
 	Succeeded  TaskStatus = "succeeded"
+	Failed     TaskStatus = "failed"
+	Canceled   TaskStatus = "canceled"
 )
 
+// IsTerminal reports whether no more events will be sent for the task
+func (s TaskStatus) IsTerminal() bool {
+	return s == Succeeded || s == Failed || s == Canceled
+}
+
+// WebhookEvent is the cog webhook event type used in webhook_events_filter
+// ref: https://github.com/replicate/cog/blob/main/docs/http.md#webhooks
+type WebhookEvent string
+
+const (
+	WebhookEventStart     WebhookEvent = "start"
+	WebhookEventOutput    WebhookEvent = "output"
+	WebhookEventLogs      WebhookEvent = "logs"
+	WebhookEventCompleted WebhookEvent = "completed"
+)
+
+var AllWebhookEvents = []WebhookEvent{WebhookEventStart, WebhookEventOutput, WebhookEventLogs, WebhookEventCompleted}
+
+// TaskData holds the accumulated stream state of a task, readers keep their own cursors
 type TaskData struct {
 	TaskId string     `json:"taskId"`
 	Data   []string   `json:"data"`
+	Logs   string     `json:"logs"`
+	Error  string     `json:"error,omitempty"`
 	Status TaskStatus `json:"status"`
 }
 
+// EventData is the prediction payload cog posts to the webhook, output and logs are cumulative
 type EventData struct {
-	Output []string   `json:"output"`
-	Status TaskStatus `json:"status"`
+	ID          string                 `json:"id"`
+	Output      interface{}            `json:"output"`
+	Logs        string                 `json:"logs"`
+	Error       interface{}            `json:"error"`
+	Status      TaskStatus             `json:"status"`
+	Metrics     map[string]interface{} `json:"metrics"`
+	StartedAt   string                 `json:"started_at"`
+	CompletedAt string                 `json:"completed_at"`
 }
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+// ErrorMessage returns the error of the event as a string
+func (e EventData) ErrorMessage() string {
+	switch v := e.Error.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+// outputChunks converts a cog output into the list of stream chunks
+func outputChunks(output interface{}) []string {
+	switch v := output.(type) {
+	case nil:
+		return nil
+	case string:
+		return []string{v}
+	case []interface{}:
+		chunks := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				chunks = append(chunks, s)
+			} else {
+				b, _ := json.Marshal(item)
+				chunks = append(chunks, string(b))
+			}
+		}
+		return chunks
+	default:
+		b, _ := json.Marshal(v)
+		return []string{string(b)}
+	}
 }
 
-var taskDataBuffer = &sync.Map{} // Change this line
+const taskDataRetention = 1 * time.Minute
+
+var taskDataBuffer = &sync.Map{}
+
+// storeTaskData updates the stream buffer of a task from a cog prediction payload
+func storeTaskData(taskId string, eventData EventData) {
+	taskData := TaskData{
+		TaskId: taskId,
+		Data:   outputChunks(eventData.Output),
+		Logs:   eventData.Logs,
+		Error:  eventData.ErrorMessage(),
+		Status: eventData.Status,
+	}
+	if taskData.Status == Canceled && taskData.Error == "" {
+		taskData.Error = "prediction canceled"
+	}
+	taskDataBuffer.Store(taskId, taskData)
+	if taskData.Status.IsTerminal() {
+		// keep the final state for late readers for a while
+		time.AfterFunc(taskDataRetention, func() {
+			taskDataBuffer.Delete(taskId)
+		})
+	}
+}
 
 func WebhookHandler(c *gin.Context) {
 	taskId := c.Param("taskId")
+	// only the pod the task was sent to knows the token of its webhook url
+	token, err := db.GetRedisClient().HGet(ctx, taskPrefix+taskId, "WebhookToken").Result()
+	if err != nil || !validWebhookToken(token, c.Query("token")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrTaskNotFound.Error()})
+		return
+	}
 
+	rawBody, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON body"})
+		return
+	}
 	var eventData EventData
-	if err := c.ShouldBindJSON(&eventData); err != nil {
+	var payload map[string]interface{}
+	if err := json.Unmarshal(rawBody, &eventData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON body"})
+		return
+	}
+	if err := json.Unmarshal(rawBody, &payload); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON body"})
 		return
 	}
 
 	switch eventData.Status {
-	case Processing:
-		// Update the task data
-		log.ZapLogger.Debug("Received output from the task", zap.String("taskId", taskId), zap.Strings("data", eventData.Output))
-		taskDataBuffer.Store(taskId, TaskData{TaskId: taskId, Data: eventData.Output, Status: "processing"})
-	case Succeeded:
-		taskDataBuffer.Store(taskId, TaskData{TaskId: taskId, Data: eventData.Output, Status: "succeeded"})
+	case Starting, Processing, Succeeded, Failed, Canceled:
+		log.ZapLogger.Debug("Received event from the task", zap.String("taskId", taskId), zap.String("status", string(eventData.Status)))
 	default:
-		log.ZapLogger.Info("Invalid status in the request")
+		log.ZapLogger.Info("Invalid status in the request", zap.String("taskId", taskId), zap.String("status", string(eventData.Status)))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status"})
 		return
 	}
-}
 
-func WebSocketHandler(c *gin.Context) {
-	// Upgrade the HTTP connection to a WebSocket connection
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	err = RecordTaskEvent(taskId, eventData, payload)
+	if errors.Is(err, ErrTaskCompleted) {
+		// the task was completed by the hub, like a cancellation before it reached the pod
+		log.ZapLogger.Debug("Ignored event of a completed task", zap.String("taskId", taskId))
+		c.Status(http.StatusOK)
+		return
+	}
 	if err != nil {
-		http.Error(c.Writer, "Could not open websocket connection", http.StatusBadRequest)
+		log.ZapLogger.Error("Failed to record task event", zap.String("taskId", taskId), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	storeTaskData(taskId, eventData)
+	c.Status(http.StatusOK)
+}
 
-	// Retrieve the taskId from the URL parameters
-	taskId := c.Param("taskId")
-	// Create a ticker that ticks every 400 milliseconds
-	ticker := time.NewTicker(400 * time.Millisecond)
-	defer ticker.Stop()
+// loadTaskData returns the stream state of a task, falling back to the stored task once it left the buffer
+func loadTaskData(taskId string) (TaskData, bool) {
+	if value, ok := taskDataBuffer.Load(taskId); ok {
+		return value.(TaskData), true
+	}
+	task, err := GetTask(taskId)
+	if err != nil || task.ModelId == "" || !task.Status.IsTerminal() {
+		return TaskData{}, false
+	}
+	return TaskData{
+		TaskId: taskId,
+		Data:   outputChunks(task.Response["output"]),
+		Logs:   task.Logs,
+		Error:  task.Error,
+		Status: task.Status,
+	}, true
+}
 
-	for range ticker.C {
-		// Retrieve the data associated with the taskId from the taskDataBuffer
-		value, ok := taskDataBuffer.Load(taskId)
-		if !ok {
-			http.Error(c.Writer, "Task not found", http.StatusNotFound)
-			conn.Close()
-		}
-		task := value.(TaskData)
+// wantsEventStream reports whether the caller asked for an SSE response
+func wantsEventStream(c *gin.Context) bool {
+	return strings.Contains(c.GetHeader("Accept"), "text/event-stream")
+}
 
-		// Join all the strings in the data slice into a single string
-		dataStr := strings.Join(task.Data, "")
-		if dataStr == "" {
-			continue
-		}
-		// remove data from the buffer
-		taskDataBuffer.Store(taskId, TaskData{TaskId: taskId, Data: nil, Status: task.Status})
-
-		// Write the data to the WebSocket connection
-		err = conn.WriteMessage(websocket.TextMessage, []byte(dataStr))
-		if err != nil {
-			log.ZapLogger.Error("Failed to write message to websocket", zap.Error(err))
-			conn.Close()
-		}
-		// close the connection if the task has succeeded
-		if task.Status == Succeeded {
-			err = conn.Close()
-			// remove task from buffer
-			taskDataBuffer.Delete(taskId)
-			return
-		}
-		// Sleep for a while before checking for updates again
-		time.Sleep(400 * time.Millisecond)
+func SSEHandler(c *gin.Context) {
+	if _, err := getOwnTask(c, c.Param("taskId")); err != nil {
+		http.Error(c.Writer, "Task not found", http.StatusNotFound)
+		return
 	}
+	streamTaskEvents(c, c.Param("taskId"))
 }
 
-func SSEHandler(c *gin.Context) {
+// streamTaskEvents writes the outputs and logs of a task to the response as server-sent events until it is done
+func streamTaskEvents(c *gin.Context, taskId string) {
 	// Upgrade the HTTP connection to an SSE connection
 	c.Writer.Header().Set("Content-Type", "text/event-stream")
 	c.Writer.Header().Set("Cache-Control", "no-cache")
 	c.Writer.Header().Set("Connection", "keep-alive")
 	c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+	c.Writer.Header().Set("X-Task-Id", taskId)
 
-	// Retrieve the taskId from the URL parameters
-	taskId := c.Param("taskId")
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		log.ZapLogger.Error("Expected http.ResponseWriter to be an http.Flusher")
+		return
+	}
+
+	err := watchTaskData(c.Request.Context(), taskId, func(task TaskData, chunks []string, logs string) {
+		// Write the new logs as a separate event type
+		if logs != "" {
+			c.SSEvent("log", logs)
+		}
+		// Join all the new strings in the data slice into a single string
+		if dataStr := strings.Join(chunks, ""); dataStr != "" {
+			c.SSEvent("message", dataStr)
+		}
+		// close the connection if the task failed or was canceled
+		if task.Status == Failed || task.Status == Canceled {
+			c.SSEvent("error", task.Error)
+		}
+		flusher.Flush()
+	})
+	if errors.Is(err, ErrTaskNotFound) {
+		http.Error(c.Writer, "Task not found", http.StatusNotFound)
+	}
+}
+
+// watchTaskData polls the stream of a task and passes the new output chunks and logs to onUpdate until the task is done
+func watchTaskData(ctx context.Context, taskId string, onUpdate func(task TaskData, chunks []string, logs string)) error {
 	// Create a ticker that ticks every 400 milliseconds
 	ticker := time.NewTicker(400 * time.Millisecond)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		// Retrieve the data associated with the taskId from the taskDataBuffer
-		value, ok := taskDataBuffer.Load(taskId)
-
+	// cursors of the output chunks and logs already sent
+	sent, logsSent := 0, 0
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		// Retrieve the data associated with the taskId
+		task, ok := loadTaskData(taskId)
 		if !ok {
-			http.Error(c.Writer, "Task not found", http.StatusNotFound)
-			return
+			return ErrTaskNotFound
 		}
-		task := value.(TaskData)
 
-		// Join all the strings in the data slice into a single string
-		dataStr := strings.Join(task.Data, "")
-		if dataStr == "" {
-			continue
+		var chunks []string
+		var logs string
+		if logsSent < len(task.Logs) {
+			logs = task.Logs[logsSent:]
+			logsSent = len(task.Logs)
 		}
-		// Write the data to the SSE connection
-		c.SSEvent("message", dataStr)
-		// Flush the response writer
-		if flusher, ok := c.Writer.(http.Flusher); ok {
-			flusher.Flush()
-		} else {
-			log.ZapLogger.Error("Expected http.ResponseWriter to be an http.Flusher")
-			return
+		if sent < len(task.Data) {
+			chunks = task.Data[sent:]
+			sent = len(task.Data)
 		}
-		// remove data from the buffer
-		taskDataBuffer.Store(taskId, TaskData{TaskId: taskId, Data: nil, Status: task.Status})
-		// close the connection if the task has succeeded
-		if task.Status == Succeeded {
-			// remove task from buffer
-			taskDataBuffer.Delete(taskId)
-			return
+		onUpdate(task, chunks, logs)
+		if task.Status.IsTerminal() {
+			return nil
 		}
 	}
 }
@@ -0,0 +1,269 @@
+package hub
+
+import (
+	"cotelligence-model-hub/log"
+	"cotelligence-model-hub/openapi"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// WsMessageType is the type of the JSON frames exchanged over a websocket session
+type WsMessageType string
+
+const (
+	// client messages
+	WsSubscribe   WsMessageType = "subscribe"
+	WsUnsubscribe WsMessageType = "unsubscribe"
+	WsPredict     WsMessageType = "predict"
+	WsCancel      WsMessageType = "cancel"
+	WsPing        WsMessageType = "ping"
+	// server frames
+	WsOutput WsMessageType = "output"
+	WsLog    WsMessageType = "log"
+	WsStatus WsMessageType = "status"
+	WsError  WsMessageType = "error"
+	WsPong   WsMessageType = "pong"
+)
+
+// WsClientMessage is a message sent by the client, RequestId is echoed back on the frames it causes
+type WsClientMessage struct {
+	Type      WsMessageType          `json:"type"`
+	TaskId    string                 `json:"task_id,omitempty"`
+	ModelUUID string                 `json:"model_uuid,omitempty"`
+	Input     map[string]interface{} `json:"input,omitempty"`
+	RequestId string                 `json:"request_id,omitempty"`
+	// malformed is set when the message is not valid JSON, the session answers it with an error frame
+	malformed error
+}
+
+// WsFrame is a frame sent by the server
+type WsFrame struct {
+	Type   WsMessageType `json:"type"`
+	TaskId string        `json:"task_id,omitempty"`
+	Data   string        `json:"data,omitempty"`
+	Status TaskStatus    `json:"status,omitempty"`
+	Error  string        `json:"error,omitempty"`
+	// Violations lists the invalid fields when a predict message has an invalid input
+	Violations []openapi.InputViolation `json:"violations,omitempty"`
+	RequestId  string                   `json:"request_id,omitempty"`
+}
+
+const (
+	wsPollInterval = 400 * time.Millisecond
+	wsPingInterval = 30 * time.Second
+	wsPongWait     = 60 * time.Second
+	wsWriteWait    = 10 * time.Second
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// wsSubscription keeps the cursors of what has been sent for a task
+type wsSubscription struct {
+	sent     int
+	logsSent int
+	status   TaskStatus
+}
+
+type wsSession struct {
+	conn          *websocket.Conn
+	apiKey        APIKey
+	subscriptions map[string]*wsSubscription
+}
+
+func (s *wsSession) write(frame WsFrame) error {
+	_ = s.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return s.conn.WriteJSON(frame)
+}
+
+func (s *wsSession) subscribe(taskId, requestId string) error {
+	if _, ok := s.subscriptions[taskId]; ok {
+		return nil
+	}
+	if task, err := GetTask(taskId); err != nil || task.ModelId == "" || !s.apiKey.CanAccessTask(task) {
+		return s.write(WsFrame{Type: WsError, TaskId: taskId, Error: ErrTaskNotFound.Error(), RequestId: requestId})
+	}
+	s.subscriptions[taskId] = &wsSubscription{}
+	return nil
+}
+
+func (s *wsSession) handleMessage(msg WsClientMessage) error {
+	if msg.malformed != nil {
+		return s.write(WsFrame{Type: WsError, Error: "malformed message: " + msg.malformed.Error()})
+	}
+	switch msg.Type {
+	case WsSubscribe:
+		return s.subscribe(msg.TaskId, msg.RequestId)
+	case WsUnsubscribe:
+		delete(s.subscriptions, msg.TaskId)
+		return nil
+	case WsPredict:
+		if !s.apiKey.HasScope(ScopePredict) {
+			return s.write(WsFrame{Type: WsError, Error: "api key lacks the predict scope", RequestId: msg.RequestId})
+		}
+		body := map[string]interface{}{"input": msg.Input, "stream": true}
+		taskId, err := SubmitPrediction(s.apiKey, msg.ModelUUID, body)
+		if err != nil {
+			frame := WsFrame{Type: WsError, Error: err.Error(), RequestId: msg.RequestId}
+			var inputValidationError *InputValidationError
+			if errors.As(err, &inputValidationError) {
+				frame.Violations = inputValidationError.Violations
+			}
+			return s.write(frame)
+		}
+		if err := s.write(WsFrame{Type: WsStatus, TaskId: taskId, Status: Starting, RequestId: msg.RequestId}); err != nil {
+			return err
+		}
+		return s.subscribe(taskId, msg.RequestId)
+	case WsCancel:
+		if !s.apiKey.HasScope(ScopePredict) {
+			return s.write(WsFrame{Type: WsError, TaskId: msg.TaskId, Error: "api key lacks the predict scope", RequestId: msg.RequestId})
+		}
+		if task, err := GetTask(msg.TaskId); err != nil || !s.apiKey.CanAccessTask(task) {
+			return s.write(WsFrame{Type: WsError, TaskId: msg.TaskId, Error: ErrTaskNotFound.Error(), RequestId: msg.RequestId})
+		}
+		if err := CancelTask(msg.TaskId); err != nil {
+			return s.write(WsFrame{Type: WsError, TaskId: msg.TaskId, Error: err.Error(), RequestId: msg.RequestId})
+		}
+		return nil
+	case WsPing:
+		return s.write(WsFrame{Type: WsPong, RequestId: msg.RequestId})
+	default:
+		return s.write(WsFrame{Type: WsError, Error: "unknown message type: " + string(msg.Type), RequestId: msg.RequestId})
+	}
+}
+
+// flush writes the new outputs, logs and status changes of every subscribed task
+func (s *wsSession) flush() error {
+	for taskId, sub := range s.subscriptions {
+		task, ok := loadTaskData(taskId)
+		if !ok {
+			// tasks that do not stream, or whose stream data expired, report their status from the task itself
+			stored, err := GetTask(taskId)
+			if err != nil || stored.ModelId == "" {
+				delete(s.subscriptions, taskId)
+				if err := s.write(WsFrame{Type: WsError, TaskId: taskId, Error: ErrTaskNotFound.Error()}); err != nil {
+					return err
+				}
+				continue
+			}
+			task = TaskData{TaskId: taskId, Logs: stored.Logs, Error: stored.Error, Status: stored.Status}
+		}
+		if sub.logsSent < len(task.Logs) {
+			if err := s.write(WsFrame{Type: WsLog, TaskId: taskId, Data: task.Logs[sub.logsSent:]}); err != nil {
+				return err
+			}
+			sub.logsSent = len(task.Logs)
+		}
+		if sub.sent < len(task.Data) {
+			if dataStr := strings.Join(task.Data[sub.sent:], ""); dataStr != "" {
+				if err := s.write(WsFrame{Type: WsOutput, TaskId: taskId, Data: dataStr}); err != nil {
+					return err
+				}
+			}
+			sub.sent = len(task.Data)
+		}
+		if sub.status != task.Status {
+			frame := WsFrame{Type: WsStatus, TaskId: taskId, Status: task.Status}
+			if task.Status == Failed || task.Status == Canceled {
+				frame.Error = task.Error
+			}
+			if err := s.write(frame); err != nil {
+				return err
+			}
+			sub.status = task.Status
+		}
+		if task.Status.IsTerminal() {
+			delete(s.subscriptions, taskId)
+		}
+	}
+	return nil
+}
+
+// readMessages forwards client messages until the connection is closed or stops answering pings, malformed messages
+// are forwarded too so the session answers them without closing
+func (s *wsSession) readMessages(messages chan<- WsClientMessage, done <-chan struct{}) {
+	defer close(messages)
+	_ = s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			var closeError *websocket.CloseError
+			if !errors.As(err, &closeError) {
+				log.ZapLogger.Info("Websocket connection lost", zap.Error(err))
+			}
+			return
+		}
+		// any client message proves the connection is alive
+		_ = s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		var msg WsClientMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			msg = WsClientMessage{malformed: err}
+		}
+		select {
+		case messages <- msg:
+		case <-done:
+			return
+		}
+	}
+}
+
+// WebSocketHandler serves a session where clients subscribe to tasks, submit predictions and cancel them
+func WebSocketHandler(c *gin.Context) {
+	// Upgrade the HTTP connection to a WebSocket connection
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		http.Error(c.Writer, "Could not open websocket connection", http.StatusBadRequest)
+		return
+	}
+	defer conn.Close()
+
+	session := &wsSession{conn: conn, apiKey: currentAPIKey(c), subscriptions: make(map[string]*wsSubscription)}
+	// Subscribe to the task in the URL, if any
+	if taskId := c.Param("taskId"); taskId != "" {
+		if err := session.subscribe(taskId, ""); err != nil {
+			return
+		}
+	}
+
+	messages := make(chan WsClientMessage)
+	done := make(chan struct{})
+	defer close(done)
+	go session.readMessages(messages, done)
+
+	pollTicker := time.NewTicker(wsPollInterval)
+	defer pollTicker.Stop()
+	pingTicker := time.NewTicker(wsPingInterval)
+	defer pingTicker.Stop()
+
+	// All writes happen in this loop
+	for {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			err = session.handleMessage(msg)
+		case <-pollTicker.C:
+			err = session.flush()
+		case <-pingTicker.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+		}
+		if err != nil {
+			log.ZapLogger.Error("Failed to write message to websocket", zap.Error(err))
+			return
+		}
+	}
+}
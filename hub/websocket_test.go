@@ -0,0 +1,71 @@
+package hub
+
+import (
+	"cotelligence-model-hub/db"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+func TestWsFlushWithoutStreamData(t *testing.T) {
+	taskId := GenerateTaskID()
+	if err := RecordTask(Task{ID: taskId, ModelId: uuid.NewString(), Body: map[string]interface{}{}}); err != nil {
+		t.Fatalf("RecordTask() = %v", err)
+	}
+	if err := db.GetRedisClient().HSet(ctx, taskPrefix+taskId, "Status", string(Processing)).Err(); err != nil {
+		t.Fatalf("failed to start the task: %v", err)
+	}
+	expiredTaskId := GenerateTaskID()
+
+	subscriptions := make(chan map[string]*wsSubscription, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		session := &wsSession{conn: conn, subscriptions: map[string]*wsSubscription{
+			taskId:        {},
+			expiredTaskId: {},
+		}}
+		if err := session.flush(); err != nil {
+			t.Errorf("flush() = %v", err)
+		}
+		subscriptions <- session.subscriptions
+		// wait for the client to read the frames and close
+		_, _, _ = conn.ReadMessage()
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial() = %v", err)
+	}
+	defer conn.Close()
+	frames := make(map[string]WsFrame)
+	for i := 0; i < 2; i++ {
+		var frame WsFrame
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatalf("ReadJSON() = %v", err)
+		}
+		frames[frame.TaskId] = frame
+	}
+
+	if frame := frames[taskId]; frame.Type != WsStatus || frame.Status != Processing {
+		t.Errorf("frame of the running task = %+v, want its processing status", frame)
+	}
+	if frame := frames[expiredTaskId]; frame.Type != WsError || frame.Error != ErrTaskNotFound.Error() {
+		t.Errorf("frame of the expired task = %+v, want a task not found error", frame)
+	}
+	remaining := <-subscriptions
+	if _, ok := remaining[expiredTaskId]; ok {
+		t.Errorf("the expired task is still subscribed")
+	}
+	if _, ok := remaining[taskId]; !ok {
+		t.Errorf("the running task is no longer subscribed")
+	}
+}
@@ -0,0 +1,222 @@
+package openapi
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+// ValueKind is the shape of a contract input or output
+type ValueKind string
+
+const (
+	// KindText is a string, a list of strings joined together, or an object with a text or transcription string
+	KindText ValueKind = "text"
+	// KindFile is a file url, or a list of them
+	KindFile ValueKind = "file"
+	// KindEmbedding is a vector of numbers, or a list of them
+	KindEmbedding ValueKind = "embedding"
+	// KindWeights is an object with the url of trained weights
+	KindWeights ValueKind = "weights"
+)
+
+// ContractInput is an input every model of a type takes
+type ContractInput struct {
+	// Names are the cog input names accepted for the input, any input of the kind matches when there is none
+	Names []string  `json:"names,omitempty"`
+	Kind  ValueKind `json:"kind"`
+}
+
+// Contract is the canonical input and output of a model type, checked against the cog schemas of the model
+type Contract struct {
+	InputSchema  string          `json:"input_schema"`
+	Inputs       []ContractInput `json:"inputs"`
+	OutputSchema string          `json:"output_schema"`
+	Output       ValueKind       `json:"output"`
+}
+
+// ContractError lists how the spec of a model breaks the contract of its type
+type ContractError struct {
+	Violations []string
+}
+
+func (e *ContractError) Error() string {
+	return "spec does not match the model type contract: " + strings.Join(e.Violations, "; ")
+}
+
+// textProperties and the other property names hold the value of object outputs
+var (
+	textProperties      = []string{"text", "transcription"}
+	embeddingProperties = []string{"embedding", "embeddings"}
+	weightsProperties   = []string{"weights"}
+)
+
+// resolveSchema flattens the schema and picks the first non null variant of an anyOf/oneOf
+func resolveSchema(schemaRef *openapi3.SchemaRef) *openapi3.Schema {
+	schema := flattenSchema(schemaRef)
+	for _, variants := range []openapi3.SchemaRefs{schema.AnyOf, schema.OneOf} {
+		if variant := firstVariant(variants); variant != nil {
+			return resolveSchema(variant)
+		}
+	}
+	return schema
+}
+
+func isFileSchema(schema *openapi3.Schema) bool {
+	return schema.Type == "string" && (schema.Format == "uri" || schema.Format == "url")
+}
+
+func isTextSchema(schema *openapi3.Schema) bool {
+	return schema.Type == "string" && !isFileSchema(schema)
+}
+
+func isNumberSchema(schema *openapi3.Schema) bool {
+	return schema.Type == "number" || schema.Type == "integer"
+}
+
+// itemSchema is the schema of the items of an array schema
+func itemSchema(schema *openapi3.Schema) *openapi3.Schema {
+	if schema.Type != "array" {
+		return nil
+	}
+	return resolveSchema(schema.Items)
+}
+
+// propertySchema is the schema of the first of the properties the object schema declares
+func propertySchema(schema *openapi3.Schema, names []string) *openapi3.Schema {
+	for _, name := range names {
+		if property, ok := schema.Properties[name]; ok {
+			return resolveSchema(property)
+		}
+	}
+	return nil
+}
+
+// matchesInput reports whether an input schema has the kind
+func matchesInput(schema *openapi3.Schema, kind ValueKind) bool {
+	switch kind {
+	case KindText:
+		return isTextSchema(schema)
+	case KindFile:
+		return isFileSchema(schema)
+	default:
+		return false
+	}
+}
+
+// matchesOutput reports whether an output schema has the kind
+func matchesOutput(schema *openapi3.Schema, kind ValueKind) bool {
+	if schema == nil {
+		return false
+	}
+	switch kind {
+	case KindText:
+		if isTextSchema(schema) {
+			return true
+		}
+		if items := itemSchema(schema); items != nil {
+			return isTextSchema(items)
+		}
+		return matchesOutput(propertySchema(schema, textProperties), KindText)
+	case KindFile:
+		if isFileSchema(schema) {
+			return true
+		}
+		if items := itemSchema(schema); items != nil {
+			return isFileSchema(items)
+		}
+		return false
+	case KindEmbedding:
+		if items := itemSchema(schema); items != nil {
+			if isNumberSchema(items) {
+				return true
+			}
+			if vector := itemSchema(items); vector != nil {
+				return isNumberSchema(vector)
+			}
+			return false
+		}
+		return matchesOutput(propertySchema(schema, embeddingProperties), KindEmbedding)
+	case KindWeights:
+		weights := propertySchema(schema, weightsProperties)
+		return weights != nil && isFileSchema(weights)
+	default:
+		return false
+	}
+}
+
+// CheckContract checks the cog schemas of the model image version against the contract, every violation is reported
+func CheckContract(modelUUID, imageVersion string, contract Contract) error {
+	swagger, err := loadSpec(modelUUID, imageVersion)
+	if err != nil {
+		return err
+	}
+	return checkSpecContract(swagger, contract)
+}
+
+// CheckSpecContract checks the cog schemas of a spec that is not stored yet against the contract
+func CheckSpecContract(data []byte, contract Contract) error {
+	swagger, err := parseSpec(data)
+	if err != nil {
+		return err
+	}
+	return checkSpecContract(swagger, contract)
+}
+
+// checkSpecContract reports every violation of the contract by the cog schemas of the spec
+func checkSpecContract(swagger *openapi3.T, contract Contract) error {
+	var violations []string
+
+	inputRef, ok := swagger.Components.Schemas[contract.InputSchema]
+	if !ok || inputRef.Value == nil {
+		violations = append(violations, fmt.Sprintf("no %s schema", contract.InputSchema))
+	} else {
+		inputSchema := flattenSchema(inputRef)
+		for _, input := range contract.Inputs {
+			if !hasInput(inputSchema, input) {
+				if len(input.Names) == 0 {
+					violations = append(violations, fmt.Sprintf("%s has no %s input", contract.InputSchema, input.Kind))
+				} else {
+					violations = append(violations, fmt.Sprintf("%s has no %s input named %s",
+						contract.InputSchema, input.Kind, strings.Join(input.Names, " or ")))
+				}
+			}
+		}
+	}
+
+	outputRef, ok := swagger.Components.Schemas[contract.OutputSchema]
+	if !ok || outputRef.Value == nil {
+		violations = append(violations, fmt.Sprintf("no %s schema", contract.OutputSchema))
+	} else if !matchesOutput(resolveSchema(outputRef), contract.Output) {
+		violations = append(violations, fmt.Sprintf("%s is not a %s output", contract.OutputSchema, contract.Output))
+	}
+
+	if len(violations) > 0 {
+		return &ContractError{Violations: violations}
+	}
+	return nil
+}
+
+// hasInput reports whether the input schema declares the contract input
+func hasInput(inputSchema *openapi3.Schema, input ContractInput) bool {
+	if len(input.Names) == 0 {
+		for _, property := range inputSchema.Properties {
+			if matchesInput(resolveSchema(property), input.Kind) {
+				return true
+			}
+		}
+		return false
+	}
+	return inputName(inputSchema, input) != ""
+}
+
+// inputName is the cog input name the schema declares for the contract input, empty when it declares none
+func inputName(inputSchema *openapi3.Schema, input ContractInput) string {
+	for _, name := range input.Names {
+		if property, ok := inputSchema.Properties[name]; ok && matchesInput(resolveSchema(property), input.Kind) {
+			return name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,191 @@
+package openapi
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+// hubSpec describes the hub routes, model prediction routes are generated from the cog specs
+//
+//go:embed hub.yaml
+var hubSpec []byte
+
+const schemaRefPrefix = "#/components/schemas/"
+
+// modelTaskPaths are the hub routes added to the document of a model
+var modelTaskPaths = []string{"/task/{taskId}", "/task/{taskId}/cancel", "/task/{taskId}/webhooks", "/sse/{taskId}"}
+
+// DocumentedModel is a model described in the hub OpenAPI documents
+type DocumentedModel struct {
+	UUID string
+	Name string
+	// ImageVersion is the version of the document
+	ImageVersion string
+}
+
+func loadHubSpec() (*openapi3.T, error) {
+	doc, err := openapi3.NewLoader().LoadFromData(hubSpec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the hub OpenAPI document: %w", err)
+	}
+	return doc, nil
+}
+
+// schemaPrefix turns a model name like "acme/sdxl-lightning" into a schema name prefix like "AcmeSdxlLightning"
+func schemaPrefix(name string) string {
+	var prefix strings.Builder
+	upper := true
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		prefix.WriteRune(r)
+	}
+	return prefix.String()
+}
+
+// renameRefs prefixes the component schemas referenced by the schema, referenced schemas are renamed on their own
+func renameRefs(schemaRef *openapi3.SchemaRef, prefix string) {
+	if schemaRef == nil {
+		return
+	}
+	if schemaRef.Ref != "" {
+		if name, ok := strings.CutPrefix(schemaRef.Ref, schemaRefPrefix); ok {
+			schemaRef.Ref = schemaRefPrefix + prefix + name
+		}
+		return
+	}
+	schema := schemaRef.Value
+	if schema == nil {
+		return
+	}
+	for _, property := range schema.Properties {
+		renameRefs(property, prefix)
+	}
+	for _, refs := range []openapi3.SchemaRefs{schema.AllOf, schema.AnyOf, schema.OneOf} {
+		for _, ref := range refs {
+			renameRefs(ref, prefix)
+		}
+	}
+	renameRefs(schema.Items, prefix)
+	renameRefs(schema.Not, prefix)
+	renameRefs(schema.AdditionalProperties.Schema, prefix)
+}
+
+// withProperties copies the hub schema and replaces some of its properties
+func withProperties(schemaRef *openapi3.SchemaRef, properties map[string]*openapi3.SchemaRef) *openapi3.SchemaRef {
+	schema := *schemaRef.Value
+	schema.Properties = make(openapi3.Schemas, len(schemaRef.Value.Properties))
+	for name, property := range schemaRef.Value.Properties {
+		schema.Properties[name] = property
+	}
+	for name, property := range properties {
+		schema.Properties[name] = property
+	}
+	return openapi3.NewSchemaRef("", &schema)
+}
+
+// addModel adds the cog schemas of the model, the hub request and task wrappers around them and its prediction route
+func addModel(doc *openapi3.T, model DocumentedModel, prefix string) error {
+	spec, err := loadSpec(model.UUID, "")
+	if err != nil {
+		return err
+	}
+	for name, schemaRef := range spec.Components.Schemas {
+		if prefix != "" {
+			renameRefs(schemaRef, prefix)
+		} else if _, ok := doc.Components.Schemas[name]; ok {
+			// unprefixed cog schemas like WebhookEvent keep the hub definition
+			continue
+		}
+		doc.Components.Schemas[prefix+name] = schemaRef
+	}
+
+	ref := func(name string) *openapi3.SchemaRef {
+		return openapi3.NewSchemaRef(schemaRefPrefix+prefix+name, nil)
+	}
+	doc.Components.Schemas[prefix+"PredictionRequest"] = withProperties(doc.Components.Schemas["PredictionOptions"],
+		map[string]*openapi3.SchemaRef{"input": ref("Input")})
+	doc.Components.Schemas[prefix+"Task"] = withProperties(doc.Components.Schemas["Task"],
+		map[string]*openapi3.SchemaRef{"input": ref("Input"), "response": ref("PredictionResponse")})
+
+	// the cog /predictions route becomes the hub prediction route of the model
+	generic := doc.Paths.Value("/prediction/{modelUUID}").Post
+	result := openapi3.NewSchema()
+	result.OneOf = openapi3.SchemaRefs{ref("PredictionResponse"), openapi3.NewSchemaRef(schemaRefPrefix+"TaskAccepted", nil)}
+	responses := openapi3.NewResponsesWithCapacity(generic.Responses.Len())
+	for status, response := range generic.Responses.Map() {
+		responses.Set(status, response)
+	}
+	ok := openapi3.NewResponse().WithDescription("The prediction response when sync, the task id otherwise").
+		WithJSONSchemaRef(openapi3.NewSchemaRef("", result))
+	ok.Content["text/event-stream"] = openapi3.NewMediaType().WithSchema(openapi3.NewStringSchema())
+	responses.Set(fmt.Sprint(http.StatusOK), &openapi3.ResponseRef{Value: ok})
+
+	operation := openapi3.NewOperation()
+	operation.Tags = []string{"Predictions"}
+	operation.Summary = "Run a prediction on " + model.Name
+	operation.OperationID = "predict" + schemaPrefix(model.Name)
+	operation.Parameters = openapi3.Parameters{{Ref: "#/components/parameters/Sync"}}
+	operation.RequestBody = &openapi3.RequestBodyRef{Value: openapi3.NewRequestBody().WithRequired(true).
+		WithJSONSchemaRef(ref("PredictionRequest"))}
+	operation.Responses = responses
+	doc.Paths.Set("/prediction/"+model.UUID, &openapi3.PathItem{Post: operation})
+	return nil
+}
+
+// ModelDocument is the OpenAPI document of the prediction and task routes of the model
+func ModelDocument(model DocumentedModel, serverURL string) (*openapi3.T, error) {
+	doc, err := loadHubSpec()
+	if err != nil {
+		return nil, err
+	}
+	if err := addModel(doc, model, ""); err != nil {
+		return nil, err
+	}
+	// only the route of the model and its task routes are documented
+	paths := doc.Paths
+	doc.Paths = openapi3.NewPaths()
+	for _, path := range append(modelTaskPaths, "/prediction/"+model.UUID) {
+		doc.Paths.Set(path, paths.Value(path))
+	}
+
+	doc.Info.Title = model.Name
+	doc.Info.Version = model.ImageVersion
+	doc.Servers = openapi3.Servers{{URL: serverURL}}
+	return doc, nil
+}
+
+// HubDocument is the OpenAPI document of every hub route, with a typed prediction route per model.
+// Models without a spec keep the generic prediction route
+func HubDocument(models []DocumentedModel, serverURL string) (*openapi3.T, error) {
+	doc, err := loadHubSpec()
+	if err != nil {
+		return nil, err
+	}
+	prefixes := make(map[string]bool, len(models))
+	for _, model := range models {
+		prefix := schemaPrefix(model.Name)
+		if prefixes[prefix] {
+			prefix += schemaPrefix(model.UUID[:8])
+		}
+		prefixes[prefix] = true
+		err := addModel(doc, model, prefix)
+		if err != nil && !errors.Is(err, ErrSpecNotFound) {
+			return nil, err
+		}
+	}
+	doc.Servers = openapi3.Servers{{URL: serverURL}}
+	return doc, nil
+}
@@ -0,0 +1,161 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+// InputField is a field of a prediction input
+type InputField struct {
+	Name  string
+	Value interface{}
+}
+
+// OrderedInput is a prediction input in the x-order of the model Input schema, it marshals to a JSON object
+type OrderedInput []InputField
+
+func (in OrderedInput) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range in {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(field.Name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(field.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Map returns the input as a map, as sent to cog
+func (in OrderedInput) Map() map[string]interface{} {
+	input := make(map[string]interface{}, len(in))
+	for _, field := range in {
+		input[field.Name] = field.Value
+	}
+	return input
+}
+
+// schemaType is the type of the schema, looking into the allOf/anyOf/oneOf compositions cog uses for enums
+func schemaType(schemaRef *openapi3.SchemaRef) string {
+	if schemaRef == nil || schemaRef.Value == nil {
+		return ""
+	}
+	if schemaRef.Value.Type != "" {
+		return schemaRef.Value.Type
+	}
+	for _, refs := range []openapi3.SchemaRefs{schemaRef.Value.AllOf, schemaRef.Value.AnyOf, schemaRef.Value.OneOf} {
+		for _, ref := range refs {
+			if t := schemaType(ref); t != "" {
+				return t
+			}
+		}
+	}
+	return ""
+}
+
+// xOrder is the x-order of a cog input property, properties without one go last
+func xOrder(schemaRef *openapi3.SchemaRef) float64 {
+	if schemaRef != nil && schemaRef.Value != nil {
+		if order, ok := schemaRef.Value.Extensions["x-order"].(float64); ok {
+			return order
+		}
+	}
+	return math.MaxFloat64
+}
+
+// orderedProperties returns the property names of the schema in x-order
+func orderedProperties(schema *openapi3.Schema) []string {
+	properties := make([]string, 0, len(schema.Properties))
+	for name := range schema.Properties {
+		properties = append(properties, name)
+	}
+	sort.Slice(properties, func(i, j int) bool {
+		oi, oj := xOrder(schema.Properties[properties[i]]), xOrder(schema.Properties[properties[j]])
+		if oi != oj {
+			return oi < oj
+		}
+		return properties[i] < properties[j]
+	})
+	return properties
+}
+
+// coerceValue converts the strings sent for integer, number and boolean properties, other values are kept as is
+func coerceValue(value interface{}, valueType string) interface{} {
+	s, ok := value.(string)
+	if !ok {
+		return value
+	}
+	switch valueType {
+	case openapi3.TypeInteger:
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return float64(i)
+		}
+	case openapi3.TypeNumber:
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	case openapi3.TypeBoolean:
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b
+		}
+	}
+	return value
+}
+
+// sortedNames returns the keys of the input sorted by name
+func sortedNames(input map[string]interface{}) []string {
+	names := make([]string, 0, len(input))
+	for name := range input {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NormalizeInput returns the effective input of a prediction: schema defaults filled in, string numbers coerced and
+// fields in x-order, against the Input schema of the model. Unknown fields follow the schema fields unless
+// dropUnknown is set. Models without a spec, a nil schema, keep their input as sent, ordered by name
+func NormalizeInput(schema *openapi3.Schema, input map[string]interface{}, dropUnknown bool) OrderedInput {
+	if schema == nil {
+		normalized := make(OrderedInput, 0, len(input))
+		for _, name := range sortedNames(input) {
+			normalized = append(normalized, InputField{Name: name, Value: input[name]})
+		}
+		return normalized
+	}
+
+	properties := orderedProperties(schema)
+	normalized := make(OrderedInput, 0, len(properties))
+	for _, name := range properties {
+		property := schema.Properties[name]
+		if value, ok := input[name]; ok {
+			normalized = append(normalized, InputField{Name: name, Value: coerceValue(value, schemaType(property))})
+		} else if property.Value != nil && property.Value.Default != nil {
+			normalized = append(normalized, InputField{Name: name, Value: property.Value.Default})
+		}
+	}
+	if !dropUnknown {
+		for _, name := range sortedNames(input) {
+			if _, ok := schema.Properties[name]; !ok {
+				normalized = append(normalized, InputField{Name: name, Value: input[name]})
+			}
+		}
+	}
+	return normalized
+}
@@ -0,0 +1,83 @@
+package openapi
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeInput(t *testing.T) {
+	schema := loadTestInputSchema(t)
+	tests := []struct {
+		name        string
+		input       map[string]interface{}
+		dropUnknown bool
+		want        string
+	}{
+		{
+			name:  "defaults in x-order",
+			input: map[string]interface{}{"prompt": "a cat"},
+			want:  `{"prompt":"a cat","guidance_scale":7.5,"num_outputs":1,"scheduler":"DDIM"}`,
+		},
+		{
+			name:  "sent values win over defaults",
+			input: map[string]interface{}{"scheduler": "K_EULER", "prompt": "a cat", "seed": float64(42)},
+			want:  `{"prompt":"a cat","guidance_scale":7.5,"num_outputs":1,"scheduler":"K_EULER","seed":42}`,
+		},
+		{
+			name:  "string numbers coerced",
+			input: map[string]interface{}{"prompt": "a cat", "guidance_scale": "3.5", "num_outputs": "2", "seed": "7"},
+			want:  `{"prompt":"a cat","guidance_scale":3.5,"num_outputs":2,"scheduler":"DDIM","seed":7}`,
+		},
+		{
+			name:  "invalid strings kept for validation",
+			input: map[string]interface{}{"prompt": "a cat", "num_outputs": "two"},
+			want:  `{"prompt":"a cat","guidance_scale":7.5,"num_outputs":"two","scheduler":"DDIM"}`,
+		},
+		{
+			name:  "unknown fields last",
+			input: map[string]interface{}{"prompt": "a cat", "width": float64(512), "height": float64(512)},
+			want:  `{"prompt":"a cat","guidance_scale":7.5,"num_outputs":1,"scheduler":"DDIM","height":512,"width":512}`,
+		},
+		{
+			name:        "unknown fields dropped",
+			input:       map[string]interface{}{"prompt": "a cat", "width": float64(512)},
+			dropUnknown: true,
+			want:        `{"prompt":"a cat","guidance_scale":7.5,"num_outputs":1,"scheduler":"DDIM"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := json.Marshal(NormalizeInput(schema, tt.input, tt.dropUnknown))
+			if err != nil {
+				t.Fatalf("failed to marshal the input: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("NormalizeInput() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeInputWithoutSpec(t *testing.T) {
+	input := map[string]interface{}{"steps": "20", "prompt": "a cat"}
+	normalized := NormalizeInput(nil, input, true)
+	got, err := json.Marshal(normalized)
+	if err != nil {
+		t.Fatalf("failed to marshal the input: %v", err)
+	}
+	if want := `{"prompt":"a cat","steps":"20"}`; string(got) != want {
+		t.Errorf("NormalizeInput() without a spec = %s, want %s", got, want)
+	}
+	if !reflect.DeepEqual(normalized.Map(), input) {
+		t.Errorf("Map() = %v, want %v", normalized.Map(), input)
+	}
+}
+
+func TestNormalizedInputIsValid(t *testing.T) {
+	schema := loadTestInputSchema(t)
+	normalized := NormalizeInput(schema, map[string]interface{}{"prompt": "a cat", "num_outputs": "3"}, false)
+	if violations := ValidateInput(schema, normalized.Map()); len(violations) > 0 {
+		t.Errorf("ValidateInput() of the normalized input = %v, want none", violations)
+	}
+}
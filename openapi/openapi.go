@@ -2,148 +2,249 @@ package openapi
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
-	"os"
-	"strings"
+	"strconv"
 
 	"github.com/getkin/kin-openapi/openapi3"
 )
 
-// Helper function to resolve $ref in the schema and its properties recursively
-func resolveRefs(schemaRef *openapi3.SchemaRef, swagger *openapi3.T) *openapi3.SchemaRef {
-	for schemaRef.Ref != "" {
-		schemaKey := strings.TrimPrefix(schemaRef.Ref, "#/components/schemas/")
-		schemaRef = swagger.Components.Schemas[schemaKey]
+// loadSpec reads the cog OpenAPI spec of the model image version, an empty version is the current spec
+func loadSpec(modelUUID, imageVersion string) (*openapi3.T, error) {
+	data, err := GetImageSpec(modelUUID, imageVersion)
+	if err != nil {
+		return nil, err
+	}
+	return parseSpec(data)
+}
+
+// parseSpec unmarshals a cog OpenAPI spec
+func parseSpec(data []byte) (*openapi3.T, error) {
+	loader := openapi3.NewLoader()
+	swagger, err := loader.LoadFromData(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal OpenAPI JSON: %w", err)
+	}
+	return swagger, nil
+}
+
+// GetInputSchema returns the cog Input schema of the model image version, an empty version is the current one
+func GetInputSchema(modelUUID, imageVersion string) (*openapi3.Schema, error) {
+	return getSchema(modelUUID, imageVersion, "Input")
+}
+
+// LookupInputSchema returns the cog Input schema of the model image version, nil for models without a spec
+func LookupInputSchema(modelUUID, imageVersion string) (*openapi3.Schema, error) {
+	schema, err := GetInputSchema(modelUUID, imageVersion)
+	if errors.Is(err, ErrSpecNotFound) {
+		return nil, nil
+	}
+	return schema, err
+}
+
+// GetTrainingInputSchema returns the cog TrainingInput schema of the model image version, models that can not be
+// trained have none
+func GetTrainingInputSchema(modelUUID, imageVersion string) (*openapi3.Schema, error) {
+	return getSchema(modelUUID, imageVersion, "TrainingInput")
+}
+
+func getSchema(modelUUID, imageVersion, name string) (*openapi3.Schema, error) {
+	swagger, err := loadSpec(modelUUID, imageVersion)
+	if err != nil {
+		return nil, err
+	}
+	schemaRef, ok := swagger.Components.Schemas[name]
+	if !ok || schemaRef.Value == nil {
+		return nil, fmt.Errorf("no %s schema found for model %s", name, modelUUID)
+	}
+	return schemaRef.Value, nil
+}
+
+// maxExampleDepth stops the example generation of recursive schemas
+const maxExampleDepth = 8
+
+// flattenSchema merges the allOf parts of the schema, cog wraps enums and refs in allOf, the outer schema wins
+func flattenSchema(schemaRef *openapi3.SchemaRef) *openapi3.Schema {
+	if schemaRef == nil || schemaRef.Value == nil {
+		return &openapi3.Schema{}
+	}
+	schema := *schemaRef.Value
+	for _, part := range schemaRef.Value.AllOf {
+		partSchema := flattenSchema(part)
+		if schema.Type == "" {
+			schema.Type = partSchema.Type
+		}
+		if schema.Format == "" {
+			schema.Format = partSchema.Format
+		}
+		if schema.Title == "" {
+			schema.Title = partSchema.Title
+		}
+		if schema.Description == "" {
+			schema.Description = partSchema.Description
+		}
+		if schema.Enum == nil {
+			schema.Enum = partSchema.Enum
+		}
+		if schema.Min == nil {
+			schema.Min = partSchema.Min
+		}
+		if schema.Max == nil {
+			schema.Max = partSchema.Max
+		}
+		if schema.Items == nil {
+			schema.Items = partSchema.Items
+		}
+		if len(partSchema.Properties) > 0 {
+			properties := make(openapi3.Schemas, len(schema.Properties)+len(partSchema.Properties))
+			for name, property := range partSchema.Properties {
+				properties[name] = property
+			}
+			for name, property := range schema.Properties {
+				properties[name] = property
+			}
+			schema.Properties = properties
+			schema.Required = append(append([]string(nil), partSchema.Required...), schema.Required...)
+		}
+	}
+	schema.AllOf = nil
+	return &schema
+}
+
+// firstVariant picks the first non null variant of an anyOf/oneOf schema
+func firstVariant(variants openapi3.SchemaRefs) *openapi3.SchemaRef {
+	for _, variant := range variants {
+		if variant.Value != nil && variant.Value.Type != "null" {
+			return variant
+		}
+	}
+	return nil
+}
+
+// stringExample is a realistic value for a string of the format
+func stringExample(format string) string {
+	switch format {
+	case "uri", "url":
+		return "https://example.com/file.png"
+	case "date-time":
+		return "2024-01-01T00:00:00Z"
+	case "date":
+		return "2024-01-01"
+	case "uuid":
+		return "3fa85f64-5717-4562-b3fc-2c963f66afa6"
+	case "email":
+		return "user@example.com"
+	default:
+		return "string"
+	}
+}
+
+// exampleValue generates an example of the schema, preferring its example, then its default, then its first enum value
+func exampleValue(schemaRef *openapi3.SchemaRef, depth int) interface{} {
+	if schemaRef == nil || schemaRef.Value == nil || depth > maxExampleDepth {
+		return nil
+	}
+	schema := flattenSchema(schemaRef)
+	switch {
+	case schema.Example != nil:
+		return schema.Example
+	case schema.Default != nil:
+		return schema.Default
+	case len(schema.Enum) > 0:
+		return schema.Enum[0]
+	}
+	if schema.Type == "" {
+		if variant := firstVariant(schema.AnyOf); variant != nil {
+			return exampleValue(variant, depth+1)
+		}
+		if variant := firstVariant(schema.OneOf); variant != nil {
+			return exampleValue(variant, depth+1)
+		}
+	}
+
+	switch schema.Type {
+	case openapi3.TypeObject, "":
+		object := make(map[string]interface{}, len(schema.Properties))
+		for name, property := range schema.Properties {
+			object[name] = exampleValue(property, depth+1)
+		}
+		return object
+	case openapi3.TypeArray:
+		item := exampleValue(schema.Items, depth+1)
+		if item == nil {
+			return []interface{}{}
+		}
+		return []interface{}{item}
+	case openapi3.TypeString:
+		return stringExample(schema.Format)
+	case openapi3.TypeInteger:
+		if schema.Min != nil {
+			return int64(math.Ceil(*schema.Min))
+		}
+		if schema.Max != nil {
+			return int64(math.Floor(*schema.Max))
+		}
+		return 1
+	case openapi3.TypeNumber:
+		if schema.Min != nil && schema.Max != nil {
+			return (*schema.Min + *schema.Max) / 2
+		}
+		if schema.Min != nil {
+			return *schema.Min
+		}
+		if schema.Max != nil {
+			return *schema.Max
+		}
+		return 0.5
+	case openapi3.TypeBoolean:
+		return false
+	default:
+		return nil
 	}
-	if schemaRef.Value != nil {
-		for propertyName, property := range schemaRef.Value.Properties {
-			schemaRef.Value.Properties[propertyName] = resolveRefs(property, swagger)
+}
+
+// contentExample marshals the example of the first media type of the content
+func contentExample(content openapi3.Content) (string, error) {
+	for _, mediaType := range content {
+		example := mediaType.Example
+		if example == nil {
+			example = exampleValue(mediaType.Schema, 0)
 		}
+		if example == nil {
+			continue
+		}
+		exampleBytes, err := json.Marshal(example)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal example: %w", err)
+		}
+		return string(exampleBytes), nil
 	}
-	return schemaRef
+	return "", nil
 }
 
 func GetSampleIO(modelUUID string) (string, string, error) {
-	// Read the OpenAPI JSON file
-	data, err := os.ReadFile(fmt.Sprintf("model_spec/%s.json", modelUUID))
+	swagger, err := loadSpec(modelUUID, "")
 	if err != nil {
-		return "", "", fmt.Errorf("failed to read OpenAPI JSON file: %w", err)
+		return "", "", err
 	}
 
-	// Unmarshal the JSON into an openapi3.T object
-	loader := openapi3.NewLoader()
-	swagger, err := loader.LoadFromData(data)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to unmarshal OpenAPI JSON: %w", err)
+	pathItem := swagger.Paths.Value("/predictions")
+	if pathItem == nil || pathItem.Post == nil {
+		return "", "", fmt.Errorf("no POST /predictions operation found for model %s", modelUUID)
 	}
+	operation := pathItem.Post
 
-	// Use JSONLookup to find the path item for "/predictions"
-	paths := swagger.Paths
-	pathItem := paths.Value("/predictions")
-	// Access its operations (like Get, Post, etc.)
-	operation := pathItem.GetOperation(http.MethodPost)
-	// Access the request body to get the example input
 	var reqExample, resExample string
 	if operation.RequestBody != nil && operation.RequestBody.Value != nil {
-		for _, mediaType := range operation.RequestBody.Value.Content {
-			if mediaType.Example != nil {
-				reqExampleBytes, err := json.Marshal(mediaType.Example)
-				if err != nil {
-					return "", "", fmt.Errorf("failed to marshal request example: %w", err)
-				}
-				reqExample = string(reqExampleBytes)
-			} else if mediaType.Schema != nil && mediaType.Schema.Value != nil {
-				schemaRef := mediaType.Schema
-				// Resolve $ref in the schema and its properties
-				schemaRef = resolveRefs(schemaRef, swagger)
-				if schemaRef.Value != nil {
-					// Create a map to hold the properties
-					propertiesMap := make(map[string]interface{})
-					// Iterate over the properties of the schema
-					for propertyName, property := range schemaRef.Value.Properties {
-						if property.Value != nil && property.Value.Default != nil {
-							propertiesMap[propertyName] = property.Value.Default
-						} else {
-							// check if the property has properties
-							if property.Value != nil && property.Value.Properties != nil {
-								// Create a map to hold the sub-properties
-								innerProps := make(map[string]interface{})
-								// Iterate over the sub-properties
-								for innerPropName, innerProp := range property.Value.Properties {
-									if innerProp.Value != nil && innerProp.Value.Default != nil {
-										innerProps[innerPropName] = innerProp.Value.Default
-									} else {
-										innerProps[innerPropName] = ""
-									}
-								}
-								propertiesMap[propertyName] = innerProps
-							} else {
-								propertiesMap[propertyName] = ""
-							}
-						}
-					}
-					// Marshal the properties map to a JSON string
-					reqExampleBytes, err := json.Marshal(propertiesMap)
-					if err != nil {
-						return "", "", fmt.Errorf("failed to marshal request properties: %w", err)
-					}
-					reqExample = string(reqExampleBytes)
-				}
-			}
-			break // Assuming we only need one example
-		}
-	}
-
-	// Access the responses to get the example output
-	response := operation.Responses.Value("200")
-	if response.Value != nil {
-		for _, mediaType := range response.Value.Content {
-			if mediaType.Example != nil {
-				resExampleBytes, err := json.Marshal(mediaType.Example)
-				if err != nil {
-					return "", "", fmt.Errorf("failed to marshal response example: %w", err)
-				}
-				resExample = string(resExampleBytes)
-			} else if mediaType.Schema != nil && mediaType.Schema.Value != nil {
-				schemaRef := mediaType.Schema
-				// Resolve $ref in the schema and its properties
-				schemaRef = resolveRefs(schemaRef, swagger)
-				if schemaRef.Value != nil {
-					// Create a map to hold the properties
-					propertiesMap := make(map[string]interface{})
-					// Iterate over the properties of the schema
-					for propertyName, property := range schemaRef.Value.Properties {
-						if property.Value != nil && property.Value.Default != nil {
-							propertiesMap[propertyName] = property.Value.Default
-						} else {
-							// check if the property has properties
-							if property.Value != nil && property.Value.Properties != nil {
-								// Create a map to hold the sub-properties
-								innerProps := make(map[string]interface{})
-								// Iterate over the sub-properties
-								for innerPropName, innerProp := range property.Value.Properties {
-									if innerProp.Value != nil && innerProp.Value.Default != nil {
-										innerProps[innerPropName] = innerProp.Value.Default
-									} else {
-										innerProps[innerPropName] = ""
-									}
-								}
-								propertiesMap[propertyName] = innerProps
-							} else {
-								propertiesMap[propertyName] = ""
-							}
-						}
-					}
-					// Marshal the properties map to a JSON string
-					resExampleBytes, err := json.Marshal(propertiesMap)
-					if err != nil {
-						return "", "", fmt.Errorf("failed to marshal response properties: %w", err)
-					}
-					resExample = string(resExampleBytes)
-				}
-			}
-			break // Assuming we only need one example
+		if reqExample, err = contentExample(operation.RequestBody.Value.Content); err != nil {
+			return "", "", err
+		}
+	}
+	if response := operation.Responses.Value(strconv.Itoa(http.StatusOK)); response != nil && response.Value != nil {
+		if resExample, err = contentExample(response.Value.Content); err != nil {
+			return "", "", err
 		}
 	}
 
@@ -153,3 +254,54 @@ func GetSampleIO(modelUUID string) (string, string, error) {
 
 	return "", "", fmt.Errorf("no examples found for /predictions")
 }
+
+// FieldDoc documents a field of the model Input schema
+type FieldDoc struct {
+	Name        string        `json:"name"`
+	Title       string        `json:"title,omitempty"`
+	Type        string        `json:"type,omitempty"`
+	Format      string        `json:"format,omitempty"`
+	Description string        `json:"description,omitempty"`
+	Default     interface{}   `json:"default,omitempty"`
+	Enum        []interface{} `json:"enum,omitempty"`
+	Minimum     *float64      `json:"minimum,omitempty"`
+	Maximum     *float64      `json:"maximum,omitempty"`
+	Required    bool          `json:"required"`
+	Example     interface{}   `json:"example,omitempty"`
+}
+
+// GetInputDocs documents every field of the model Input schema, in x-order
+func GetInputDocs(modelUUID string) ([]FieldDoc, error) {
+	schema, err := GetInputSchema(modelUUID, "")
+	if err != nil {
+		return nil, err
+	}
+	required := make(map[string]bool, len(schema.Required))
+	for _, name := range schema.Required {
+		required[name] = true
+	}
+
+	docs := make([]FieldDoc, 0, len(schema.Properties))
+	for _, name := range orderedProperties(schema) {
+		propertyRef := schema.Properties[name]
+		property := flattenSchema(propertyRef)
+		doc := FieldDoc{
+			Name:        name,
+			Title:       property.Title,
+			Type:        schemaType(propertyRef),
+			Format:      property.Format,
+			Description: property.Description,
+			Default:     property.Default,
+			Enum:        property.Enum,
+			Minimum:     property.Min,
+			Maximum:     property.Max,
+			Required:    required[name],
+			Example:     exampleValue(propertyRef, 0),
+		}
+		if doc.Type == openapi3.TypeArray && property.Items != nil {
+			doc.Type += "<" + schemaType(property.Items) + ">"
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
@@ -0,0 +1,110 @@
+package openapi
+
+import (
+	"context"
+	"cotelligence-model-hub/db"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/go-redis/redis/v8"
+)
+
+// Specs are stored per model and image version, the model points at the version it currently runs
+
+const specPrefix = "cotelligence-model:spec"
+const specVersionPrefix = "cotelligence-model:spec-version"
+
+var ErrSpecNotFound = errors.New("model spec not found")
+
+var ctx = context.Background()
+
+func specKey(modelUUID, imageVersion string) string {
+	return specPrefix + ":" + modelUUID + ":" + imageVersion
+}
+
+// SaveSpec stores the cog OpenAPI spec of the model image version, UseSpec makes it the current spec of the model
+func SaveSpec(modelUUID, imageVersion string, data []byte) error {
+	if _, err := openapi3.NewLoader().LoadFromData(data); err != nil {
+		return fmt.Errorf("failed to unmarshal OpenAPI JSON: %w", err)
+	}
+	client := db.GetRedisClient()
+	return client.Set(ctx, specKey(modelUUID, imageVersion), data, 0).Err()
+}
+
+// HasSpec reports whether the spec of the model image version is stored
+func HasSpec(modelUUID, imageVersion string) (bool, error) {
+	client := db.GetRedisClient()
+	exists, err := client.Exists(ctx, specKey(modelUUID, imageVersion)).Result()
+	return exists > 0, err
+}
+
+// UseSpec makes an already stored spec the current spec of the model, it reports whether one was stored
+func UseSpec(modelUUID, imageVersion string) (bool, error) {
+	client := db.GetRedisClient()
+	exists, err := client.Exists(ctx, specKey(modelUUID, imageVersion)).Result()
+	if err != nil || exists == 0 {
+		return false, err
+	}
+	return true, client.Set(ctx, specVersionPrefix+":"+modelUUID, imageVersion, 0).Err()
+}
+
+// GetImageSpec returns the cog OpenAPI spec of the model image version, an empty version is the current spec
+func GetImageSpec(modelUUID, imageVersion string) ([]byte, error) {
+	if imageVersion == "" {
+		return GetSpec(modelUUID)
+	}
+	client := db.GetRedisClient()
+	data, err := client.Get(ctx, specKey(modelUUID, imageVersion)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("%w: %s@%s", ErrSpecNotFound, modelUUID, imageVersion)
+	}
+	return data, err
+}
+
+// GetSpec returns the current cog OpenAPI spec of the model,
+// models registered before discovery fall back to their model_spec/<uuid>.json file
+func GetSpec(modelUUID string) ([]byte, error) {
+	client := db.GetRedisClient()
+	imageVersion, err := client.Get(ctx, specVersionPrefix+":"+modelUUID).Result()
+	if err == nil {
+		data, err := client.Get(ctx, specKey(modelUUID, imageVersion)).Bytes()
+		if err == nil {
+			return data, nil
+		}
+		if !errors.Is(err, redis.Nil) {
+			return nil, err
+		}
+	} else if !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	return ReadSpecFile(modelUUID)
+}
+
+// ReadSpecFile reads the model_spec/<uuid>.json spec of a model registered before discovery existed
+func ReadSpecFile(modelUUID string) ([]byte, error) {
+	data, err := os.ReadFile(fmt.Sprintf("model_spec/%s.json", modelUUID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrSpecNotFound, modelUUID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OpenAPI JSON file: %w", err)
+	}
+	return data, nil
+}
+
+// RemoveSpecs deletes every stored spec of the model
+func RemoveSpecs(modelUUID string) error {
+	client := db.GetRedisClient()
+	keys := []string{specVersionPrefix + ":" + modelUUID}
+	iter := client.Scan(ctx, 0, specPrefix+":"+modelUUID+":*", 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	return client.Del(ctx, keys...).Err()
+}
@@ -0,0 +1,95 @@
+package openapi
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+// InputViolation is an input field that does not match the model Input schema
+type InputViolation struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func init() {
+	// cog file inputs are urls, including data: urls
+	openapi3.DefineStringFormatCallback("uri", func(value string) error {
+		u, err := url.Parse(value)
+		if err != nil || u.Scheme == "" {
+			return errors.New("not a valid uri")
+		}
+		return nil
+	})
+}
+
+// ValidateInput checks the prediction input against the Input schema of the model and returns every violation,
+// models without a spec, a nil schema, are not validated
+func ValidateInput(schema *openapi3.Schema, input map[string]interface{}) []InputViolation {
+	if schema == nil {
+		return nil
+	}
+	return validateAgainst(schema, input)
+}
+
+// ValidateTrainingInput checks the training input against the TrainingInput schema of the model image version
+func ValidateTrainingInput(modelUUID, imageVersion string, input map[string]interface{}) ([]InputViolation, error) {
+	schema, err := GetTrainingInputSchema(modelUUID, imageVersion)
+	if err != nil {
+		return nil, err
+	}
+	return validateAgainst(schema, input), nil
+}
+
+// validateAgainst returns every violation of the schema by the input
+func validateAgainst(schema *openapi3.Schema, input map[string]interface{}) []InputViolation {
+	if input == nil {
+		input = map[string]interface{}{}
+	}
+
+	err := schema.VisitJSON(input, openapi3.MultiErrors(), openapi3.EnableFormatValidation(), openapi3.VisitAsRequest())
+	if err == nil {
+		return nil
+	}
+	var violations []InputViolation
+	collectViolations(err, nil, &violations)
+	return violations
+}
+
+// collectViolations flattens the kin-openapi errors, nested allOf errors keep the path of the field they belong to
+func collectViolations(err error, path []string, violations *[]InputViolation) {
+	var multiError openapi3.MultiError
+	if errors.As(err, &multiError) {
+		for _, e := range multiError {
+			collectViolations(e, path, violations)
+		}
+		return
+	}
+	var schemaError *openapi3.SchemaError
+	if !errors.As(err, &schemaError) {
+		*violations = append(*violations, InputViolation{Field: strings.Join(path, "."), Message: err.Error()})
+		return
+	}
+
+	fieldPath := append(append([]string(nil), path...), schemaError.JSONPointer()...)
+	if schemaError.Origin != nil {
+		var originMulti openapi3.MultiError
+		var originSchema *openapi3.SchemaError
+		if errors.As(schemaError.Origin, &originMulti) || errors.As(schemaError.Origin, &originSchema) {
+			collectViolations(schemaError.Origin, fieldPath, violations)
+			return
+		}
+	}
+	if schemaError.SchemaField == "required" {
+		var property string
+		// kin-openapi points at the missing property itself, older errors point at its object
+		_, err := fmt.Sscanf(schemaError.Reason, "property %q is missing", &property)
+		if err == nil && (len(fieldPath) == 0 || fieldPath[len(fieldPath)-1] != property) {
+			fieldPath = append(fieldPath, property)
+		}
+	}
+	*violations = append(*violations, InputViolation{Field: strings.Join(fieldPath, "."), Message: schemaError.Reason})
+}
@@ -0,0 +1,121 @@
+package openapi
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+// testSpec is a cog spec in the shape cog generates, with an enum behind allOf and a file input
+const testSpec = `{
+  "openapi": "3.0.2",
+  "info": {"title": "Cog", "version": "0.1.0"},
+  "paths": {},
+  "components": {
+    "schemas": {
+      "Input": {
+        "title": "Input",
+        "type": "object",
+        "required": ["prompt"],
+        "properties": {
+          "prompt": {"title": "Prompt", "type": "string", "x-order": 0},
+          "guidance_scale": {"title": "Guidance Scale", "type": "number", "default": 7.5, "x-order": 1},
+          "num_outputs": {"title": "Num Outputs", "type": "integer", "minimum": 1, "maximum": 4, "default": 1, "x-order": 2},
+          "scheduler": {"allOf": [{"$ref": "#/components/schemas/scheduler"}], "default": "DDIM", "x-order": 3},
+          "image": {"title": "Image", "type": "string", "format": "uri", "x-order": 4},
+          "seed": {"title": "Seed", "type": "integer"}
+        }
+      },
+      "scheduler": {"title": "scheduler", "type": "string", "enum": ["DDIM", "K_EULER"]}
+    }
+  }
+}`
+
+func loadTestInputSchema(t *testing.T) *openapi3.Schema {
+	t.Helper()
+	swagger, err := openapi3.NewLoader().LoadFromData([]byte(testSpec))
+	if err != nil {
+		t.Fatalf("failed to load the test spec: %v", err)
+	}
+	return swagger.Components.Schemas["Input"].Value
+}
+
+func violationFields(violations []InputViolation) []string {
+	fields := make([]string, 0, len(violations))
+	for _, violation := range violations {
+		fields = append(fields, violation.Field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func TestValidateInput(t *testing.T) {
+	schema := loadTestInputSchema(t)
+	tests := []struct {
+		name   string
+		input  map[string]interface{}
+		fields []string
+	}{
+		{
+			name:   "valid",
+			input:  map[string]interface{}{"prompt": "a cat", "num_outputs": float64(2), "scheduler": "K_EULER", "image": "https://example.com/cat.png"},
+			fields: []string{},
+		},
+		{
+			name:   "data uri file",
+			input:  map[string]interface{}{"prompt": "a cat", "image": "data:image/png;base64,iVBORw0KGgo="},
+			fields: []string{},
+		},
+		{
+			name:   "missing required",
+			input:  map[string]interface{}{},
+			fields: []string{"prompt"},
+		},
+		{
+			name:   "above maximum",
+			input:  map[string]interface{}{"prompt": "a cat", "num_outputs": float64(10)},
+			fields: []string{"num_outputs"},
+		},
+		{
+			name:   "not in enum",
+			input:  map[string]interface{}{"prompt": "a cat", "scheduler": "PNDM"},
+			fields: []string{"scheduler"},
+		},
+		{
+			name:   "not a uri",
+			input:  map[string]interface{}{"prompt": "a cat", "image": "cat.png"},
+			fields: []string{"image"},
+		},
+		{
+			name:   "wrong type",
+			input:  map[string]interface{}{"prompt": "a cat", "guidance_scale": "high"},
+			fields: []string{"guidance_scale"},
+		},
+		{
+			name:   "every violation",
+			input:  map[string]interface{}{"num_outputs": float64(0), "scheduler": "PNDM"},
+			fields: []string{"num_outputs", "prompt", "scheduler"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			violations := ValidateInput(schema, tt.input)
+			if fields := violationFields(violations); !reflect.DeepEqual(fields, tt.fields) {
+				t.Errorf("ValidateInput() fields = %v, want %v (%v)", fields, tt.fields, violations)
+			}
+			for _, violation := range violations {
+				if violation.Message == "" {
+					t.Errorf("ValidateInput() violation of %s has no message", violation.Field)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateInputWithoutSpec(t *testing.T) {
+	if violations := ValidateInput(nil, map[string]interface{}{"anything": true}); violations != nil {
+		t.Errorf("ValidateInput() without a spec = %v, want none", violations)
+	}
+}